@@ -0,0 +1,63 @@
+package account
+
+import (
+	"net/http"
+
+	"debrid_drive/config"
+	"debrid_drive/provider"
+	"debrid_drive/provider/real_debrid"
+)
+
+// A debrid account with its own provider and directory in the file system
+type Account struct {
+	name       string
+	directory  string
+	pollSource string
+	pollUrl    string
+	provider   provider.Provider
+}
+
+func New(accountConfig config.Account, provider provider.Provider) *Account {
+	return &Account{
+		name:       accountConfig.Name,
+		directory:  accountConfig.Directory,
+		pollSource: accountConfig.PollSource,
+		pollUrl:    accountConfig.PollUrl,
+		provider:   provider,
+	}
+}
+
+// Accounts from the loaded config
+func FromConfig() []*Account {
+	accountConfigs := config.GetAccounts()
+
+	accounts := make([]*Account, 0, len(accountConfigs))
+	for _, accountConfig := range accountConfigs {
+		provider := real_debrid.New(accountConfig.RealDebridToken, real_debrid.Instrument(accountConfig.Name, &http.Client{}))
+
+		accounts = append(accounts, New(accountConfig, provider))
+	}
+
+	return accounts
+}
+
+func (account *Account) GetName() string {
+	return account.name
+}
+
+// Path from the root of the file system, separated by slashes
+func (account *Account) GetDirectory() string {
+	return account.directory
+}
+
+func (account *Account) GetPollSource() string {
+	return account.pollSource
+}
+
+func (account *Account) GetPollUrl() string {
+	return account.pollUrl
+}
+
+func (account *Account) GetProvider() provider.Provider {
+	return account.provider
+}
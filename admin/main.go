@@ -0,0 +1,115 @@
+package admin
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"debrid_drive/config"
+	"debrid_drive/database"
+
+	media_repository "debrid_drive/media/repository"
+)
+
+type command struct {
+	usage       string
+	description string
+	run         func(mediaRepository *media_repository.MediaRepository, args []string) error
+}
+
+var commands = map[string]map[string]command{
+	"removals": {
+		"list": {
+			usage:       "admin removals list",
+			description: "List removals held back by the mass deletion guard",
+			run:         listHeldRemovals,
+		},
+		"confirm": {
+			usage:       "admin removals confirm [torrent id...]",
+			description: "Confirm held removals, all of them when no ids are given. They are applied on the next poll",
+			run:         confirmHeldRemovals,
+		},
+	},
+	"trash": {
+		"list": {
+			usage:       "admin trash list",
+			description: "List files in the trash with their original path and when their torrent is deleted",
+			run:         listTrash,
+		},
+		"restore": {
+			usage:       "admin trash restore [entry id...]",
+			description: "Restore files from the trash to their original path, all of them when no ids are given. They are restored within a minute",
+			run:         restoreTrash,
+		},
+	},
+	"rejections": {
+		"list": {
+			usage:       "admin rejections list",
+			description: "List rejected torrents with their reason and next retry",
+			run:         listRejections,
+		},
+		"clear": {
+			usage:       "admin rejections clear [torrent id...]",
+			description: "Clear rejections, all of them when no ids are given. The torrents are tried again on the next poll",
+			run:         clearRejections,
+		},
+	},
+}
+
+// Runs an admin command against the media database, e.g. "admin removals list"
+func Run(args []string) error {
+	if len(args) < 2 {
+		printUsage(os.Stderr)
+		return fmt.Errorf("missing command")
+	}
+
+	group, ok := commands[args[0]]
+	if !ok {
+		printUsage(os.Stderr)
+		return fmt.Errorf("unknown command: %s", args[0])
+	}
+
+	command, ok := group[args[1]]
+	if !ok {
+		printUsage(os.Stderr)
+		return fmt.Errorf("unknown command: %s %s", args[0], args[1])
+	}
+
+	instance, err := database.NewInstance(config.GetMediaDatabasePath())
+	if err != nil {
+		return err
+	}
+	defer instance.Close()
+
+	mediaRepository := media_repository.NewMediaService(instance.GetDatabase())
+
+	return command.run(mediaRepository, args[2:])
+}
+
+func printUsage(writer io.Writer) {
+	fmt.Fprintln(writer, "Usage:")
+
+	usages := make([]command, 0)
+	for _, group := range commands {
+		for _, command := range group {
+			usages = append(usages, command)
+		}
+	}
+
+	sort.Slice(usages, func(i, j int) bool {
+		return usages[i].usage < usages[j].usage
+	})
+
+	table := tabwriter.NewWriter(writer, 0, 4, 2, ' ', 0)
+	for _, command := range usages {
+		fmt.Fprintf(table, "  %s\t%s\n", command.usage, command.description)
+	}
+
+	table.Flush()
+}
+
+func newTable() *tabwriter.Writer {
+	return tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+}
@@ -0,0 +1,55 @@
+package admin
+
+import (
+	"fmt"
+	"time"
+
+	media_repository "debrid_drive/media/repository"
+)
+
+func listRejections(mediaRepository *media_repository.MediaRepository, args []string) error {
+	rejectedTorrents, err := mediaRepository.GetRejectedTorrents()
+	if err != nil {
+		return err
+	}
+
+	if len(rejectedTorrents) == 0 {
+		fmt.Println("No rejected torrents")
+		return nil
+	}
+
+	table := newTable()
+	fmt.Fprintln(table, "TORRENT ID\tACCOUNT\tNAME\tREASON\tREJECTED AT\tATTEMPTS\tNEXT RETRY")
+
+	for _, rejectedTorrent := range rejectedTorrents {
+		nextRetry := "never"
+		if !rejectedTorrent.GetRetryAt().IsZero() {
+			nextRetry = rejectedTorrent.GetRetryAt().Format(time.RFC3339)
+		}
+
+		fmt.Fprintf(
+			table,
+			"%s\t%s\t%s\t%s\t%s\t%d\t%s\n",
+			rejectedTorrent.GetTorrentIdentifier(),
+			rejectedTorrent.GetAccount(),
+			rejectedTorrent.GetName(),
+			rejectedTorrent.GetReason(),
+			rejectedTorrent.GetRejectedAt().Format(time.RFC3339),
+			rejectedTorrent.GetAttempts(),
+			nextRetry,
+		)
+	}
+
+	return table.Flush()
+}
+
+func clearRejections(mediaRepository *media_repository.MediaRepository, args []string) error {
+	count, err := mediaRepository.ClearRejectedTorrents(args)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Cleared %d rejections, the torrents are tried again on the next poll\n", count)
+
+	return nil
+}
@@ -0,0 +1,54 @@
+package admin
+
+import (
+	"fmt"
+
+	"debrid_drive/config"
+
+	media_repository "debrid_drive/media/repository"
+)
+
+func listHeldRemovals(mediaRepository *media_repository.MediaRepository, args []string) error {
+	heldRemovals := make([]*media_repository.HeldRemoval, 0)
+
+	for _, account := range config.GetAccounts() {
+		accountHeldRemovals, err := mediaRepository.GetHeldRemovals(account.Name)
+		if err != nil {
+			return err
+		}
+
+		heldRemovals = append(heldRemovals, accountHeldRemovals...)
+	}
+
+	if len(heldRemovals) == 0 {
+		fmt.Println("No held removals")
+		return nil
+	}
+
+	table := newTable()
+	fmt.Fprintln(table, "TORRENT ID\tACCOUNT\tNAME\tHELD AT\tCONFIRMED")
+
+	for _, heldRemoval := range heldRemovals {
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%t\n", heldRemoval.GetTorrentIdentifier(), heldRemoval.GetAccount(), heldRemoval.GetName(), heldRemoval.GetHeldAt(), heldRemoval.IsConfirmed())
+	}
+
+	return table.Flush()
+}
+
+// Held removals are kept per account, the ids are confirmed in every account that holds them
+func confirmHeldRemovals(mediaRepository *media_repository.MediaRepository, args []string) error {
+	var count int64
+
+	for _, account := range config.GetAccounts() {
+		accountCount, err := mediaRepository.ConfirmHeldRemovals(account.Name, args)
+		if err != nil {
+			return err
+		}
+
+		count += accountCount
+	}
+
+	fmt.Printf("Confirmed %d held removals, they will be applied on the next poll\n", count)
+
+	return nil
+}
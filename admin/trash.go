@@ -0,0 +1,70 @@
+package admin
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"debrid_drive/config"
+
+	media_repository "debrid_drive/media/repository"
+)
+
+func listTrash(mediaRepository *media_repository.MediaRepository, args []string) error {
+	trashEntries, err := mediaRepository.GetTrashEntries()
+	if err != nil {
+		return err
+	}
+
+	if len(trashEntries) == 0 {
+		fmt.Println("The trash is empty")
+		return nil
+	}
+
+	table := newTable()
+	fmt.Fprintln(table, "ID\tTORRENT ID\tACCOUNT\tORIGINAL PATH\tTRASHED AT\tPURGED AT\tRESTORE REQUESTED")
+
+	for _, trashEntry := range trashEntries {
+		// Without a retention the trash is emptied on the next check
+		purgedAt := "next check"
+		if retention := config.GetTrashRetention(); retention > 0 {
+			purgedAt = trashEntry.GetTrashedAt().Add(retention).Format(time.RFC3339)
+		}
+
+		fmt.Fprintf(
+			table,
+			"%d\t%s\t%s\t%s\t%s\t%s\t%t\n",
+			trashEntry.GetIdentifier(),
+			trashEntry.GetTorrentIdentifier(),
+			trashEntry.GetAccount(),
+			trashEntry.GetOriginalPath(),
+			trashEntry.GetTrashedAt().Format(time.RFC3339),
+			purgedAt,
+			trashEntry.IsRestoreRequested(),
+		)
+	}
+
+	return table.Flush()
+}
+
+func restoreTrash(mediaRepository *media_repository.MediaRepository, args []string) error {
+	identifiers := make([]uint64, 0, len(args))
+
+	for _, arg := range args {
+		identifier, err := strconv.ParseUint(arg, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid trash entry id: %s", arg)
+		}
+
+		identifiers = append(identifiers, identifier)
+	}
+
+	count, err := mediaRepository.RequestTrashRestores(identifiers)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Requested %d restores, the files are moved back within a minute\n", count)
+
+	return nil
+}
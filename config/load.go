@@ -0,0 +1,186 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Every field can be overridden with DEBRID_DRIVE_ followed by its yaml key in upper case, e.g. DEBRID_DRIVE_REAL_DEBRID_TOKEN
+// Appending _FILE reads the value from a file instead, e.g. DEBRID_DRIVE_REAL_DEBRID_TOKEN_FILE=/run/secrets/token
+// Tokens of listed accounts are overridden with DEBRID_DRIVE_ACCOUNT_ followed by the account name, e.g. DEBRID_DRIVE_ACCOUNT_ALICE_REAL_DEBRID_TOKEN
+const environmentPrefix = "DEBRID_DRIVE_"
+
+var current atomic.Pointer[Config]
+
+// Where the current config was loaded from, used when watching for changes
+var source struct {
+	path     string
+	required bool
+}
+
+// Parses the config file once, applies environment overrides and validates the result
+// A missing file is only an error when required, so a config can come from the environment alone
+func Load(path string, required bool) error {
+	cfg, err := parse(path, required)
+	if err != nil {
+		return err
+	}
+
+	err = validate(cfg)
+	if err != nil {
+		return err
+	}
+
+	current.Store(&cfg)
+
+	source.path = path
+	source.required = required
+
+	forgetIgnoredChanges()
+
+	return nil
+}
+
+func parse(path string, required bool) (Config, error) {
+	var cfg Config
+
+	err := parseFile(path, &cfg)
+	if err != nil && (required || !errors.Is(err, fs.ErrNotExist)) {
+		return Config{}, err
+	}
+
+	err = applyEnvironment(&cfg)
+	if err != nil {
+		return Config{}, err
+	}
+
+	return cfg, nil
+}
+
+func parseFile(path string, cfg *Config) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("Failed to open config file: %w", err)
+	}
+	defer file.Close()
+
+	decoder := yaml.NewDecoder(file)
+
+	err = decoder.Decode(cfg)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("Failed to parse config file %s: %w", path, err)
+	}
+
+	return nil
+}
+
+func applyEnvironment(cfg *Config) error {
+	value := reflect.ValueOf(cfg).Elem()
+	valueType := value.Type()
+
+	for i := 0; i < valueType.NumField(); i++ {
+		field := valueType.Field(i)
+
+		key := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if key == "" || key == "-" {
+			continue
+		}
+
+		// Lists and maps are only configured in the file
+		if field.Type.Kind() == reflect.Slice || field.Type.Kind() == reflect.Map {
+			continue
+		}
+
+		name := environmentPrefix + strings.ToUpper(key)
+
+		raw, ok, err := lookupEnvironment(name)
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			continue
+		}
+
+		err = setField(value.Field(i), raw)
+		if err != nil {
+			return fmt.Errorf("Invalid value for %s: %w", name, err)
+		}
+	}
+
+	for i := range cfg.Accounts {
+		name := environmentPrefix + "ACCOUNT_" + strings.ToUpper(cfg.Accounts[i].Name) + "_REAL_DEBRID_TOKEN"
+
+		raw, ok, err := lookupEnvironment(name)
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			cfg.Accounts[i].RealDebridToken = raw
+		}
+	}
+
+	return nil
+}
+
+func lookupEnvironment(name string) (string, bool, error) {
+	if raw, ok := os.LookupEnv(name); ok {
+		return raw, true, nil
+	}
+
+	path, ok := os.LookupEnv(name + "_FILE")
+	if !ok {
+		return "", false, nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", false, fmt.Errorf("Failed to read %s_FILE: %w", name, err)
+	}
+
+	return strings.TrimSpace(string(content)), true, nil
+}
+
+func setField(field reflect.Value, raw string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(raw)
+	case reflect.Int:
+		parsed, err := strconv.Atoi(raw)
+		if err != nil {
+			return err
+		}
+
+		field.SetInt(int64(parsed))
+	case reflect.Bool:
+		parsed, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+
+		field.SetBool(parsed)
+	case reflect.Pointer:
+		value := reflect.New(field.Type().Elem())
+
+		err := setField(value.Elem(), raw)
+		if err != nil {
+			return err
+		}
+
+		field.Set(value)
+	default:
+		return fmt.Errorf("unsupported type %s", field.Kind())
+	}
+
+	return nil
+}
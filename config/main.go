@@ -1,52 +1,239 @@
 package config
 
 import (
-	"os"
+	"fmt"
+	"maps"
+	"net"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
+)
+
+const (
+	PollSourcePage = "page"
+	PollSourceApi  = "api"
+)
+
+// How links that point to an archive instead of a single file are handled
+const (
+	// The archive is listed as a single file next to the files that have their own link
+	ArchivePolicyFile = "file"
+	// The torrent is rejected
+	ArchivePolicyReject = "reject"
+)
+
+// What removing a file through the file system removes
+const (
+	// The torrent with all of its files, it is deleted from debrid
+	RemovalPolicyTorrent = "torrent"
+	// Only the file, the torrent is deleted from debrid when its last file is removed
+	RemovalPolicyFile = "file"
+)
 
-	"gopkg.in/yaml.v3"
+// Format of the log output on stdout, log files are always json
+const (
+	LogFormatText = "text"
+	LogFormatJson = "json"
 )
 
+const (
+	// Torrents added before accounts existed belong to this account
+	DefaultAccountName      = "default"
+	defaultAccountDirectory = "media_manager"
+)
+
+// Fields tagged with reload are picked up when the config file changes, the others require a restart
 type Config struct {
-	ContentType           string `yaml:"content_type"`
-	PollUrl               string `yaml:"poll_url"`
-	PollIntervalSeconds   int    `yaml:"poll_interval_seconds"`
-	Port                  int    `yaml:"port"`
-	RealDebridToken       string `yaml:"real_debrid_token"`
-	UseFilenameInLister   bool   `yaml:"use_filename_in_lister"`
-	UseIdInFilenameLister bool   `yaml:"use_id_in_filename_lister"`
+	ContentType                string            `yaml:"content_type"`
+	PollUrl                    string            `yaml:"poll_url"`
+	PollSource                 string            `yaml:"poll_source"`
+	PollIntervalSeconds        int               `yaml:"poll_interval_seconds" reload:"true"`
+	Port                       int               `yaml:"port"`
+	BindAddress                string            `yaml:"bind_address"`
+	TlsCertFile                string            `yaml:"tls_cert_file"`
+	TlsKeyFile                 string            `yaml:"tls_key_file"`
+	TlsClientCaFile            string            `yaml:"tls_client_ca_file"`
+	AuthToken                  string            `yaml:"auth_token" reload:"true"`
+	Clients                    []Client          `yaml:"clients" reload:"true"`
+	ReadOnly                   bool              `yaml:"read_only" reload:"true"`
+	HttpPort                   int               `yaml:"http_port"`
+	ShutdownTimeoutSeconds     int               `yaml:"shutdown_timeout_seconds"`
+	RealDebridToken            string            `yaml:"real_debrid_token"`
+	UseFilenameInLister        bool              `yaml:"use_filename_in_lister" reload:"true"`
+	UseIdInFilenameLister      bool              `yaml:"use_id_in_filename_lister" reload:"true"`
+	StreamUrlTtlSeconds        int               `yaml:"stream_url_ttl_seconds" reload:"true"`
+	SymlinkQuarantineDirectory string            `yaml:"symlink_quarantine_directory" reload:"true"`
+	RemovalGuardMaxCount       *int              `yaml:"removal_guard_max_count" reload:"true"`
+	RemovalGuardMaxPercent     int               `yaml:"removal_guard_max_percent" reload:"true"`
+	ArchivePolicy              string            `yaml:"archive_policy" reload:"true"`
+	LinkCheckIntervalSeconds   int               `yaml:"link_check_interval_seconds" reload:"true"`
+	LinkCheckMaxAgeSeconds     int               `yaml:"link_check_max_age_seconds" reload:"true"`
+	LinkCheckBatchSize         int               `yaml:"link_check_batch_size" reload:"true"`
+	TrashRetentionHours        int               `yaml:"trash_retention_hours" reload:"true"`
+	RemovalPolicy              string            `yaml:"removal_policy" reload:"true"`
+	DataDirectory              string            `yaml:"data_directory"`
+	MediaDatabasePath          string            `yaml:"media_database_path"`
+	FileSystemDatabasePath     string            `yaml:"file_system_database_path"`
+	LogDirectory               string            `yaml:"log_directory"`
+	LogLevel                   string            `yaml:"log_level" reload:"true"`
+	LogLevels                  map[string]string `yaml:"log_levels" reload:"true"`
+	LogFormat                  string            `yaml:"log_format"`
+	LogMaxSizeMegabytes        int               `yaml:"log_max_size_mb"`
+	LogMaxAgeHours             int               `yaml:"log_max_age_hours"`
+	LogMaxBackups              int               `yaml:"log_max_backups"`
+	Accounts                   []Account         `yaml:"accounts"`
+}
+
+// A debrid account, the top level token and poll settings form the "default" account when no accounts are listed
+type Account struct {
+	Name            string `yaml:"name"`
+	RealDebridToken string `yaml:"real_debrid_token"`
+	PollSource      string `yaml:"poll_source"`
+	PollUrl         string `yaml:"poll_url"`
+	// Path from the root of the file system where the torrents of this account are listed
+	Directory string `yaml:"directory"`
 }
 
+// A grpc client with a token of its own, the token in the authorization metadata identifies it
+type Client struct {
+	Name  string `yaml:"name"`
+	Token string `yaml:"token"`
+	// Create, Remove, Rename, Mkdir, Link and WriteFile fail with EROFS for this client
+	ReadOnly bool `yaml:"read_only"`
+}
+
+// Snapshot of the loaded config, panics when Load has not been called
 func get() Config {
-	file, err := os.Open("config.yml")
-	if err != nil {
-		panic(err)
+	cfg := current.Load()
+	if cfg == nil {
+		panic("Config is not loaded")
 	}
-	defer file.Close()
 
-	decoder := yaml.NewDecoder(file)
-	var cfg Config
-	if err := decoder.Decode(&cfg); err != nil {
-		panic(err)
+	return *cfg
+}
+
+// Returns a copy of the loaded config, changing it doesn't change the loaded config
+func Get() Config {
+	return get().clone()
+}
+
+// Copies the slices, maps and pointers the struct copy of get would share
+func (cfg Config) clone() Config {
+	cfg.Clients = slices.Clone(cfg.Clients)
+	cfg.LogLevels = maps.Clone(cfg.LogLevels)
+	cfg.Accounts = slices.Clone(cfg.Accounts)
+
+	if cfg.RemovalGuardMaxCount != nil {
+		maxCount := *cfg.RemovalGuardMaxCount
+		cfg.RemovalGuardMaxCount = &maxCount
 	}
 
 	return cfg
 }
 
-func Validate() {
-	cfg := get()
+func validate(cfg Config) error {
+	network, _ := cfg.listenAddress()
+	if cfg.Port == 0 && network != "unix" {
+		return fmt.Errorf("Port is not set")
+	}
+
+	if (cfg.TlsCertFile == "") != (cfg.TlsKeyFile == "") {
+		return fmt.Errorf("TLS needs both tls_cert_file and tls_key_file")
+	}
 
-	if cfg.Port == 0 {
-		panic("Port is not set")
+	if cfg.TlsClientCaFile != "" && cfg.TlsCertFile == "" {
+		return fmt.Errorf("Client certificates need TLS, set tls_cert_file and tls_key_file")
 	}
 
 	if cfg.ContentType == "" {
-		panic("Content type is not set")
+		return fmt.Errorf("Content type is not set")
+	}
+
+	clientNames := make(map[string]bool)
+	tokens := map[string]bool{cfg.AuthToken: cfg.AuthToken != ""}
+
+	for _, client := range cfg.Clients {
+		if client.Name == "" || client.Token == "" {
+			return fmt.Errorf("Clients need both a name and a token")
+		}
+
+		if clientNames[client.Name] {
+			return fmt.Errorf("Client %s is listed more than once", client.Name)
+		}
+
+		if tokens[client.Token] {
+			return fmt.Errorf("Client %s uses the same token as another client or auth_token", client.Name)
+		}
+
+		clientNames[client.Name] = true
+		tokens[client.Token] = true
+	}
+
+	for service, level := range cfg.LogLevels {
+		if !validLogLevel(level) {
+			return fmt.Errorf("Log level %s of %s must be one of debug, info, warn or error", level, service)
+		}
 	}
 
-	if cfg.RealDebridToken == "" {
-		panic("Real Debrid token is not set")
+	if cfg.LogLevel != "" && !validLogLevel(cfg.LogLevel) {
+		return fmt.Errorf("Log level must be one of debug, info, warn or error")
 	}
+
+	switch cfg.LogFormat {
+	case "", LogFormatText, LogFormatJson:
+	default:
+		return fmt.Errorf("Log format must be either \"text\" or \"json\"")
+	}
+
+	switch cfg.ArchivePolicy {
+	case "", ArchivePolicyFile, ArchivePolicyReject:
+	default:
+		return fmt.Errorf("Archive policy must be either \"file\" or \"reject\"")
+	}
+
+	switch cfg.RemovalPolicy {
+	case "", RemovalPolicyTorrent, RemovalPolicyFile:
+	default:
+		return fmt.Errorf("Removal policy must be either \"torrent\" or \"file\"")
+	}
+
+	names := make(map[string]bool)
+	directories := make(map[string]bool)
+
+	for _, account := range cfg.accounts() {
+		if account.Name == "" {
+			return fmt.Errorf("Account name is not set")
+		}
+
+		if names[account.Name] {
+			return fmt.Errorf("Account %s is listed more than once", account.Name)
+		}
+
+		if directories[account.Directory] {
+			return fmt.Errorf("Account %s uses the same directory as another account: %s", account.Name, account.Directory)
+		}
+
+		names[account.Name] = true
+		directories[account.Directory] = true
+
+		if account.RealDebridToken == "" {
+			return fmt.Errorf("Real Debrid token is not set for account %s", account.Name)
+		}
+
+		switch account.PollSource {
+		case PollSourcePage:
+			if account.PollUrl == "" {
+				return fmt.Errorf("Poll url is not set for account %s, it is required for the page poll source", account.Name)
+			}
+		case PollSourceApi:
+		default:
+			return fmt.Errorf("Poll source for account %s must be either \"page\" or \"api\"", account.Name)
+		}
+	}
+
+	return nil
 }
 
 func GetContentType() string {
@@ -61,6 +248,70 @@ func GetPollUrl() string {
 	return cfg.PollUrl
 }
 
+func GetPollSource() string {
+	cfg := get()
+
+	return cfg.pollSource()
+}
+
+// Defaults to the page when a poll url is set, for backwards compatibility
+func (cfg Config) pollSource() string {
+	if cfg.PollSource == "" {
+		if cfg.PollUrl != "" {
+			return PollSourcePage
+		}
+
+		return PollSourceApi
+	}
+
+	return cfg.PollSource
+}
+
+// Accounts with their defaults applied
+func GetAccounts() []Account {
+	cfg := get()
+
+	return cfg.accounts()
+}
+
+func (cfg Config) accounts() []Account {
+	if len(cfg.Accounts) == 0 {
+		return []Account{
+			{
+				Name:            DefaultAccountName,
+				RealDebridToken: cfg.RealDebridToken,
+				PollSource:      cfg.pollSource(),
+				PollUrl:         cfg.PollUrl,
+				Directory:       defaultAccountDirectory,
+			},
+		}
+	}
+
+	accounts := make([]Account, 0, len(cfg.Accounts))
+
+	for _, account := range cfg.Accounts {
+		if account.PollSource == "" {
+			account.PollSource = PollSourceApi
+
+			if account.PollUrl != "" {
+				account.PollSource = PollSourcePage
+			}
+		}
+
+		if account.Directory == "" {
+			account.Directory = defaultAccountDirectory
+
+			if len(cfg.Accounts) > 1 {
+				account.Directory = defaultAccountDirectory + "/" + account.Name
+			}
+		}
+
+		accounts = append(accounts, account)
+	}
+
+	return accounts
+}
+
 func GetPollIntervalSeconds() time.Duration {
 	cfg := get()
 
@@ -77,6 +328,75 @@ func GetPort() int {
 	return cfg.Port
 }
 
+// Network and address the grpc server listens on, a unix socket when bind_address starts with unix:
+func GetListenAddress() (string, string) {
+	cfg := get()
+
+	return cfg.listenAddress()
+}
+
+// All interfaces when no bind address is set
+func (cfg Config) listenAddress() (string, string) {
+	if path, ok := strings.CutPrefix(cfg.BindAddress, "unix:"); ok {
+		// unix:///run/debrid_drive.sock is the same as unix:/run/debrid_drive.sock
+		return "unix", strings.TrimPrefix(path, "//")
+	}
+
+	return "tcp", net.JoinHostPort(cfg.BindAddress, strconv.Itoa(cfg.Port))
+}
+
+// Certificate and key of the grpc server, TLS is off when empty
+func GetTlsFiles() (string, string) {
+	cfg := get()
+
+	return cfg.TlsCertFile, cfg.TlsKeyFile
+}
+
+// CA that client certificates must be signed by, client certificates are not required when empty
+func GetTlsClientCaFile() string {
+	cfg := get()
+
+	return cfg.TlsClientCaFile
+}
+
+// Shared secret grpc clients send as a bearer token, no token is required when it is empty and no clients are listed
+func GetAuthToken() string {
+	cfg := get()
+
+	return cfg.AuthToken
+}
+
+func GetClients() []Client {
+	cfg := get()
+
+	return slices.Clone(cfg.Clients)
+}
+
+// Makes the file system read only for every client
+func GetReadOnly() bool {
+	cfg := get()
+
+	return cfg.ReadOnly
+}
+
+// Port of the optional http listener for health checks, 0 when disabled
+func GetHttpPort() int {
+	cfg := get()
+
+	return cfg.HttpPort
+}
+
+// Time given to grpc calls, reconciliation and link checks to finish on shutdown, below the 10 second stop grace period of Docker by default
+func GetShutdownTimeout() time.Duration {
+	cfg := get()
+
+	if cfg.ShutdownTimeoutSeconds <= 0 {
+		return 8 * time.Second
+	}
+
+	return time.Duration(cfg.ShutdownTimeoutSeconds) * time.Second
+}
+
 func GetRealDebridToken() string {
 	cfg := get()
 
@@ -94,3 +414,227 @@ func GetUseIdInFilenameLister() bool {
 
 	return cfg.UseIdInFilenameLister
 }
+
+func GetStreamUrlTtl() time.Duration {
+	cfg := get()
+
+	if cfg.StreamUrlTtlSeconds == 0 {
+		return 60 * time.Minute
+	}
+
+	return time.Duration(cfg.StreamUrlTtlSeconds) * time.Second
+}
+
+func GetSymlinkQuarantineDirectory() string {
+	cfg := get()
+
+	return cfg.SymlinkQuarantineDirectory
+}
+
+// Removals are held when they exceed this count, the max percentage or would empty the library
+// Unset means the default, 0 holds every removal
+func GetRemovalGuardMaxCount() int {
+	cfg := get()
+
+	if cfg.RemovalGuardMaxCount == nil {
+		return 10
+	}
+
+	return *cfg.RemovalGuardMaxCount
+}
+
+// Removals are held when they exceed this percentage of the library, the max count or would empty the library
+func GetRemovalGuardMaxPercent() int {
+	cfg := get()
+
+	if cfg.RemovalGuardMaxPercent == 0 {
+		return 10
+	}
+
+	return cfg.RemovalGuardMaxPercent
+}
+
+func GetArchivePolicy() string {
+	cfg := get()
+
+	if cfg.ArchivePolicy == "" {
+		return ArchivePolicyFile
+	}
+
+	return cfg.ArchivePolicy
+}
+
+// Links are checked in the background unless the interval is negative
+func GetLinkCheckEnabled() bool {
+	cfg := get()
+
+	return cfg.LinkCheckIntervalSeconds >= 0
+}
+
+func GetLinkCheckInterval() time.Duration {
+	cfg := get()
+
+	if cfg.LinkCheckIntervalSeconds <= 0 {
+		return time.Hour
+	}
+
+	return time.Duration(cfg.LinkCheckIntervalSeconds) * time.Second
+}
+
+// Links are checked again once their last check is older than this
+func GetLinkCheckMaxAge() time.Duration {
+	cfg := get()
+
+	if cfg.LinkCheckMaxAgeSeconds == 0 {
+		return 7 * 24 * time.Hour
+	}
+
+	return time.Duration(cfg.LinkCheckMaxAgeSeconds) * time.Second
+}
+
+// Links checked per run of the background check, the least recently checked first
+func GetLinkCheckBatchSize() int {
+	cfg := get()
+
+	if cfg.LinkCheckBatchSize <= 0 {
+		return 50
+	}
+
+	return cfg.LinkCheckBatchSize
+}
+
+// Defaults to removing the whole torrent
+func GetRemovalPolicy() string {
+	cfg := get()
+
+	if cfg.RemovalPolicy == "" {
+		return RemovalPolicyTorrent
+	}
+
+	return cfg.RemovalPolicy
+}
+
+// Files removed through the file system go to the trash instead of deleting their torrent right away
+func GetTrashEnabled() bool {
+	cfg := get()
+
+	return cfg.TrashRetentionHours > 0
+}
+
+// How long removed files stay in the trash, zero when the trash is disabled
+func GetTrashRetention() time.Duration {
+	cfg := get()
+
+	if cfg.TrashRetentionHours <= 0 {
+		return 0
+	}
+
+	return time.Duration(cfg.TrashRetentionHours) * time.Hour
+}
+
+func GetDataDirectory() string {
+	cfg := get()
+
+	if cfg.DataDirectory == "" {
+		return "app_data"
+	}
+
+	return cfg.DataDirectory
+}
+
+// Defaults to media.db in the data directory
+func GetMediaDatabasePath() string {
+	cfg := get()
+
+	if cfg.MediaDatabasePath == "" {
+		return filepath.Join(GetDataDirectory(), "media.db")
+	}
+
+	return cfg.MediaDatabasePath
+}
+
+// Defaults to filesystem.db in the data directory
+func GetFileSystemDatabasePath() string {
+	cfg := get()
+
+	if cfg.FileSystemDatabasePath == "" {
+		return filepath.Join(GetDataDirectory(), "filesystem.db")
+	}
+
+	return cfg.FileSystemDatabasePath
+}
+
+func GetLogDirectory() string {
+	cfg := get()
+
+	if cfg.LogDirectory == "" {
+		return "logs"
+	}
+
+	return cfg.LogDirectory
+}
+
+func validLogLevel(level string) bool {
+	switch level {
+	case "debug", "info", "warn", "error":
+		return true
+	}
+
+	return false
+}
+
+func GetLogLevel() string {
+	cfg := get()
+
+	if cfg.LogLevel == "" {
+		return "info"
+	}
+
+	return cfg.LogLevel
+}
+
+// Levels by service name, overriding the log level
+func GetLogLevels() map[string]string {
+	cfg := get()
+
+	return maps.Clone(cfg.LogLevels)
+}
+
+func GetLogFormat() string {
+	cfg := get()
+
+	if cfg.LogFormat == "" {
+		return LogFormatText
+	}
+
+	return cfg.LogFormat
+}
+
+// Log files are rotated past this size, a negative size disables rotation by size
+func GetLogMaxSizeMegabytes() int {
+	cfg := get()
+
+	if cfg.LogMaxSizeMegabytes == 0 {
+		return 10
+	}
+
+	return max(cfg.LogMaxSizeMegabytes, 0)
+}
+
+// Log files are rotated after this long, 0 disables rotation by age
+func GetLogMaxAge() time.Duration {
+	cfg := get()
+
+	return time.Duration(cfg.LogMaxAgeHours) * time.Hour
+}
+
+// Rotated log files kept per service, a negative count keeps all of them
+func GetLogMaxBackups() int {
+	cfg := get()
+
+	if cfg.LogMaxBackups == 0 {
+		return 5
+	}
+
+	return max(cfg.LogMaxBackups, 0)
+}
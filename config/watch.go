@@ -0,0 +1,156 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// Called with the previous and the new config after a reload was applied
+type Subscriber func(previous Config, next Config)
+
+// Receives messages about reloads, err is nil for informational messages
+type Reporter func(message string, err error)
+
+var subscribers struct {
+	mutex sync.Mutex
+	list  []Subscriber
+}
+
+func Subscribe(subscriber Subscriber) {
+	subscribers.mutex.Lock()
+	defer subscribers.mutex.Unlock()
+
+	subscribers.list = append(subscribers.list, subscriber)
+}
+
+func publish(previous Config, next Config) {
+	subscribers.mutex.Lock()
+	list := append([]Subscriber{}, subscribers.list...)
+	subscribers.mutex.Unlock()
+
+	for _, subscriber := range list {
+		subscriber(previous, next)
+	}
+}
+
+// Values of restart only fields that were reported as ignored, so every change is reported once
+var ignoredChanges = struct {
+	mutex  sync.Mutex
+	values map[string]any
+}{
+	values: make(map[string]any),
+}
+
+// The loaded config is the running one, nothing differs from it yet
+func forgetIgnoredChanges() {
+	ignoredChanges.mutex.Lock()
+	defer ignoredChanges.mutex.Unlock()
+
+	clear(ignoredChanges.values)
+}
+
+// Checks the config file for changes every interval until ctx is done
+// Stat is used instead of file system events so edits through bind mounts and atomic renames are noticed too
+func Watch(ctx context.Context, interval time.Duration, report Reporter) {
+	lastModified, lastSize := stat(source.path)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		modified, size := stat(source.path)
+		if modified.Equal(lastModified) && size == lastSize {
+			continue
+		}
+
+		lastModified, lastSize = modified, size
+
+		reload(report)
+	}
+}
+
+func stat(path string) (time.Time, int64) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, -1
+	}
+
+	return info.ModTime(), info.Size()
+}
+
+// Invalid configs are rejected and the current one stays active
+func reload(report Reporter) {
+	parsed, err := parse(source.path, source.required)
+	if err != nil {
+		report("Rejected config change, keeping the current config", err)
+		return
+	}
+
+	err = validate(parsed)
+	if err != nil {
+		report("Rejected config change, keeping the current config", err)
+		return
+	}
+
+	previous := get()
+	next := merge(previous, parsed, report)
+
+	if reflect.DeepEqual(previous, next) {
+		return
+	}
+
+	current.Store(&next)
+
+	report("Reloaded config", nil)
+
+	publish(previous, next)
+}
+
+// Takes reloadable fields from parsed and keeps the others from previous, the running config
+// A change to a field that requires a restart is reported the first time the file has it
+func merge(previous Config, parsed Config, report Reporter) Config {
+	next := previous
+
+	nextValue := reflect.ValueOf(&next).Elem()
+	parsedValue := reflect.ValueOf(parsed)
+	valueType := nextValue.Type()
+
+	ignoredChanges.mutex.Lock()
+	defer ignoredChanges.mutex.Unlock()
+
+	for i := 0; i < valueType.NumField(); i++ {
+		field := valueType.Field(i)
+		name := field.Tag.Get("yaml")
+		value := parsedValue.Field(i).Interface()
+
+		if reflect.DeepEqual(nextValue.Field(i).Interface(), value) {
+			// Changed back, a later change is reported again
+			delete(ignoredChanges.values, name)
+			continue
+		}
+
+		if field.Tag.Get("reload") != "true" {
+			reported, ok := ignoredChanges.values[name]
+			if !ok || !reflect.DeepEqual(reported, value) {
+				report(fmt.Sprintf("Ignoring change to %s, it requires a restart", name), nil)
+				ignoredChanges.values[name] = value
+			}
+
+			continue
+		}
+
+		nextValue.Field(i).Set(parsedValue.Field(i))
+	}
+
+	return next
+}
@@ -3,6 +3,7 @@ package database
 import (
 	"database/sql"
 	"fmt"
+	"os"
 	"sync"
 
 	_ "modernc.org/sqlite"
@@ -13,8 +14,8 @@ type Instance struct {
 	mutex *sync.Mutex
 }
 
-func NewInstance() (*Instance, error) {
-	db, err := initializeDatabase()
+func NewInstance(path string) (*Instance, error) {
+	db, err := initializeDatabase(path)
 	if err != nil {
 		return nil, err
 	}
@@ -28,8 +29,12 @@ func NewInstance() (*Instance, error) {
 	}, nil
 }
 
-func initializeDatabase() (*sql.DB, error) {
-	db, err := sql.Open("sqlite", "app_data/media.db")
+func initializeDatabase(path string) (*sql.DB, error) {
+	_, err := os.Stat(path)
+	existed := err == nil
+
+	// Writers wait for each other instead of failing with SQLITE_BUSY
+	db, err := sql.Open("sqlite", fmt.Sprintf("file:%s?_pragma=busy_timeout(5000)", path))
 	if err != nil {
 		return nil, fmt.Errorf("Failed to open database: %v", err)
 	}
@@ -44,62 +49,10 @@ func initializeDatabase() (*sql.DB, error) {
 	}
 	fmt.Printf("Journal mode: %s\n", journalMode)
 
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS torrents (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			torrent_id TEXT NOT NULL,
-			name TEXT NOT NULL,
-
-			UNIQUE(torrent_id)
-		);
-	`)
-
-	if err != nil {
-		return nil, fmt.Errorf("Failed to create table: %v", err)
-	}
-
-	_, err = db.Exec(`
-		CREATE INDEX IF NOT EXISTS idx_torrents_torrent_id 
-		ON torrents (torrent_id);
-	`)
-
-	if err != nil {
-		return nil, fmt.Errorf("Failed to create index: %v", err)
-	}
-
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS torrent_files (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			torrent_id INTEGER NOT NULL,
-			path TEXT NOT NULL,
-			size INTEGER NOT NULL,
-			link INTEGER NOT NULL,
-			file_index INTEGER NOT NULL,
-			file_node_id INTEGER NOT NULL,
-
-			UNIQUE(torrent_id, file_index)
-			UNIQUE(file_node_id)
-
-			FOREIGN KEY(torrent_id) REFERENCES torrents(id)
-		);
-	`)
-
+	err = migrate(db, path, existed)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to create table: %v", err)
-	}
-
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS rejected_torrents (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			torrent_id TEXT NOT NULL,
-			name TEXT NOT NULL,
-				
-			UNIQUE(torrent_id)
-		);
-	`)
-
-	if err != nil {
-		return nil, fmt.Errorf("Failed to create table: %v", err)
+		db.Close()
+		return nil, err
 	}
 
 	return db, nil
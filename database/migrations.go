@@ -0,0 +1,428 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"debrid_drive/logger"
+)
+
+type migration struct {
+	version     int
+	description string
+	statements  []string
+}
+
+// Append only, a released migration must never be changed or reordered
+var migrations = []migration{
+	{
+		version:     1,
+		description: "Initial schema",
+		statements: []string{
+			`
+			CREATE TABLE IF NOT EXISTS torrents (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				torrent_id TEXT NOT NULL,
+				name TEXT NOT NULL,
+
+				UNIQUE(torrent_id)
+			);
+			`,
+			`
+			CREATE INDEX IF NOT EXISTS idx_torrents_torrent_id
+			ON torrents (torrent_id);
+			`,
+			`
+			CREATE TABLE IF NOT EXISTS torrent_files (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				torrent_id INTEGER NOT NULL,
+				path TEXT NOT NULL,
+				size INTEGER NOT NULL,
+				link INTEGER NOT NULL,
+				file_index INTEGER NOT NULL,
+				file_node_id INTEGER NOT NULL,
+
+				UNIQUE(torrent_id, file_index)
+				UNIQUE(file_node_id)
+
+				FOREIGN KEY(torrent_id) REFERENCES torrents(id)
+			);
+			`,
+			`
+			CREATE TABLE IF NOT EXISTS rejected_torrents (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				torrent_id TEXT NOT NULL,
+				name TEXT NOT NULL,
+
+				UNIQUE(torrent_id)
+			);
+			`,
+			`
+			CREATE TABLE IF NOT EXISTS stream_urls (
+				link TEXT PRIMARY KEY,
+				url TEXT NOT NULL,
+				expires_at INTEGER NOT NULL
+			);
+			`,
+		},
+	},
+	{
+		version:     2,
+		description: "Torrent snapshots for incremental reconciliation",
+		statements: []string{
+			`
+			CREATE TABLE IF NOT EXISTS torrent_snapshots (
+				torrent_id TEXT PRIMARY KEY,
+				name TEXT NOT NULL,
+				status TEXT NOT NULL,
+				bytes INTEGER NOT NULL,
+				added TEXT NOT NULL
+			);
+			`,
+			`
+			CREATE INDEX IF NOT EXISTS idx_torrent_files_torrent_id
+			ON torrent_files (torrent_id);
+			`,
+		},
+	},
+	{
+		version:     3,
+		description: "Held removals for the mass deletion guard",
+		statements: []string{
+			`
+			CREATE TABLE IF NOT EXISTS held_removals (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				torrent_id TEXT NOT NULL,
+				name TEXT NOT NULL,
+				held_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+				confirmed INTEGER NOT NULL DEFAULT 0,
+
+				UNIQUE(torrent_id)
+			);
+			`,
+		},
+	},
+	{
+		version:     4,
+		description: "Accounts",
+		statements: []string{
+			// Everything added before accounts existed belongs to the default account
+			`
+			ALTER TABLE torrents ADD COLUMN account TEXT NOT NULL DEFAULT 'default';
+			`,
+			`
+			ALTER TABLE rejected_torrents ADD COLUMN account TEXT NOT NULL DEFAULT 'default';
+			`,
+			`
+			ALTER TABLE torrent_snapshots ADD COLUMN account TEXT NOT NULL DEFAULT 'default';
+			`,
+			`
+			CREATE INDEX IF NOT EXISTS idx_torrents_account
+			ON torrents (account);
+			`,
+			`
+			CREATE INDEX IF NOT EXISTS idx_torrent_snapshots_account
+			ON torrent_snapshots (account);
+			`,
+		},
+	},
+	{
+		version:     5,
+		description: "Rejection reasons and retries",
+		statements: []string{
+			`
+			ALTER TABLE rejected_torrents ADD COLUMN reason TEXT NOT NULL DEFAULT '';
+			`,
+			`
+			ALTER TABLE rejected_torrents ADD COLUMN rejected_at INTEGER NOT NULL DEFAULT 0;
+			`,
+			`
+			ALTER TABLE rejected_torrents ADD COLUMN attempts INTEGER NOT NULL DEFAULT 1;
+			`,
+			// NULL means the torrent is not retried
+			`
+			ALTER TABLE rejected_torrents ADD COLUMN retry_at INTEGER;
+			`,
+			// Missing links were the only reason before, retry those torrents once
+			`
+			UPDATE rejected_torrents
+			SET reason = 'missing_links', rejected_at = strftime('%s', 'now'), retry_at = strftime('%s', 'now');
+			`,
+		},
+	},
+	{
+		version:     6,
+		description: "Link health",
+		statements: []string{
+			// 0 means the link was not unrestricted since it was stored
+			`
+			ALTER TABLE torrent_files ADD COLUMN link_checked_at INTEGER NOT NULL DEFAULT 0;
+			`,
+			// Failed unrestricts in a row
+			`
+			ALTER TABLE torrent_files ADD COLUMN link_failures INTEGER NOT NULL DEFAULT 0;
+			`,
+			`
+			CREATE INDEX IF NOT EXISTS idx_torrent_files_link_checked_at
+			ON torrent_files (link_checked_at);
+			`,
+		},
+	},
+	{
+		version:     7,
+		description: "Trash",
+		statements: []string{
+			// Files removed through the file system wait here until their torrent is deleted from debrid
+			// The original location is kept as the path of the directory and the name, names can contain slashes
+			`
+			CREATE TABLE IF NOT EXISTS trash_entries (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				torrent_file_id INTEGER NOT NULL,
+				original_directory TEXT NOT NULL,
+				original_name TEXT NOT NULL,
+				trashed_at INTEGER NOT NULL,
+				restore_requested INTEGER NOT NULL DEFAULT 0,
+
+				UNIQUE(torrent_file_id)
+
+				FOREIGN KEY(torrent_file_id) REFERENCES torrent_files(id)
+			);
+			`,
+		},
+	},
+	{
+		version:     8,
+		description: "Held removals per account",
+		statements: []string{
+			// SQLite can not change a unique constraint, the table is rebuilt with the account in it
+			`
+			CREATE TABLE held_removals_accounts (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				account TEXT NOT NULL DEFAULT 'default',
+				torrent_id TEXT NOT NULL,
+				name TEXT NOT NULL,
+				held_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+				confirmed INTEGER NOT NULL DEFAULT 0,
+
+				UNIQUE(account, torrent_id)
+			);
+			`,
+			// Held removals take the account of their torrent, the torrent is still there until the removal is applied
+			`
+			INSERT INTO held_removals_accounts (id, account, torrent_id, name, held_at, confirmed)
+			SELECT
+				held_removals.id,
+				COALESCE((SELECT torrents.account FROM torrents WHERE torrents.torrent_id = held_removals.torrent_id), 'default'),
+				held_removals.torrent_id,
+				held_removals.name,
+				held_removals.held_at,
+				held_removals.confirmed
+			FROM held_removals;
+			`,
+			`
+			DROP TABLE held_removals;
+			`,
+			`
+			ALTER TABLE held_removals_accounts RENAME TO held_removals;
+			`,
+		},
+	},
+	{
+		version:     9,
+		description: "Symlink index",
+		statements: []string{
+			// Symlinks by the node they point at, so the links to a removed file are found without walking the file system
+			// Node ids are never reused, a row left behind by a link removed elsewhere can't match another node
+			`
+			CREATE TABLE IF NOT EXISTS symlinks (
+				source_node_id INTEGER PRIMARY KEY,
+				target_node_id INTEGER NOT NULL
+			);
+			`,
+			`
+			CREATE INDEX IF NOT EXISTS idx_symlinks_target_node_id
+			ON symlinks (target_node_id);
+			`,
+		},
+	},
+	{
+		version:     10,
+		description: "Torrent snapshots per account",
+		statements: []string{
+			// SQLite can not change a primary key, the table is rebuilt with the account in it
+			`
+			CREATE TABLE torrent_snapshots_accounts (
+				account TEXT NOT NULL DEFAULT 'default',
+				torrent_id TEXT NOT NULL,
+				name TEXT NOT NULL,
+				status TEXT NOT NULL,
+				bytes INTEGER NOT NULL,
+				added TEXT NOT NULL,
+
+				PRIMARY KEY(account, torrent_id)
+			);
+			`,
+			`
+			INSERT INTO torrent_snapshots_accounts (account, torrent_id, name, status, bytes, added)
+			SELECT account, torrent_id, name, status, bytes, added
+			FROM torrent_snapshots;
+			`,
+			// The primary key starts with the account, which replaces its index
+			`
+			DROP TABLE torrent_snapshots;
+			`,
+			`
+			ALTER TABLE torrent_snapshots_accounts RENAME TO torrent_snapshots;
+			`,
+		},
+	},
+	{
+		version:     11,
+		description: "Torrents and rejections per account",
+		statements: []string{
+			// The same torrent id can be in more than one account, the tables are rebuilt with the account in their unique constraint
+			// Ids are kept, torrent_files refers to torrents by id
+			`
+			CREATE TABLE torrents_accounts (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				torrent_id TEXT NOT NULL,
+				name TEXT NOT NULL,
+				account TEXT NOT NULL DEFAULT 'default',
+
+				UNIQUE(account, torrent_id)
+			);
+			`,
+			`
+			INSERT INTO torrents_accounts (id, torrent_id, name, account)
+			SELECT id, torrent_id, name, account
+			FROM torrents;
+			`,
+			`
+			DROP TABLE torrents;
+			`,
+			`
+			ALTER TABLE torrents_accounts RENAME TO torrents;
+			`,
+			`
+			CREATE INDEX IF NOT EXISTS idx_torrents_torrent_id
+			ON torrents (torrent_id);
+			`,
+			`
+			CREATE TABLE rejected_torrents_accounts (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				torrent_id TEXT NOT NULL,
+				name TEXT NOT NULL,
+				account TEXT NOT NULL DEFAULT 'default',
+				reason TEXT NOT NULL DEFAULT '',
+				rejected_at INTEGER NOT NULL DEFAULT 0,
+				attempts INTEGER NOT NULL DEFAULT 1,
+				retry_at INTEGER,
+
+				UNIQUE(account, torrent_id)
+			);
+			`,
+			`
+			INSERT INTO rejected_torrents_accounts (id, torrent_id, name, account, reason, rejected_at, attempts, retry_at)
+			SELECT id, torrent_id, name, account, reason, rejected_at, attempts, retry_at
+			FROM rejected_torrents;
+			`,
+			`
+			DROP TABLE rejected_torrents;
+			`,
+			`
+			ALTER TABLE rejected_torrents_accounts RENAME TO rejected_torrents;
+			`,
+		},
+	},
+}
+
+func latestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// 1. Read the current schema version
+// 2. Refuse to continue when the database is newer than this build
+// 3. Back up the database file
+// 4. Apply every pending migration in a single transaction
+func migrate(db *sql.DB, path string, existed bool) error {
+	logger, err := logger.NewLogger("Database")
+	if err != nil {
+		return fmt.Errorf("Failed to create logger: %v", err)
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_version (
+			version INTEGER NOT NULL,
+			description TEXT NOT NULL,
+			applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+			UNIQUE(version)
+		);
+	`)
+
+	if err != nil {
+		return fmt.Errorf("Failed to create schema version table: %v", err)
+	}
+
+	var currentVersion int
+	err = db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&currentVersion)
+	if err != nil {
+		return fmt.Errorf("Failed to read schema version: %v", err)
+	}
+
+	latestVersion := latestSchemaVersion()
+
+	if currentVersion > latestVersion {
+		return fmt.Errorf("Database schema version %d is newer than the latest known version %d, refusing to start", currentVersion, latestVersion)
+	}
+
+	if currentVersion == latestVersion {
+		return nil
+	}
+
+	if existed {
+		backupPath := fmt.Sprintf("%s.v%d.%s.bak", path, currentVersion, time.Now().Format("20060102150405"))
+
+		// VACUUM INTO writes a consistent copy including anything still in the WAL
+		_, err = db.Exec("VACUUM INTO ?", backupPath)
+		if err != nil {
+			return fmt.Errorf("Failed to back up database before migrating: %v", err)
+		}
+
+		logger.Info("Backed up database", "path", backupPath)
+	}
+
+	transaction, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("Failed to begin migration transaction: %v", err)
+	}
+	defer transaction.Rollback()
+
+	for _, migration := range migrations {
+		if migration.version <= currentVersion {
+			continue
+		}
+
+		for _, statement := range migration.statements {
+			_, err = transaction.Exec(statement)
+			if err != nil {
+				return fmt.Errorf("Failed to apply migration %d (%s): %v", migration.version, migration.description, err)
+			}
+		}
+
+		_, err = transaction.Exec("INSERT INTO schema_version (version, description) VALUES (?, ?)", migration.version, migration.description)
+		if err != nil {
+			return fmt.Errorf("Failed to record migration %d: %v", migration.version, err)
+		}
+
+		logger.Info(fmt.Sprintf("Applied migration %d: %s", migration.version, migration.description))
+	}
+
+	err = transaction.Commit()
+	if err != nil {
+		return fmt.Errorf("Failed to commit migrations: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,126 @@
+package e2e
+
+import (
+	"slices"
+	"testing"
+
+	"debrid_drive/provider"
+)
+
+const accountsConfig = `accounts:
+  - name: "first"
+    real_debrid_token: "first-token"
+  - name: "second"
+    real_debrid_token: "second-token"
+`
+
+func TestPollKeepsAccountsApart(t *testing.T) {
+	setConfig(t, accountsConfig+"removal_guard_max_count: 1\nremoval_guard_max_percent: 50\n")
+
+	h := newAccountsHarness(t)
+	first := h.forAccount("first")
+	second := h.forAccount("second")
+
+	first.addTorrent("F1", "/a.mkv")
+	first.addTorrent("F2", "/a.mkv")
+	second.addTorrent("S1", "/a.mkv")
+	second.addTorrent("S2", "/a.mkv")
+
+	// Each account is polled on its own
+	first.poll(t)
+
+	if ids := h.torrentIds(t); !slices.Equal(ids, []string{"F1", "F2"}) {
+		t.Fatalf("Expected only the torrents of the first account, got %v", ids)
+	}
+
+	second.poll(t)
+
+	for _, path := range []string{"media_manager/first/F1", "media_manager/second/S1"} {
+		if _, err := h.lookup(t, path); err != nil {
+			t.Errorf("Expected %s in the directory of its account: %v", path, err)
+		}
+	}
+
+	snapshots, err := h.mediaRepository.GetTorrentSnapshots("first")
+	if err != nil {
+		t.Fatalf("Failed to get snapshots: %v", err)
+	}
+
+	if len(snapshots) != 2 || snapshots["F1"] == nil || snapshots["F2"] == nil {
+		t.Errorf("Expected the snapshots of the first account only, got %v", snapshots)
+	}
+
+	// Over the guard of the second account, the first account is not affected
+	second.pollWithout(t, "S1", "S2")
+
+	heldRemovals, err := h.mediaRepository.GetHeldRemovals("second")
+	if err != nil {
+		t.Fatalf("Failed to get held removals: %v", err)
+	}
+
+	if len(heldRemovals) != 2 {
+		t.Fatalf("Expected 2 held removals in the second account, got %d", len(heldRemovals))
+	}
+
+	if ids := first.pollWithout(t, "F1"); !slices.Equal(ids, []string{"F2", "S1", "S2"}) {
+		t.Fatalf("Expected the removal in the first account to be applied, got %v", ids)
+	}
+
+	confirmed, err := h.mediaRepository.ConfirmHeldRemovals("first", nil)
+	if err != nil {
+		t.Fatalf("Failed to confirm held removals: %v", err)
+	}
+
+	if confirmed != 0 {
+		t.Errorf("Expected no held removals to confirm in the first account, got %d", confirmed)
+	}
+
+	_, err = h.mediaRepository.ConfirmHeldRemovals("second", nil)
+	if err != nil {
+		t.Fatalf("Failed to confirm held removals: %v", err)
+	}
+
+	second.poll(t)
+
+	if ids := h.torrentIds(t); !slices.Equal(ids, []string{"F2"}) {
+		t.Fatalf("Expected the confirmed removals of the second account to be applied, got %v", ids)
+	}
+}
+
+// Torrent ids are only unique within an account, adding or rejecting one in an account doesn't affect the other
+func TestPollAddsTorrentIdSharedByAccounts(t *testing.T) {
+	setConfig(t, accountsConfig)
+
+	h := newAccountsHarness(t)
+	first := h.forAccount("first")
+	second := h.forAccount("second")
+
+	first.addTorrent("T1", "/a.mkv")
+	second.addTorrent("T1", "/a.mkv")
+	second.addTorrent("T2", "/a.mkv")
+
+	// Without links T2 is rejected in the first account
+	first.provider.SetTorrent(provider.Torrent{ID: "T2", Name: "T2", Bytes: 1000, Status: provider.StatusDownloaded}, []provider.TorrentFile{
+		{ID: 1, Path: "/a.mkv", Bytes: 1000, Selected: true},
+	}, nil)
+
+	first.poll(t)
+	second.poll(t)
+
+	for _, path := range []string{"media_manager/first/T1", "media_manager/second/T1", "media_manager/second/T2"} {
+		if _, err := h.lookup(t, path); err != nil {
+			t.Errorf("Expected %s to be added: %v", path, err)
+		}
+	}
+
+	first.rejection(t, "T2")
+
+	rejected, err := h.mediaRepository.GetRejectedTorrent("second", "T2")
+	if err != nil {
+		t.Fatalf("Failed to get rejected torrent: %v", err)
+	}
+
+	if rejected != nil {
+		t.Errorf("Expected the rejection of T2 to stay in the first account")
+	}
+}
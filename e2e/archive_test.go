@@ -0,0 +1,144 @@
+package e2e
+
+import (
+	"database/sql"
+	"testing"
+
+	media_service "debrid_drive/media/service"
+	"debrid_drive/provider"
+	"debrid_drive/provider/fake"
+)
+
+// Three selected files behind two links, b.mkv has a link of its own and the others are packed in T1.rar
+func addArchiveTorrent(h *harness) {
+	h.provider.SetTorrent(provider.Torrent{ID: "T1", Name: "T1", Bytes: 6000, Status: provider.StatusDownloaded}, []provider.TorrentFile{
+		{ID: 1, Path: "/a.mkv", Bytes: 1000, Selected: true},
+		{ID: 2, Path: "/b.mkv", Bytes: 2000, Selected: true},
+		{ID: 3, Path: "/c.mkv", Bytes: 3000, Selected: true},
+	}, []string{"T1/rar", "T1/b"})
+
+	h.provider.SetDownload("T1/rar", provider.Download{Url: "https://download.test/T1/T1.rar", Filename: "T1.rar", Bytes: 4000})
+	h.provider.SetDownload("T1/b", provider.Download{Url: "https://download.test/T1/b.mkv", Filename: "b.mkv", Bytes: 2000})
+}
+
+func TestPollListsArchiveAsSingleFile(t *testing.T) {
+	h := newHarness(t)
+	addArchiveTorrent(h)
+
+	h.poll(t)
+
+	if ids := h.torrentIds(t); len(ids) != 1 {
+		t.Fatalf("Expected the archive torrent to be added, got %v", ids)
+	}
+
+	archive, err := h.lookup(t, "media_manager/T1/T1.rar")
+	if err != nil {
+		t.Fatalf("Expected the archive to be listed: %v", err)
+	}
+
+	torrentFile, err := h.mediaRepository.GetTorrentFileByFileId(archive.GetId())
+	if err != nil {
+		t.Fatalf("Failed to get torrent file: %v", err)
+	}
+
+	if torrentFile.GetLink() != "T1/rar" || torrentFile.GetSize() != 4000 {
+		t.Errorf("Expected the archive to stream from its own link, got %s with %d bytes", torrentFile.GetLink(), torrentFile.GetSize())
+	}
+
+	file, err := h.lookup(t, "media_manager/T1/b.mkv")
+	if err != nil {
+		t.Fatalf("Expected b.mkv to be listed: %v", err)
+	}
+
+	torrentFile, err = h.mediaRepository.GetTorrentFileByFileId(file.GetId())
+	if err != nil {
+		t.Fatalf("Failed to get torrent file: %v", err)
+	}
+
+	if torrentFile.GetLink() != "T1/b" || torrentFile.GetSize() != 2000 {
+		t.Errorf("Expected b.mkv to stream from its own link, got %s with %d bytes", torrentFile.GetLink(), torrentFile.GetSize())
+	}
+
+	// Files in the archive are not listed
+	for _, path := range []string{"media_manager/T1/a.mkv", "media_manager/T1/c.mkv"} {
+		if _, err := h.lookup(t, path); err == nil {
+			t.Errorf("Expected %s not to be listed", path)
+		}
+	}
+}
+
+func TestPollRejectsArchivesWithRejectPolicy(t *testing.T) {
+	setConfig(t, "archive_policy: \"reject\"\n")
+
+	h := newHarness(t)
+	addArchiveTorrent(h)
+
+	h.poll(t)
+
+	rejected := h.rejection(t, "T1")
+
+	if rejected.GetReason() != media_service.RejectionArchive {
+		t.Fatalf("Expected an archive rejection, got %s", rejected.GetReason())
+	}
+
+	if !rejected.GetRetryAt().IsZero() {
+		t.Errorf("Expected no retry, got %s", rejected.GetRetryAt())
+	}
+
+	if ids := h.torrentIds(t); len(ids) != 0 {
+		t.Errorf("Expected nothing to be added, got %v", ids)
+	}
+
+	// The archive link was unrestricted before the rejection, its url goes with the rolled back torrent
+	if _, err := h.mediaRepository.GetStreamUrl("T1/rar"); err != sql.ErrNoRows {
+		t.Errorf("Expected no stream url for the rejected torrent, got %v", err)
+	}
+}
+
+func TestPollMatchesLinksByFullPath(t *testing.T) {
+	h := newHarness(t)
+
+	// Files of the same name in different folders, only the second has a link of its own
+	h.provider.SetTorrent(provider.Torrent{ID: "T1", Name: "T1", Bytes: 6000, Status: provider.StatusDownloaded}, []provider.TorrentFile{
+		{ID: 1, Path: "/S01/sample.mkv", Bytes: 1000, Selected: true},
+		{ID: 2, Path: "/S02/sample.mkv", Bytes: 2000, Selected: true},
+		{ID: 3, Path: "/S03/sample.mkv", Bytes: 3000, Selected: true},
+	}, []string{"T1/rar", "T1/s02"})
+
+	h.provider.SetDownload("T1/rar", provider.Download{Url: "https://download.test/T1/T1.rar", Filename: "T1.rar", Bytes: 4000})
+	h.provider.SetDownload("T1/s02", provider.Download{Url: "https://download.test/T1/S02/sample.mkv", Filename: "sample.mkv", Bytes: 2000})
+
+	h.poll(t)
+
+	torrents, err := h.mediaRepository.GetTorrents()
+	if err != nil || len(torrents) != 1 {
+		t.Fatalf("Expected the torrent to be added, got %d: %v", len(torrents), err)
+	}
+
+	torrentFiles, err := h.mediaRepository.GetTorrentFiles(torrents[0])
+	if err != nil {
+		t.Fatalf("Failed to get torrent files: %v", err)
+	}
+
+	links := make(map[string]string, len(torrentFiles))
+	for _, torrentFile := range torrentFiles {
+		links[torrentFile.GetPath()] = torrentFile.GetLink()
+	}
+
+	if links["/S02/sample.mkv"] != "T1/s02" || links["/T1.rar"] != "T1/rar" || len(links) != 2 {
+		t.Fatalf("Expected S02/sample.mkv and the archive to be linked, got %v", links)
+	}
+
+	// The links were unrestricted while adding, streaming doesn't do it again
+	calls := h.provider.GetCalls(fake.MethodUnrestrictLink)
+
+	for _, torrentFile := range torrentFiles {
+		if _, err := h.mediaService.GetStreamUrl(torrentFile); err != nil {
+			t.Fatalf("Failed to get stream url: %v", err)
+		}
+	}
+
+	if h.provider.GetCalls(fake.MethodUnrestrictLink) != calls {
+		t.Errorf("Expected the stream urls to be cached while adding")
+	}
+}
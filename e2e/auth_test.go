@@ -0,0 +1,343 @@
+package e2e
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	filesystem_server "debrid_drive/filesystem/server"
+
+	api "github.com/sushydev/stream_mount_api"
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	grpc_health "google.golang.org/grpc/health"
+	grpc_health_v1 "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Serves the file system of the harness on a unix socket with the yaml applied to the config, returns the socket path
+func serveFileSystem(t *testing.T, h *harness, yaml string) string {
+	t.Helper()
+
+	// Socket paths are limited to about 100 bytes, t.TempDir can be longer
+	directory, err := os.MkdirTemp("", "dd")
+	if err != nil {
+		t.Fatalf("Failed to create socket directory: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(directory) })
+
+	socket := filepath.Join(directory, "grpc.sock")
+
+	setConfig(t, fmt.Sprintf("bind_address: \"unix:%s\"\n%s", socket, yaml))
+
+	server := filesystem_server.NewFileSystemServer(h.fileSystem, h.mediaService)
+	grpc_health_v1.RegisterHealthServer(server.GetServer(), grpc_health.NewServer())
+
+	ready := make(chan struct{})
+	go server.Serve(ready)
+
+	select {
+	case <-ready:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Server did not start")
+	}
+	t.Cleanup(func() { server.Stop(time.Second) })
+
+	return socket
+}
+
+func dial(t *testing.T, socket string, creds credentials.TransportCredentials) *grpc.ClientConn {
+	t.Helper()
+
+	connection, err := grpc.NewClient("unix:"+socket, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	t.Cleanup(func() { connection.Close() })
+
+	return connection
+}
+
+func withToken(value string) context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+value)
+}
+
+func TestServesOnUnixSocket(t *testing.T) {
+	h := newHarness(t)
+	socket := serveFileSystem(t, h, "")
+
+	info, err := os.Stat(socket)
+	if err != nil {
+		t.Fatalf("Failed to stat socket: %v", err)
+	}
+
+	if info.Mode().Perm() != 0660 {
+		t.Errorf("Expected socket permissions 0660, got %o", info.Mode().Perm())
+	}
+
+	client := api.NewFileSystemServiceClient(dial(t, socket, insecure.NewCredentials()))
+
+	_, err = client.Root(context.Background(), &api.RootRequest{})
+	if err != nil {
+		t.Fatalf("Expected root without a configured token, got %v", err)
+	}
+}
+
+func TestKeepsFileAtSocketPath(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "grpc.sock")
+
+	err := os.WriteFile(path, []byte("data"), 0600)
+	if err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	setConfig(t, fmt.Sprintf("bind_address: \"unix:%s\"\n", path))
+
+	h := newHarness(t)
+	server := filesystem_server.NewFileSystemServer(h.fileSystem, h.mediaService)
+
+	// Serve returns right away when it can't listen
+	ready := make(chan struct{})
+	server.Serve(ready)
+
+	select {
+	case <-ready:
+		t.Fatalf("Expected the server not to start")
+	default:
+	}
+
+	if data, err := os.ReadFile(path); err != nil || string(data) != "data" {
+		t.Errorf("Expected the file to be kept, got %q: %v", data, err)
+	}
+}
+
+func TestRequiresAuthToken(t *testing.T) {
+	h := newHarness(t)
+	socket := serveFileSystem(t, h, "auth_token: \"secret\"\n")
+
+	connection := dial(t, socket, insecure.NewCredentials())
+	client := api.NewFileSystemServiceClient(connection)
+
+	_, err := client.Root(context.Background(), &api.RootRequest{})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("Expected unauthenticated without a token, got %v", err)
+	}
+
+	_, err = client.Root(withToken("wrong"), &api.RootRequest{})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("Expected unauthenticated with a wrong token, got %v", err)
+	}
+
+	_, err = client.Root(withToken("secret"), &api.RootRequest{})
+	if err != nil {
+		t.Errorf("Expected root with the token, got %v", err)
+	}
+
+	// Probes don't know the token
+	_, err = grpc_health_v1.NewHealthClient(connection).Check(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+	if err != nil {
+		t.Errorf("Expected health check without a token, got %v", err)
+	}
+
+	// The token is reloadable
+	setConfig(t, fmt.Sprintf("bind_address: \"unix:%s\"\nauth_token: \"rotated\"\n", socket))
+
+	_, err = client.Root(withToken("secret"), &api.RootRequest{})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("Expected unauthenticated with the old token, got %v", err)
+	}
+
+	_, err = client.Root(withToken("rotated"), &api.RootRequest{})
+	if err != nil {
+		t.Errorf("Expected root with the rotated token, got %v", err)
+	}
+}
+
+func TestRequiresClientCertificate(t *testing.T) {
+	directory := t.TempDir()
+
+	ca, caKey := newCertificate(t, directory, "ca", nil, nil)
+	newCertificate(t, directory, "server", ca, caKey)
+	newCertificate(t, directory, "client", ca, caKey)
+	newCertificate(t, directory, "stranger", nil, nil)
+
+	path := func(name string) string {
+		return filepath.Join(directory, name)
+	}
+
+	h := newHarness(t)
+	socket := serveFileSystem(t, h, fmt.Sprintf(
+		"tls_cert_file: %q\ntls_key_file: %q\ntls_client_ca_file: %q\n",
+		path("server.crt"), path("server.key"), path("ca.crt"),
+	))
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	clientTls := func(name string) credentials.TransportCredentials {
+		config := &tls.Config{RootCAs: roots, ServerName: "localhost"}
+
+		if name != "" {
+			certificate, err := tls.LoadX509KeyPair(path(name+".crt"), path(name+".key"))
+			if err != nil {
+				t.Fatalf("Failed to load %s certificate: %v", name, err)
+			}
+
+			config.Certificates = []tls.Certificate{certificate}
+		}
+
+		return credentials.NewTLS(config)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := api.NewFileSystemServiceClient(dial(t, socket, clientTls("client"))).Root(ctx, &api.RootRequest{})
+	if err != nil {
+		t.Errorf("Expected root with a client certificate, got %v", err)
+	}
+
+	_, err = api.NewFileSystemServiceClient(dial(t, socket, clientTls(""))).Root(ctx, &api.RootRequest{})
+	if err == nil {
+		t.Errorf("Expected an error without a client certificate")
+	}
+
+	_, err = api.NewFileSystemServiceClient(dial(t, socket, clientTls("stranger"))).Root(ctx, &api.RootRequest{})
+	if err == nil {
+		t.Errorf("Expected an error with a certificate of another CA")
+	}
+
+	_, err = api.NewFileSystemServiceClient(dial(t, socket, insecure.NewCredentials())).Root(ctx, &api.RootRequest{})
+	if err == nil {
+		t.Errorf("Expected an error without TLS")
+	}
+}
+
+// Writes name.crt and name.key for localhost, signed by the parent or self signed as a CA when there is none
+func newCertificate(t *testing.T, directory string, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	signer := key
+
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent = template
+	} else {
+		signer = parentKey
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %v", err)
+	}
+
+	err = os.WriteFile(filepath.Join(directory, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatalf("Failed to write certificate: %v", err)
+	}
+
+	err = os.WriteFile(filepath.Join(directory, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+
+	return certificate, key
+}
+
+func TestReadOnlyClient(t *testing.T) {
+	h := newHarness(t)
+
+	h.addTorrent("T1", "/a.mkv", "/b.mkv")
+	h.poll(t)
+
+	socket := serveFileSystem(t, h, "clients:\n  - name: family\n    token: family-token\n    read_only: true\n  - name: sonarr\n    token: sonarr-token\n")
+	client := api.NewFileSystemServiceClient(dial(t, socket, insecure.NewCredentials()))
+
+	directory, err := h.lookup(t, "media_manager/T1")
+	if err != nil {
+		t.Fatalf("Failed to look up directory: %v", err)
+	}
+
+	family := withToken("family-token")
+
+	_, err = client.ReadDirAll(family, &api.ReadDirAllRequest{NodeId: directory.Id})
+	if err != nil {
+		t.Errorf("Expected a read only client to list, got %v", err)
+	}
+
+	_, err = client.Remove(family, &api.RemoveRequest{ParentNodeId: directory.Id, Name: "a.mkv"})
+	if status.Convert(err).Message() != syscall.EROFS.Error() {
+		t.Errorf("Expected a read only client to get EROFS on remove, got %v", err)
+	}
+
+	_, err = client.Mkdir(family, &api.MkdirRequest{ParentNodeId: directory.Id, Name: "extras"})
+	if status.Convert(err).Message() != syscall.EROFS.Error() {
+		t.Errorf("Expected a read only client to get EROFS on mkdir, got %v", err)
+	}
+
+	if deleted := h.provider.GetDeleted(); len(deleted) != 0 {
+		t.Fatalf("Expected nothing to be deleted remotely, got %v", deleted)
+	}
+
+	_, err = client.Remove(withToken("sonarr-token"), &api.RemoveRequest{ParentNodeId: directory.Id, Name: "a.mkv"})
+	if err != nil {
+		t.Fatalf("Expected other clients to remove, got %v", err)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	h := newHarness(t)
+	socket := serveFileSystem(t, h, "read_only: true\n")
+	client := api.NewFileSystemServiceClient(dial(t, socket, insecure.NewCredentials()))
+
+	root, err := client.Root(context.Background(), &api.RootRequest{})
+	if err != nil {
+		t.Fatalf("Expected root in read only mode, got %v", err)
+	}
+
+	_, err = client.Mkdir(context.Background(), &api.MkdirRequest{ParentNodeId: root.Root.Id, Name: "extras"})
+	if status.Convert(err).Message() != syscall.EROFS.Error() {
+		t.Errorf("Expected EROFS on mkdir in read only mode, got %v", err)
+	}
+}
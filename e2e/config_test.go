@@ -0,0 +1,151 @@
+package e2e
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"debrid_drive/config"
+)
+
+// Messages of a watch, safe to read while it runs
+type watchReport struct {
+	mutex    sync.Mutex
+	messages []string
+}
+
+func (report *watchReport) add(message string, err error) {
+	report.mutex.Lock()
+	defer report.mutex.Unlock()
+
+	report.messages = append(report.messages, message)
+}
+
+func (report *watchReport) count(message string) int {
+	report.mutex.Lock()
+	defer report.mutex.Unlock()
+
+	count := 0
+	for _, reported := range report.messages {
+		if reported == message {
+			count++
+		}
+	}
+
+	return count
+}
+
+// Waits until the condition holds, failing the test after a second
+func waitFor(t *testing.T, description string, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", description)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWatchReportsIgnoredChangeOnce(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+
+	writeConfig := func(yaml string) {
+		t.Helper()
+
+		err := os.WriteFile(path, []byte(yaml), 0644)
+		if err != nil {
+			t.Fatalf("Failed to write config: %v", err)
+		}
+	}
+
+	writeConfig(baseConfig)
+
+	err := config.Load(path, true)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	t.Cleanup(func() {
+		config.Load(baseConfigPath, true)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	report := &watchReport{}
+	go config.Watch(ctx, 10*time.Millisecond, report.add)
+
+	// Changes before the watch took its first look at the file go unnoticed
+	time.Sleep(50 * time.Millisecond)
+
+	ignored := "Ignoring change to port, it requires a restart"
+	restartOnly := strings.Replace(baseConfig, "port: 1", "port: 20", 1)
+
+	writeConfig(restartOnly)
+	waitFor(t, "the port change to be reported", func() bool { return report.count(ignored) == 1 })
+
+	// A later reload still sees the port differ from the running config, but it was reported already
+	writeConfig(restartOnly + "read_only: true\n")
+	waitFor(t, "read_only to be reloaded", config.GetReadOnly)
+
+	if count := report.count(ignored); count != 1 {
+		t.Errorf("Expected the port change to be reported once, got %d", count)
+	}
+
+	if port := config.Get().Port; port != 1 {
+		t.Errorf("Expected the running port to be kept, got %d", port)
+	}
+}
+
+func TestRemovalGuardMaxCountKeepsZero(t *testing.T) {
+	if count := config.GetRemovalGuardMaxCount(); count != 10 {
+		t.Errorf("Expected the default of 10 when unset, got %d", count)
+	}
+
+	setConfig(t, "removal_guard_max_count: 0\n")
+
+	if count := config.GetRemovalGuardMaxCount(); count != 0 {
+		t.Errorf("Expected 0 from the file, got %d", count)
+	}
+
+	t.Setenv("DEBRID_DRIVE_REMOVAL_GUARD_MAX_COUNT", "0")
+	setConfig(t, "")
+
+	if count := config.GetRemovalGuardMaxCount(); count != 0 {
+		t.Errorf("Expected 0 from the environment, got %d", count)
+	}
+}
+
+func TestGetReturnsCopies(t *testing.T) {
+	setConfig(t, "removal_guard_max_count: 3\nclients:\n  - name: \"kodi\"\n    token: \"kodi-token\"\nlog_levels:\n  Database: \"debug\"\n")
+
+	cfg := config.Get()
+	cfg.Clients[0].ReadOnly = true
+	cfg.LogLevels["Database"] = "error"
+	*cfg.RemovalGuardMaxCount = 5
+
+	clients := config.GetClients()
+	clients[0].Token = "changed"
+
+	logLevels := config.GetLogLevels()
+	logLevels["Poller"] = "error"
+
+	if client := config.GetClients()[0]; client.ReadOnly || client.Token != "kodi-token" {
+		t.Errorf("Expected the loaded client to be unchanged, got %+v", client)
+	}
+
+	if logLevels := config.GetLogLevels(); len(logLevels) != 1 || logLevels["Database"] != "debug" {
+		t.Errorf("Expected the loaded log levels to be unchanged, got %v", logLevels)
+	}
+
+	if count := config.GetRemovalGuardMaxCount(); count != 3 {
+		t.Errorf("Expected the loaded max count to be unchanged, got %d", count)
+	}
+}
@@ -0,0 +1,220 @@
+package e2e
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"debrid_drive/provider"
+	"debrid_drive/provider/fake"
+
+	api "github.com/sushydev/stream_mount_api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestGetStreamUrl(t *testing.T) {
+	h := newHarness(t)
+
+	h.addTorrent("T1", "/a.mkv")
+	h.poll(t)
+
+	node, err := h.lookup(t, "media_manager/T1/a.mkv")
+	if err != nil {
+		t.Fatalf("Failed to look up file: %v", err)
+	}
+
+	for range 2 {
+		response, err := h.client.GetStreamUrl(context.Background(), &api.GetStreamUrlRequest{NodeId: node.Id})
+		if err != nil {
+			t.Fatalf("Failed to get stream url: %v", err)
+		}
+
+		if response.Url != "https://download.test/T1/a.mkv" {
+			t.Fatalf("Unexpected stream url %s", response.Url)
+		}
+	}
+
+	// The second call is served from the cache
+	if calls := h.provider.GetCalls(fake.MethodUnrestrictLink); calls != 1 {
+		t.Errorf("Expected 1 unrestrict call, got %d", calls)
+	}
+}
+
+func TestGetStreamUrlAfterTorrentIsAddedAgain(t *testing.T) {
+	setConfig(t, "removal_guard_max_percent: 50\n")
+
+	h := newHarness(t)
+
+	h.addTorrent("T1", "/a.mkv")
+	h.addTorrent("T2", "/a.mkv")
+	h.poll(t)
+
+	if _, err := h.streamUrl(t, "media_manager/T1/a.mkv"); err != nil {
+		t.Fatalf("Failed to get stream url: %v", err)
+	}
+
+	h.provider.RemoveTorrent("T1")
+	h.poll(t)
+
+	h.addTorrent("T1", "/a.mkv")
+	h.provider.SetDownload("T1/0", provider.Download{Url: "https://download.test/T1/new.mkv", Filename: "a.mkv", Bytes: 1000})
+	h.poll(t)
+
+	url, err := h.streamUrl(t, "media_manager/T1/a.mkv")
+	if err != nil {
+		t.Fatalf("Failed to get stream url: %v", err)
+	}
+
+	// The url of the removed torrent was forgotten with it
+	if url != "https://download.test/T1/new.mkv" {
+		t.Errorf("Expected the url of the added torrent, got %s", url)
+	}
+}
+
+func TestGetStreamUrlOfUnavailableLink(t *testing.T) {
+	h := newHarness(t)
+
+	h.addTorrent("T1", "/a.mkv")
+	h.poll(t)
+
+	h.provider.SetError(fake.MethodUnrestrictLink, errors.New("Service unavailable"))
+
+	node, err := h.lookup(t, "media_manager/T1/a.mkv")
+	if err != nil {
+		t.Fatalf("Failed to look up file: %v", err)
+	}
+
+	_, err = h.client.GetStreamUrl(context.Background(), &api.GetStreamUrlRequest{NodeId: node.Id})
+	if err == nil {
+		t.Fatalf("Expected getting the stream url to fail")
+	}
+}
+
+func TestGetFileInfo(t *testing.T) {
+	h := newHarness(t)
+
+	h.addTorrent("T1", "/a.mkv", "/b.mkv")
+	h.poll(t)
+
+	node, err := h.lookup(t, "media_manager/T1/b.mkv")
+	if err != nil {
+		t.Fatalf("Failed to look up file: %v", err)
+	}
+
+	response, err := h.client.GetFileInfo(context.Background(), &api.GetFileInfoRequest{NodeId: node.Id})
+	if err != nil {
+		t.Fatalf("Failed to get file info: %v", err)
+	}
+
+	if response.Size != 2000 {
+		t.Errorf("Expected a size of 2000, got %d", response.Size)
+	}
+}
+
+func TestReadDirAll(t *testing.T) {
+	h := newHarness(t)
+
+	h.addTorrent("T1", "/a.mkv", "/b.mkv")
+	h.poll(t)
+
+	directory, err := h.lookup(t, "media_manager/T1")
+	if err != nil {
+		t.Fatalf("Failed to look up directory: %v", err)
+	}
+
+	response, err := h.client.ReadDirAll(context.Background(), &api.ReadDirAllRequest{NodeId: directory.Id})
+	if err != nil {
+		t.Fatalf("Failed to read directory: %v", err)
+	}
+
+	names := make([]string, 0, len(response.Nodes))
+	for _, node := range response.Nodes {
+		names = append(names, node.Name)
+	}
+
+	slices.Sort(names)
+
+	if !slices.Equal(names, []string{"a.mkv", "b.mkv"}) {
+		t.Errorf("Unexpected directory contents %v", names)
+	}
+}
+
+func TestRemoveDeletesTorrentRemotely(t *testing.T) {
+	h := newHarness(t)
+
+	h.addTorrent("T1", "/a.mkv", "/b.mkv")
+	h.addTorrent("T2", "/a.mkv")
+	h.poll(t)
+
+	directory, err := h.lookup(t, "media_manager/T1")
+	if err != nil {
+		t.Fatalf("Failed to look up directory: %v", err)
+	}
+
+	_, err = h.client.Remove(context.Background(), &api.RemoveRequest{ParentNodeId: directory.Id, Name: "a.mkv"})
+	if err != nil {
+		t.Fatalf("Failed to remove file: %v", err)
+	}
+
+	if deleted := h.provider.GetDeleted(); !slices.Equal(deleted, []string{"T1"}) {
+		t.Fatalf("Expected T1 to be deleted remotely, got %v", deleted)
+	}
+
+	if ids := h.torrentIds(t); !slices.Equal(ids, []string{"T2"}) {
+		t.Fatalf("Expected only T2 to remain, got %v", ids)
+	}
+
+	_, err = h.lookup(t, "media_manager/T1")
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("Expected the directory of T1 to be removed, got %v", err)
+	}
+
+	// The next poll finds the account in line with the library
+	h.poll(t)
+
+	if ids := h.torrentIds(t); !slices.Equal(ids, []string{"T2"}) {
+		t.Fatalf("Expected only T2 to remain after polling, got %v", ids)
+	}
+}
+
+func TestRemoveWithFilePolicyKeepsSiblings(t *testing.T) {
+	setConfig(t, "removal_policy: \"file\"\n")
+
+	h := newHarness(t)
+
+	h.addTorrent("T1", "/e01.mkv", "/e02.mkv")
+	h.poll(t)
+
+	h.remove(t, "media_manager/T1", "e01.mkv")
+
+	if deleted := h.provider.GetDeleted(); len(deleted) != 0 {
+		t.Fatalf("Expected nothing to be deleted remotely, got %v", deleted)
+	}
+
+	if _, err := h.lookup(t, "media_manager/T1/e01.mkv"); status.Code(err) != codes.NotFound {
+		t.Errorf("Expected e01.mkv to be removed, got %v", err)
+	}
+
+	if _, err := h.lookup(t, "media_manager/T1/e02.mkv"); err != nil {
+		t.Errorf("Expected e02.mkv to be kept: %v", err)
+	}
+
+	// Polling doesn't bring the removed file back
+	h.poll(t)
+
+	if _, err := h.lookup(t, "media_manager/T1/e01.mkv"); status.Code(err) != codes.NotFound {
+		t.Errorf("Expected e01.mkv to stay removed after polling, got %v", err)
+	}
+
+	h.remove(t, "media_manager/T1", "e02.mkv")
+
+	if deleted := h.provider.GetDeleted(); !slices.Equal(deleted, []string{"T1"}) {
+		t.Fatalf("Expected T1 to be deleted remotely with its last file, got %v", deleted)
+	}
+
+	if ids := h.torrentIds(t); len(ids) != 0 {
+		t.Errorf("Expected no torrents, got %v", ids)
+	}
+}
@@ -0,0 +1,208 @@
+package e2e
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	media_repository "debrid_drive/media/repository"
+	"debrid_drive/provider"
+	"debrid_drive/provider/fake"
+
+	api "github.com/sushydev/stream_mount_api"
+)
+
+// Replaces the link of the single file torrent, the old link is dead
+func replaceLink(h *harness, id string, path string, link string) {
+	h.provider.SetUnavailable(id + "/0")
+	h.provider.SetDownload(link, provider.Download{Url: "https://download.test/" + id + "/new" + path, Filename: path[1:]})
+	h.provider.SetTorrent(provider.Torrent{ID: id, Name: id, Bytes: 1000, Status: provider.StatusDownloaded}, []provider.TorrentFile{
+		{ID: 1, Path: path, Bytes: 1000, Selected: true},
+	}, []string{link})
+}
+
+func (h *harness) torrentFile(t *testing.T, path string) *media_repository.TorrentFile {
+	t.Helper()
+
+	node, err := h.lookup(t, path)
+	if err != nil {
+		t.Fatalf("Failed to look up file: %v", err)
+	}
+
+	torrentFile, err := h.mediaRepository.GetTorrentFileByFileId(node.Id)
+	if err != nil {
+		t.Fatalf("Failed to get torrent file: %v", err)
+	}
+
+	return torrentFile
+}
+
+func TestGetStreamUrlRefreshesDeadLink(t *testing.T) {
+	h := newHarness(t)
+
+	h.addTorrent("T1", "/a.mkv")
+	h.poll(t)
+
+	replaceLink(h, "T1", "/a.mkv", "T1/new")
+
+	node, err := h.lookup(t, "media_manager/T1/a.mkv")
+	if err != nil {
+		t.Fatalf("Failed to look up file: %v", err)
+	}
+
+	response, err := h.client.GetStreamUrl(context.Background(), &api.GetStreamUrlRequest{NodeId: node.Id})
+	if err != nil {
+		t.Fatalf("Failed to get stream url: %v", err)
+	}
+
+	if response.Url != "https://download.test/T1/new/a.mkv" {
+		t.Errorf("Expected the url of the refreshed link, got %s", response.Url)
+	}
+
+	torrentFile := h.torrentFile(t, "media_manager/T1/a.mkv")
+
+	if torrentFile.GetLink() != "T1/new" {
+		t.Errorf("Expected the refreshed link to be stored, got %s", torrentFile.GetLink())
+	}
+
+	if torrentFile.GetLinkFailures() != 0 || torrentFile.GetLinkCheckedAt().IsZero() {
+		t.Errorf("Expected the refreshed link to be healthy, got %d failures", torrentFile.GetLinkFailures())
+	}
+}
+
+func TestGetStreamUrlRecordsDeadLink(t *testing.T) {
+	h := newHarness(t)
+
+	h.addTorrent("T1", "/a.mkv")
+	h.poll(t)
+
+	h.provider.SetUnavailable("T1/0")
+
+	node, err := h.lookup(t, "media_manager/T1/a.mkv")
+	if err != nil {
+		t.Fatalf("Failed to look up file: %v", err)
+	}
+
+	calls := h.provider.GetCalls(fake.MethodGetTorrentInfo)
+
+	// The torrent still has the same link, so it is not tried again
+	_, err = h.client.GetStreamUrl(context.Background(), &api.GetStreamUrlRequest{NodeId: node.Id})
+	if err == nil {
+		t.Fatalf("Expected getting the stream url to fail")
+	}
+
+	if h.provider.GetCalls(fake.MethodGetTorrentInfo) != calls+1 {
+		t.Errorf("Expected the torrent info to be fetched for new links")
+	}
+
+	if failures := h.torrentFile(t, "media_manager/T1/a.mkv").GetLinkFailures(); failures != 1 {
+		t.Errorf("Expected 1 link failure, got %d", failures)
+	}
+}
+
+func TestCheckLinks(t *testing.T) {
+	h := newHarness(t)
+
+	h.addTorrent("T1", "/a.mkv", "/b.mkv")
+	h.poll(t)
+
+	err := h.mediaService.CheckLinks(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to check links: %v", err)
+	}
+
+	if calls := h.provider.GetCalls(fake.MethodUnrestrictLink); calls != 2 {
+		t.Fatalf("Expected 2 unrestrict calls, got %d", calls)
+	}
+
+	if h.torrentFile(t, "media_manager/T1/a.mkv").GetLinkCheckedAt().IsZero() {
+		t.Errorf("Expected the link check to be recorded")
+	}
+
+	// Checked links are not checked again, and their stream urls are cached
+	err = h.mediaService.CheckLinks(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to check links: %v", err)
+	}
+
+	node, err := h.lookup(t, "media_manager/T1/a.mkv")
+	if err != nil {
+		t.Fatalf("Failed to look up file: %v", err)
+	}
+
+	_, err = h.client.GetStreamUrl(context.Background(), &api.GetStreamUrlRequest{NodeId: node.Id})
+	if err != nil {
+		t.Fatalf("Failed to get stream url: %v", err)
+	}
+
+	if calls := h.provider.GetCalls(fake.MethodUnrestrictLink); calls != 2 {
+		t.Errorf("Expected no more unrestrict calls, got %d", calls)
+	}
+}
+
+func TestCheckLinksRefreshesDeadLinks(t *testing.T) {
+	h := newHarness(t)
+
+	h.addTorrent("T1", "/a.mkv")
+	h.poll(t)
+
+	replaceLink(h, "T1", "/a.mkv", "T1/new")
+
+	err := h.mediaService.CheckLinks(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to check links: %v", err)
+	}
+
+	if link := h.torrentFile(t, "media_manager/T1/a.mkv").GetLink(); link != "T1/new" {
+		t.Errorf("Expected the refreshed link to be stored, got %s", link)
+	}
+}
+
+// A link whose hoster is down is moved to the back of the checks, so it doesn't keep others from being checked
+func TestCheckLinksMovesOnFromUnconfirmedLinks(t *testing.T) {
+	setConfig(t, "link_check_batch_size: 1\n")
+
+	h := newHarness(t)
+
+	h.addTorrent("T1", "/a.mkv")
+	h.addTorrent("T2", "/b.mkv")
+	h.poll(t)
+
+	first, err := h.mediaRepository.GetTorrentFilesCheckedBefore(time.Now(), 1)
+	if err != nil || len(first) != 1 {
+		t.Fatalf("Failed to get the first file to check: %v", err)
+	}
+
+	h.provider.SetUnconfirmed(first[0].GetLink())
+
+	for range 2 {
+		err := h.mediaService.CheckLinks(context.Background())
+		if err != nil {
+			t.Fatalf("Failed to check links: %v", err)
+		}
+	}
+
+	for _, path := range []string{"media_manager/T1/a.mkv", "media_manager/T2/b.mkv"} {
+		torrentFile := h.torrentFile(t, path)
+
+		if torrentFile.GetLinkCheckedAt().IsZero() {
+			t.Errorf("Expected the link of %s to be checked", path)
+		}
+
+		if torrentFile.GetLinkFailures() != 0 {
+			t.Errorf("Expected no link failures for %s, got %d", path, torrentFile.GetLinkFailures())
+		}
+	}
+
+	// Both were checked, the unconfirmed link is not tried again until it is due
+	calls := h.provider.GetCalls(fake.MethodGetTorrentInfo)
+
+	err = h.mediaService.CheckLinks(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to check links: %v", err)
+	}
+
+	if h.provider.GetCalls(fake.MethodGetTorrentInfo) != calls {
+		t.Errorf("Expected the unconfirmed link not to be refreshed again")
+	}
+}
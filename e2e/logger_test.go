@@ -0,0 +1,243 @@
+package e2e
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"debrid_drive/logger"
+)
+
+// Services are registered once per process, so every logger of a test gets a name of its own
+var testLoggers atomic.Uint64
+
+// Creates a logger writing to a temporary directory with the options and returns it with the path of its file
+// The default options are restored when the test ends
+func newTestLogger(t *testing.T, options logger.Options) (*logger.Logger, string) {
+	t.Helper()
+
+	return newTestLoggerAfter(t, options, func(path string) {})
+}
+
+// Like newTestLogger, prepare runs before the logger opens its file, e.g. to leave files of an earlier run behind
+func newTestLoggerAfter(t *testing.T, options logger.Options, prepare func(path string)) (*logger.Logger, string) {
+	t.Helper()
+
+	previous := logger.LogDir
+
+	options.Directory = t.TempDir()
+
+	err := logger.Configure(options)
+	if err != nil {
+		t.Fatalf("Failed to configure logger: %v", err)
+	}
+
+	t.Cleanup(func() {
+		logger.Configure(logger.Options{Directory: previous})
+	})
+
+	name := fmt.Sprintf("test %d", testLoggers.Add(1))
+	path := filepath.Join(options.Directory, strings.ReplaceAll(name, " ", "_")+".log")
+
+	prepare(path)
+
+	instance, err := logger.NewLogger(name)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+
+	return instance, path
+}
+
+// Rotated files of the log file
+func logBackups(t *testing.T, path string) []string {
+	t.Helper()
+
+	backups, err := filepath.Glob(path + ".*")
+	if err != nil {
+		t.Fatalf("Failed to list backups: %v", err)
+	}
+
+	return backups
+}
+
+func readLog(t *testing.T, path string) string {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read log: %v", err)
+	}
+
+	return string(data)
+}
+
+func TestLogRotatesBySize(t *testing.T) {
+	instance, path := newTestLogger(t, logger.Options{MaxSizeMegabytes: 1})
+
+	entry := strings.Repeat("x", 100*1024)
+
+	for range 8 {
+		instance.Info(entry)
+	}
+
+	if backups := logBackups(t, path); len(backups) != 0 {
+		t.Fatalf("Expected no rotation under the size, got %v", backups)
+	}
+
+	for range 4 {
+		instance.Info(entry)
+	}
+
+	backups := logBackups(t, path)
+	if len(backups) != 1 {
+		t.Fatalf("Expected one rotation past the size, got %v", backups)
+	}
+
+	// The suffix is the rotation time
+	suffix := strings.TrimPrefix(backups[0], path+".")
+	if _, err := time.Parse("20060102-150405.000", suffix); err != nil {
+		t.Errorf("Unexpected backup name %s: %v", backups[0], err)
+	}
+}
+
+func TestLogRotatesByAge(t *testing.T) {
+	instance, path := newTestLogger(t, logger.Options{MaxAge: 50 * time.Millisecond})
+
+	instance.Info("first")
+	instance.Info("second")
+
+	if backups := logBackups(t, path); len(backups) != 0 {
+		t.Fatalf("Expected no rotation before the age, got %v", backups)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	instance.Info("third")
+
+	if backups := logBackups(t, path); len(backups) != 1 {
+		t.Fatalf("Expected one rotation past the age, got %v", backups)
+	}
+
+	if content := readLog(t, path); !strings.Contains(content, "third") || strings.Contains(content, "first") {
+		t.Errorf("Expected the new file to start with the entry after the rotation, got %s", content)
+	}
+}
+
+// The age of a file left by an earlier run counts from its last rotation, not from when it was opened again
+func TestLogRotatesByAgeAcrossRestarts(t *testing.T) {
+	instance, path := newTestLoggerAfter(t, logger.Options{MaxAge: time.Hour}, func(path string) {
+		err := os.WriteFile(path, []byte("earlier run\n"), 0644)
+		if err != nil {
+			t.Fatalf("Failed to write log: %v", err)
+		}
+
+		rotatedAt := time.Now().Add(-2 * time.Hour)
+
+		err = os.WriteFile(path+"."+rotatedAt.Format("20060102-150405.000"), []byte("older run\n"), 0644)
+		if err != nil {
+			t.Fatalf("Failed to write backup: %v", err)
+		}
+	})
+
+	instance.Info("new run")
+
+	if backups := logBackups(t, path); len(backups) != 2 {
+		t.Fatalf("Expected the file of the earlier run to be rotated, got %v", backups)
+	}
+
+	if content := readLog(t, path); strings.Contains(content, "earlier run") {
+		t.Errorf("Expected the new file to start with the entry after the rotation, got %s", content)
+	}
+}
+
+// Without a rotation to go by, a file left by an earlier run is as old as its last write
+func TestLogRotatesByModificationTime(t *testing.T) {
+	instance, path := newTestLoggerAfter(t, logger.Options{MaxAge: time.Hour}, func(path string) {
+		err := os.WriteFile(path, []byte("earlier run\n"), 0644)
+		if err != nil {
+			t.Fatalf("Failed to write log: %v", err)
+		}
+
+		modifiedAt := time.Now().Add(-2 * time.Hour)
+
+		err = os.Chtimes(path, modifiedAt, modifiedAt)
+		if err != nil {
+			t.Fatalf("Failed to change log times: %v", err)
+		}
+	})
+
+	instance.Info("new run")
+
+	if backups := logBackups(t, path); len(backups) != 1 {
+		t.Fatalf("Expected the file of the earlier run to be rotated, got %v", backups)
+	}
+}
+
+func TestLogKeepsMaxBackups(t *testing.T) {
+	instance, path := newTestLogger(t, logger.Options{MaxSizeMegabytes: 1, MaxBackups: 2})
+
+	entry := strings.Repeat("x", 600*1024)
+
+	// Every entry past the first rotates, apart in time so the backups get their own names
+	for range 5 {
+		instance.Info(entry)
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if backups := logBackups(t, path); len(backups) != 2 {
+		t.Fatalf("Expected 2 backups, got %v", backups)
+	}
+}
+
+// Only files with a rotation time suffix count as backups
+func TestLogKeepsOtherFiles(t *testing.T) {
+	instance, path := newTestLoggerAfter(t, logger.Options{MaxSizeMegabytes: 1, MaxBackups: 1}, func(path string) {
+		err := os.WriteFile(path+".1", []byte("not a backup\n"), 0644)
+		if err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	})
+
+	entry := strings.Repeat("x", 600*1024)
+
+	for range 3 {
+		instance.Info(entry)
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if _, err := os.Stat(path + ".1"); err != nil {
+		t.Errorf("Expected the unrelated file to be kept: %v", err)
+	}
+}
+
+func TestConfigureChangesLevelOfExistingLogger(t *testing.T) {
+	instance, path := newTestLogger(t, logger.Options{Level: "warn"})
+
+	instance.Info("hidden")
+
+	err := logger.Configure(logger.Options{Directory: filepath.Dir(path), Levels: map[string]string{serviceOf(path): "debug"}})
+	if err != nil {
+		t.Fatalf("Failed to configure logger: %v", err)
+	}
+
+	instance.Debug("shown")
+
+	content := readLog(t, path)
+
+	if strings.Contains(content, "hidden") {
+		t.Errorf("Expected the info entry to be dropped at warn")
+	}
+
+	if !strings.Contains(content, "shown") {
+		t.Errorf("Expected the debug entry to be written after the level changed")
+	}
+}
+
+// Name of the service writing to the log file
+func serviceOf(path string) string {
+	return strings.ReplaceAll(strings.TrimSuffix(filepath.Base(path), ".log"), "_", " ")
+}
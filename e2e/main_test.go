@@ -0,0 +1,378 @@
+package e2e
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"debrid_drive/account"
+	"debrid_drive/config"
+	"debrid_drive/database"
+	file_system_server "debrid_drive/filesystem/service"
+	"debrid_drive/filesystem/symlink"
+	"debrid_drive/logger"
+	media_repository "debrid_drive/media/repository"
+	media_service "debrid_drive/media/service"
+	"debrid_drive/metrics"
+	"debrid_drive/poller/action"
+	"debrid_drive/provider"
+	"debrid_drive/provider/fake"
+	"debrid_drive/provider/real_debrid"
+	"debrid_drive/provider/real_debrid/fake_server"
+
+	api "github.com/sushydev/stream_mount_api"
+	"github.com/sushydev/vfs_go"
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+const (
+	token      = "test-token"
+	baseConfig = "port: 1\ncontent_type: \"application/debrid-drive\"\nreal_debrid_token: \"" + token + "\"\n"
+)
+
+// Config file loaded for every test
+var baseConfigPath string
+
+func TestMain(m *testing.M) {
+	os.Exit(run(m))
+}
+
+func run(m *testing.M) int {
+	directory, err := os.MkdirTemp("", "debrid_drive_e2e_")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer os.RemoveAll(directory)
+
+	logger.LogDir = filepath.Join(directory, "logs")
+
+	baseConfigPath = filepath.Join(directory, "config.yml")
+
+	err = os.WriteFile(baseConfigPath, []byte(baseConfig), 0644)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	err = config.Load(baseConfigPath, true)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	return m.Run()
+}
+
+// Loads the base config with the yaml appended, the base config is loaded again when the test ends
+func setConfig(t *testing.T, yaml string) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.yml")
+
+	err := os.WriteFile(path, []byte(baseConfig+yaml), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	err = config.Load(path, true)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	t.Cleanup(func() {
+		config.Load(baseConfigPath, true)
+	})
+}
+
+// A server wired to a fake provider, a temporary database and file system, and a grpc client
+type harness struct {
+	// The in memory provider, set by newHarness
+	provider *fake.Fake
+	// The fake Real-Debrid api, set by newRealDebridHarness
+	server *fake_server.Server
+	// The in memory provider of every account by name, set by newAccountsHarness
+	providers map[string]*fake.Fake
+
+	database        *database.Instance
+	fileSystem      *filesystem.FileSystem
+	mediaRepository *media_repository.MediaRepository
+	mediaService    *media_service.MediaService
+	actioner        *action.Actioner
+	client          api.FileSystemServiceClient
+
+	// Name of the account the actioner above polls, the first one unless set by forAccount
+	account string
+	// Actioner of every account by name
+	actioners map[string]*action.Actioner
+}
+
+func newHarness(t *testing.T) *harness {
+	t.Helper()
+
+	fakeProvider := fake.New()
+
+	h := newHarnessWith(t, fakeProvider)
+	h.provider = fakeProvider
+
+	return h
+}
+
+// Goes through the Real-Debrid client and the fake api, for tests of the http side like retries, status codes and request metrics
+func newRealDebridHarness(t *testing.T) *harness {
+	t.Helper()
+
+	server := fake_server.New(token)
+	t.Cleanup(server.Close)
+
+	h := newHarnessWith(t, real_debrid.New(token, real_debrid.Instrument(config.DefaultAccountName, server.Client())))
+	h.server = server
+
+	return h
+}
+
+// An in memory provider for every account in the config, see forAccount
+func newAccountsHarness(t *testing.T) *harness {
+	t.Helper()
+
+	accountConfigs := config.GetAccounts()
+
+	fakeProviders := make(map[string]*fake.Fake, len(accountConfigs))
+	debridProviders := make([]provider.Provider, 0, len(accountConfigs))
+
+	for _, accountConfig := range accountConfigs {
+		fakeProvider := fake.New()
+
+		fakeProviders[accountConfig.Name] = fakeProvider
+		debridProviders = append(debridProviders, fakeProvider)
+	}
+
+	h := newHarnessWith(t, debridProviders...)
+	h.provider = fakeProviders[accountConfigs[0].Name]
+	h.providers = fakeProviders
+
+	return h
+}
+
+// Copy of the harness that adds torrents to and polls the named account
+func (h *harness) forAccount(name string) *harness {
+	accountHarness := *h
+	accountHarness.provider = h.providers[name]
+	accountHarness.actioner = h.actioners[name]
+	accountHarness.account = name
+
+	return &accountHarness
+}
+
+// Takes a provider for every account in the config, in the same order
+func newHarnessWith(t *testing.T, debridProviders ...provider.Provider) *harness {
+	t.Helper()
+
+	directory := t.TempDir()
+
+	database, err := database.NewInstance(filepath.Join(directory, "media.db"))
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	t.Cleanup(database.Close)
+
+	fileSystemPath := filepath.Join(directory, "filesystem.db")
+	fileSystem, err := filesystem.New(fileSystemPath)
+	if err != nil {
+		t.Fatalf("Failed to create file system: %v", err)
+	}
+
+	accountConfigs := config.GetAccounts()
+	if len(accountConfigs) != len(debridProviders) {
+		t.Fatalf("Expected a provider for each of the %d accounts, got %d", len(accountConfigs), len(debridProviders))
+	}
+
+	accounts := make([]*account.Account, 0, len(accountConfigs))
+	for index, accountConfig := range accountConfigs {
+		accounts = append(accounts, account.New(accountConfig, debridProviders[index]))
+	}
+
+	mediaRepository := media_repository.NewMediaService(database.GetDatabase())
+	symlinks := symlink.NewResolver(fileSystem, mediaRepository)
+	mediaService := media_service.NewMediaService(accounts, database, fileSystem, symlinks, mediaRepository)
+
+	actioners := make(map[string]*action.Actioner, len(accounts))
+	for _, account := range accounts {
+		actioners[account.GetName()] = action.New(account, mediaRepository, mediaService, fileSystem, fileSystemPath)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	grpcServer := grpc.NewServer(grpc.ChainUnaryInterceptor(metrics.UnaryServerInterceptor))
+	api.RegisterFileSystemServiceServer(grpcServer, file_system_server.NewFileSystemService(fileSystem, mediaService))
+
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	connection, err := grpc.NewClient(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	t.Cleanup(func() { connection.Close() })
+
+	return &harness{
+		database:        database,
+		fileSystem:      fileSystem,
+		mediaRepository: mediaRepository,
+		mediaService:    mediaService,
+		actioner:        actioners[accounts[0].GetName()],
+		account:         accounts[0].GetName(),
+		actioners:       actioners,
+		client:          api.NewFileSystemServiceClient(connection),
+	}
+}
+
+// Adds a downloaded torrent with a selected file and link per path
+func (h *harness) addTorrent(id string, paths ...string) {
+	if h.server != nil {
+		h.addRealDebridTorrent(id, paths...)
+		return
+	}
+
+	files := make([]provider.TorrentFile, 0, len(paths))
+	links := make([]string, 0, len(paths))
+
+	for index, filePath := range paths {
+		link := fmt.Sprintf("%s/%d", id, index)
+
+		files = append(files, provider.TorrentFile{ID: index + 1, Path: filePath, Bytes: 1000 * (index + 1), Selected: true})
+		links = append(links, link)
+
+		h.provider.SetDownload(link, provider.Download{Url: "https://download.test/" + id + filePath, Filename: path.Base(filePath), Bytes: 1000 * (index + 1)})
+	}
+
+	h.provider.SetTorrent(provider.Torrent{
+		ID:     id,
+		Name:   id,
+		Bytes:  1000 * len(paths),
+		Status: provider.StatusDownloaded,
+		Added:  "2024-01-01T00:00:00.000Z",
+	}, files, links)
+}
+
+func (h *harness) addRealDebridTorrent(id string, paths ...string) {
+	files := make([]fake_server.TorrentFile, 0, len(paths))
+	links := make([]string, 0, len(paths))
+
+	for index, path := range paths {
+		link := fake_server.Link(fmt.Sprintf("%s%d", id, index))
+
+		files = append(files, fake_server.TorrentFile{ID: index + 1, Path: path, Bytes: 1000 * (index + 1), Selected: 1})
+		links = append(links, link)
+
+		h.server.SetUrl(link, "https://download.test/"+id+path)
+	}
+
+	h.server.SetTorrent(fake_server.Torrent{
+		ID:       id,
+		Filename: id,
+		Bytes:    1000 * len(paths),
+		Status:   "downloaded",
+		Added:    "2024-01-01T00:00:00.000Z",
+		Links:    links,
+	}, files)
+}
+
+func (h *harness) poll(t *testing.T) {
+	t.Helper()
+
+	err := h.actioner.Poll(context.Background())
+	if err != nil {
+		t.Fatalf("Poll failed: %v", err)
+	}
+}
+
+func (h *harness) torrentIds(t *testing.T) []string {
+	t.Helper()
+
+	torrents, err := h.mediaRepository.GetTorrents()
+	if err != nil {
+		t.Fatalf("Failed to get torrents: %v", err)
+	}
+
+	ids := make([]string, 0, len(torrents))
+	for _, torrent := range torrents {
+		ids = append(ids, torrent.GetTorrentIdentifier())
+	}
+
+	return ids
+}
+
+func (h *harness) rejection(t *testing.T, torrentId string) *media_repository.RejectedTorrent {
+	t.Helper()
+
+	rejected, err := h.mediaRepository.GetRejectedTorrent(h.account, torrentId)
+	if err != nil {
+		t.Fatalf("Failed to get rejected torrent: %v", err)
+	}
+
+	if rejected == nil {
+		t.Fatalf("Expected %s to be rejected", torrentId)
+	}
+
+	return rejected
+}
+
+// Moves every scheduled retry into the past
+func (h *harness) makeRetriesDue(t *testing.T) {
+	t.Helper()
+
+	_, err := h.database.GetDatabase().Exec("UPDATE rejected_torrents SET retry_at = 0 WHERE retry_at IS NOT NULL")
+	if err != nil {
+		t.Fatalf("Failed to update retries: %v", err)
+	}
+}
+
+// Looks up a slash separated path from the root over grpc
+func (h *harness) lookup(t *testing.T, path string) (*api.Node, error) {
+	t.Helper()
+
+	ctx := context.Background()
+
+	root, err := h.client.Root(ctx, &api.RootRequest{})
+	if err != nil {
+		t.Fatalf("Failed to get root: %v", err)
+	}
+
+	node := root.Root
+
+	for _, name := range strings.Split(path, "/") {
+		response, err := h.client.Lookup(ctx, &api.LookupRequest{NodeId: node.Id, Name: name})
+		if err != nil {
+			return nil, err
+		}
+
+		node = response.Node
+	}
+
+	return node, nil
+}
+
+// Removes a file over grpc, like rm in a mount
+func (h *harness) remove(t *testing.T, directory string, name string) {
+	t.Helper()
+
+	parent, err := h.lookup(t, directory)
+	if err != nil {
+		t.Fatalf("Failed to look up %s: %v", directory, err)
+	}
+
+	_, err = h.client.Remove(context.Background(), &api.RemoveRequest{ParentNodeId: parent.Id, Name: name})
+	if err != nil {
+		t.Fatalf("Failed to remove %s/%s: %v", directory, name, err)
+	}
+}
@@ -0,0 +1,108 @@
+package e2e
+
+import (
+	"io"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"debrid_drive/metrics"
+	"debrid_drive/provider"
+)
+
+func scrape(t *testing.T) string {
+	t.Helper()
+
+	recorder := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	body, err := io.ReadAll(recorder.Result().Body)
+	if err != nil {
+		t.Fatalf("Failed to read metrics: %v", err)
+	}
+
+	return string(body)
+}
+
+func TestMetrics(t *testing.T) {
+	// Provider requests are counted by the http client
+	h := newRealDebridHarness(t)
+
+	h.addTorrent("T1", "/a.mkv")
+	h.poll(t)
+
+	// Lookups go through the grpc client
+	_, err := h.lookup(t, "media_manager/T1/a.mkv")
+	if err != nil {
+		t.Fatalf("Failed to look up file: %v", err)
+	}
+
+	body := scrape(t)
+
+	expected := []string{
+		`debrid_drive_poll_total{account="default",outcome="success"}`,
+		`debrid_drive_poll_duration_seconds_count{account="default"}`,
+		`debrid_drive_torrents_added_total{account="default"}`,
+		`debrid_drive_provider_requests_total{account="default",code="200",endpoint="/torrents"}`,
+		`debrid_drive_provider_request_duration_seconds_count{account="default",endpoint="/torrents/info/{id}"}`,
+		`debrid_drive_grpc_requests_total{code="OK",method="/stream_mount_api.FileSystemService/Lookup"}`,
+	}
+
+	for _, line := range expected {
+		if !strings.Contains(body, line) {
+			t.Errorf("Expected metrics to contain %s", line)
+		}
+	}
+}
+
+// Value of the metric line, 0 when it is missing
+func metricValue(t *testing.T, line string) float64 {
+	t.Helper()
+
+	for _, scraped := range strings.Split(scrape(t), "\n") {
+		value, ok := strings.CutPrefix(scraped, line+" ")
+		if !ok {
+			continue
+		}
+
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", scraped, err)
+		}
+
+		return parsed
+	}
+
+	return 0
+}
+
+// Torrents are counted once per change, after it is committed
+func TestMetricsCountCommittedChanges(t *testing.T) {
+	h := newHarness(t)
+
+	counters := []string{
+		`debrid_drive_torrents_added_total{account="default"}`,
+		`debrid_drive_torrents_rejected_total{account="default",reason="missing_links"}`,
+		`debrid_drive_torrents_removed_total{account="default"}`,
+	}
+
+	before := make([]float64, len(counters))
+	for index, counter := range counters {
+		before[index] = metricValue(t, counter)
+	}
+
+	h.addTorrent("T1", "/a.mkv")
+	h.provider.SetTorrent(provider.Torrent{ID: "T2", Name: "T2", Bytes: 1000, Status: provider.StatusDownloaded}, []provider.TorrentFile{
+		{ID: 1, Path: "/a.mkv", Bytes: 1000, Selected: true},
+	}, nil)
+	h.poll(t)
+
+	h.remove(t, "media_manager/T1", "a.mkv")
+
+	for index, counter := range counters {
+		if delta := metricValue(t, counter) - before[index]; delta != 1 {
+			t.Errorf("Expected %s to grow by 1, got %v", counter, delta)
+		}
+	}
+}
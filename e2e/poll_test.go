@@ -0,0 +1,456 @@
+package e2e
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"debrid_drive/config"
+	media_service "debrid_drive/media/service"
+	"debrid_drive/poller"
+	"debrid_drive/provider"
+	"debrid_drive/provider/fake"
+)
+
+func TestPollAddsDownloadedTorrents(t *testing.T) {
+	h := newHarness(t)
+
+	h.addTorrent("T1", "/a.mkv", "/b.mkv")
+	h.provider.SetTorrent(provider.Torrent{ID: "T2", Name: "T2", Bytes: 1000, Status: "downloading"}, nil, nil)
+
+	h.poll(t)
+
+	if ids := h.torrentIds(t); !slices.Equal(ids, []string{"T1"}) {
+		t.Fatalf("Expected only T1 to be added, got %v", ids)
+	}
+
+	for _, path := range []string{"media_manager/T1/a.mkv", "media_manager/T1/b.mkv"} {
+		node, err := h.lookup(t, path)
+		if err != nil {
+			t.Fatalf("Failed to look up %s: %v", path, err)
+		}
+
+		if !node.Streamable {
+			t.Errorf("Expected %s to be streamable", path)
+		}
+	}
+
+	if _, err := h.lookup(t, "media_manager/T2"); err == nil {
+		t.Errorf("Expected T2 to be skipped until it is downloaded")
+	}
+}
+
+func TestPollAddsTorrentOnceDownloaded(t *testing.T) {
+	h := newHarness(t)
+
+	h.provider.SetTorrent(provider.Torrent{ID: "T1", Name: "T1", Bytes: 1000, Status: "downloading"}, nil, nil)
+	h.poll(t)
+
+	if ids := h.torrentIds(t); len(ids) != 0 {
+		t.Fatalf("Expected nothing to be added, got %v", ids)
+	}
+
+	h.addTorrent("T1", "/a.mkv")
+	h.poll(t)
+
+	if ids := h.torrentIds(t); !slices.Equal(ids, []string{"T1"}) {
+		t.Fatalf("Expected T1 to be added, got %v", ids)
+	}
+}
+
+func TestPollRejectsTorrentsWithMissingLinks(t *testing.T) {
+	h := newHarness(t)
+
+	h.provider.SetTorrent(provider.Torrent{ID: "T1", Name: "T1", Bytes: 2000, Status: provider.StatusDownloaded}, []provider.TorrentFile{
+		{ID: 1, Path: "/a.mkv", Bytes: 1000, Selected: true},
+		{ID: 2, Path: "/b.mkv", Bytes: 1000, Selected: true},
+	}, []string{"T1/0"})
+	h.provider.SetDownload("T1/0", provider.Download{Url: "https://download.test/T1/a.mkv", Filename: "a.mkv"})
+
+	h.poll(t)
+
+	rejected := h.rejection(t, "T1")
+
+	if rejected.GetReason() != media_service.RejectionMissingLinks || rejected.GetAttempts() != 1 {
+		t.Fatalf("Expected a first missing links rejection, got %s after %d attempts", rejected.GetReason(), rejected.GetAttempts())
+	}
+
+	if delay := time.Until(rejected.GetRetryAt()); delay < 14*time.Minute || delay > 16*time.Minute {
+		t.Errorf("Expected a retry in 15 minutes, got %s", delay)
+	}
+
+	// Nothing of the failed add is kept
+	if ids := h.torrentIds(t); len(ids) != 0 {
+		t.Fatalf("Expected nothing to be added, got %v", ids)
+	}
+
+	if _, err := h.lookup(t, "media_manager/T1"); err == nil {
+		t.Errorf("Expected no directory for the rejected torrent")
+	}
+
+	// Rejected torrents are not looked at again until the retry is due
+	calls := h.provider.GetCalls(fake.MethodGetTorrentInfo)
+	h.poll(t)
+
+	if h.provider.GetCalls(fake.MethodGetTorrentInfo) != calls {
+		t.Errorf("Expected the rejected torrent to be skipped")
+	}
+
+	if h.actioner.HasPendingTorrents() {
+		t.Errorf("Expected no pending torrents before the retry is due")
+	}
+}
+
+func TestPollRetriesRejectionsWithBackoff(t *testing.T) {
+	h := newHarness(t)
+
+	h.provider.SetTorrent(provider.Torrent{ID: "T1", Name: "T1", Bytes: 1000, Status: provider.StatusDownloaded}, []provider.TorrentFile{
+		{ID: 1, Path: "/a.mkv", Bytes: 1000, Selected: true},
+	}, nil)
+
+	h.poll(t)
+
+	expected := []time.Duration{30 * time.Minute, time.Hour}
+
+	for index, delay := range expected {
+		h.makeRetriesDue(t)
+
+		if !h.actioner.HasPendingTorrents() {
+			t.Fatalf("Expected the due rejection to be pending")
+		}
+
+		h.poll(t)
+
+		rejected := h.rejection(t, "T1")
+
+		if rejected.GetAttempts() != index+2 {
+			t.Fatalf("Expected %d attempts, got %d", index+2, rejected.GetAttempts())
+		}
+
+		if actual := time.Until(rejected.GetRetryAt()); actual < delay-time.Minute || actual > delay+time.Minute {
+			t.Errorf("Expected a retry in %s, got %s", delay, actual)
+		}
+	}
+
+	// The links showed up, the next retry adds the torrent
+	h.addTorrent("T1", "/a.mkv")
+	h.makeRetriesDue(t)
+	h.poll(t)
+
+	if ids := h.torrentIds(t); !slices.Equal(ids, []string{"T1"}) {
+		t.Fatalf("Expected T1 to be added, got %v", ids)
+	}
+
+	rejected, err := h.mediaRepository.GetRejectedTorrents()
+	if err != nil {
+		t.Fatalf("Failed to get rejected torrents: %v", err)
+	}
+
+	if len(rejected) != 0 {
+		t.Errorf("Expected the rejection to be cleared, got %d", len(rejected))
+	}
+}
+
+func TestPollDoesNotRetryPermanentRejections(t *testing.T) {
+	h := newHarness(t)
+
+	h.provider.SetTorrent(provider.Torrent{ID: "T1", Name: "T1", Bytes: 1000, Status: provider.StatusDownloaded}, []provider.TorrentFile{
+		{ID: 1, Path: "/a.mkv", Bytes: 1000, Selected: false},
+	}, nil)
+
+	h.poll(t)
+
+	rejected := h.rejection(t, "T1")
+
+	if rejected.GetReason() != media_service.RejectionNoSelectedFiles {
+		t.Fatalf("Expected a no selected files rejection, got %s", rejected.GetReason())
+	}
+
+	if !rejected.GetRetryAt().IsZero() {
+		t.Errorf("Expected no retry, got %s", rejected.GetRetryAt())
+	}
+
+	if deleted := h.provider.GetDeleted(); len(deleted) != 0 {
+		t.Errorf("Expected nothing to be deleted remotely, got %v", deleted)
+	}
+}
+
+func TestPollRetriesClearedRejections(t *testing.T) {
+	h := newHarness(t)
+
+	h.provider.SetTorrent(provider.Torrent{ID: "T1", Name: "T1", Bytes: 1000, Status: provider.StatusDownloaded}, []provider.TorrentFile{
+		{ID: 1, Path: "/a.mkv", Bytes: 1000, Selected: false},
+	}, nil)
+
+	h.poll(t)
+	h.rejection(t, "T1")
+
+	h.addTorrent("T1", "/a.mkv")
+
+	count, err := h.mediaRepository.ClearRejectedTorrents([]string{"T1"})
+	if err != nil || count != 1 {
+		t.Fatalf("Expected 1 cleared rejection, got %d: %v", count, err)
+	}
+
+	if !h.actioner.HasPendingTorrents() {
+		t.Fatalf("Expected the cleared torrent to be pending")
+	}
+
+	h.poll(t)
+
+	if ids := h.torrentIds(t); !slices.Equal(ids, []string{"T1"}) {
+		t.Fatalf("Expected T1 to be added, got %v", ids)
+	}
+}
+
+func TestPollRemovesTorrentsMissingFromAccount(t *testing.T) {
+	setConfig(t, "removal_guard_max_percent: 50\n")
+
+	h := newHarness(t)
+
+	h.addTorrent("T1", "/a.mkv")
+	h.addTorrent("T2", "/a.mkv")
+	h.poll(t)
+
+	h.provider.RemoveTorrent("T1")
+	h.poll(t)
+
+	if ids := h.torrentIds(t); !slices.Equal(ids, []string{"T2"}) {
+		t.Fatalf("Expected only T2 to remain, got %v", ids)
+	}
+
+	if _, err := h.lookup(t, "media_manager/T1"); err == nil {
+		t.Errorf("Expected the directory of T1 to be removed")
+	}
+
+	if deleted := h.provider.GetDeleted(); len(deleted) != 0 {
+		t.Errorf("Expected nothing to be deleted remotely, got %v", deleted)
+	}
+}
+
+func TestPollKeepsLibraryWhenListingFails(t *testing.T) {
+	h := newHarness(t)
+
+	h.addTorrent("T1", "/a.mkv")
+	h.poll(t)
+
+	h.provider.RemoveTorrent("T1")
+	h.provider.SetError(fake.MethodListTorrents, errors.New("Permission denied"))
+
+	err := h.actioner.Poll(context.Background())
+	if err == nil {
+		t.Fatalf("Expected the poll to fail")
+	}
+
+	if ids := h.torrentIds(t); !slices.Equal(ids, []string{"T1"}) {
+		t.Fatalf("Expected T1 to be kept, got %v", ids)
+	}
+}
+
+func TestPollHoldsMassRemovals(t *testing.T) {
+	h := newHarness(t)
+
+	for index := range 12 {
+		h.addTorrent(fmt.Sprintf("T%d", index), "/a.mkv")
+	}
+
+	h.poll(t)
+
+	for index := range 12 {
+		h.provider.RemoveTorrent(fmt.Sprintf("T%d", index))
+	}
+
+	h.poll(t)
+
+	if ids := h.torrentIds(t); len(ids) != 12 {
+		t.Fatalf("Expected every torrent to be kept, got %d", len(ids))
+	}
+
+	heldRemovals, err := h.mediaRepository.GetHeldRemovals(config.DefaultAccountName)
+	if err != nil {
+		t.Fatalf("Failed to get held removals: %v", err)
+	}
+
+	if len(heldRemovals) != 12 {
+		t.Fatalf("Expected 12 held removals, got %d", len(heldRemovals))
+	}
+
+	_, err = h.mediaRepository.ConfirmHeldRemovals(config.DefaultAccountName, nil)
+	if err != nil {
+		t.Fatalf("Failed to confirm held removals: %v", err)
+	}
+
+	h.poll(t)
+
+	if ids := h.torrentIds(t); len(ids) != 0 {
+		t.Fatalf("Expected confirmed removals to be applied, got %v", ids)
+	}
+}
+
+// Removes the torrents from the account and returns the ids left locally after a poll
+func (h *harness) pollWithout(t *testing.T, ids ...string) []string {
+	t.Helper()
+
+	for _, id := range ids {
+		h.provider.RemoveTorrent(id)
+	}
+
+	h.poll(t)
+
+	return h.torrentIds(t)
+}
+
+func TestPollHoldsRemovalsEmptyingLibrary(t *testing.T) {
+	setConfig(t, "removal_guard_max_count: 100\nremoval_guard_max_percent: 100\n")
+
+	h := newHarness(t)
+
+	h.addTorrent("T1", "/a.mkv")
+	h.addTorrent("T2", "/a.mkv")
+	h.poll(t)
+
+	// An empty listing looks like every torrent was removed
+	if ids := h.pollWithout(t, "T1", "T2"); len(ids) != 2 {
+		t.Fatalf("Expected every torrent to be kept, got %v", ids)
+	}
+}
+
+func TestPollHoldsRemovalsOverMaxCount(t *testing.T) {
+	setConfig(t, "removal_guard_max_count: 2\nremoval_guard_max_percent: 100\n")
+
+	h := newHarness(t)
+
+	for index := range 10 {
+		h.addTorrent(fmt.Sprintf("T%d", index), "/a.mkv")
+	}
+
+	h.poll(t)
+
+	if ids := h.pollWithout(t, "T0", "T1"); len(ids) != 8 {
+		t.Fatalf("Expected removals within the count to be applied, got %v", ids)
+	}
+
+	if ids := h.pollWithout(t, "T2", "T3", "T4"); len(ids) != 8 {
+		t.Fatalf("Expected removals over the count to be held, got %v", ids)
+	}
+}
+
+func TestPollHoldsRemovalsOverMaxPercent(t *testing.T) {
+	setConfig(t, "removal_guard_max_count: 100\nremoval_guard_max_percent: 10\n")
+
+	h := newHarness(t)
+
+	for index := range 20 {
+		h.addTorrent(fmt.Sprintf("T%d", index), "/a.mkv")
+	}
+
+	h.poll(t)
+
+	if ids := h.pollWithout(t, "T0", "T1"); len(ids) != 18 {
+		t.Fatalf("Expected removals within the percentage to be applied, got %v", ids)
+	}
+
+	if ids := h.pollWithout(t, "T2", "T3"); len(ids) != 18 {
+		t.Fatalf("Expected removals over the percentage to be held, got %v", ids)
+	}
+}
+
+// Emptying a library is held whatever its size, an empty listing looks the same
+func TestPollHoldsRemovalOfLastTorrent(t *testing.T) {
+	setConfig(t, "removal_guard_max_percent: 100\n")
+
+	h := newHarness(t)
+
+	h.addTorrent("T1", "/a.mkv")
+	h.addTorrent("T2", "/a.mkv")
+	h.addTorrent("T3", "/a.mkv")
+	h.poll(t)
+
+	if ids := h.pollWithout(t, "T1", "T2"); !slices.Equal(ids, []string{"T3"}) {
+		t.Fatalf("Expected removals within the guard to be applied, got %v", ids)
+	}
+
+	if ids := h.pollWithout(t, "T3"); !slices.Equal(ids, []string{"T3"}) {
+		t.Fatalf("Expected the last torrent to be kept, got %v", ids)
+	}
+}
+
+func TestPollHoldsEveryRemovalWithZeroMaxCount(t *testing.T) {
+	setConfig(t, "removal_guard_max_count: 0\nremoval_guard_max_percent: 100\n")
+
+	h := newHarness(t)
+
+	h.addTorrent("T1", "/a.mkv")
+	h.addTorrent("T2", "/a.mkv")
+	h.addTorrent("T3", "/a.mkv")
+	h.poll(t)
+
+	if ids := h.pollWithout(t, "T1"); len(ids) != 3 {
+		t.Fatalf("Expected the removal to be held, got %v", ids)
+	}
+}
+
+func TestPollForgetsFilesMissingFromFileSystem(t *testing.T) {
+	h := newHarness(t)
+
+	h.addTorrent("T1", "/a.mkv", "/b.mkv")
+	h.poll(t)
+
+	node, err := h.lookup(t, "media_manager/T1/a.mkv")
+	if err != nil {
+		t.Fatalf("Failed to look up a.mkv: %v", err)
+	}
+
+	err = h.fileSystem.RemoveFile(node.Id)
+	if err != nil {
+		t.Fatalf("Failed to remove a.mkv: %v", err)
+	}
+
+	h.poll(t)
+
+	if _, err := h.mediaRepository.GetTorrentFileByFileId(node.Id); err == nil {
+		t.Errorf("Expected the torrent file of a.mkv to be removed")
+	}
+
+	if ids := h.torrentIds(t); !slices.Equal(ids, []string{"T1"}) {
+		t.Fatalf("Expected T1 to be kept with its other file, got %v", ids)
+	}
+}
+
+// Confirming held removals doesn't change the account, the poller still applies them on its next tick
+func TestPollerAppliesConfirmedRemovals(t *testing.T) {
+	h := newHarness(t)
+
+	for index := range 12 {
+		h.addTorrent(fmt.Sprintf("T%d", index), "/a.mkv")
+	}
+
+	accountPoller := poller.New(poller.NewApiDetector(h.provider), 10*time.Millisecond, func(ctx context.Context, hash [32]byte) error {
+		return h.actioner.Poll(ctx)
+	})
+	accountPoller.SetPending(h.actioner.HasPendingTorrents)
+
+	go accountPoller.Start()
+	t.Cleanup(accountPoller.Stop)
+
+	waitFor(t, "the torrents to be added", func() bool { return len(h.torrentIds(t)) == 12 })
+
+	for index := range 12 {
+		h.provider.RemoveTorrent(fmt.Sprintf("T%d", index))
+	}
+
+	waitFor(t, "the removals to be held", func() bool {
+		heldRemovals, err := h.mediaRepository.GetHeldRemovals(config.DefaultAccountName)
+		return err == nil && len(heldRemovals) == 12
+	})
+
+	_, err := h.mediaRepository.ConfirmHeldRemovals(config.DefaultAccountName, nil)
+	if err != nil {
+		t.Fatalf("Failed to confirm held removals: %v", err)
+	}
+
+	waitFor(t, "the confirmed removals to be applied", func() bool { return len(h.torrentIds(t)) == 0 })
+}
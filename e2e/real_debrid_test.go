@@ -0,0 +1,115 @@
+package e2e
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"debrid_drive/provider/real_debrid/fake_server"
+
+	api "github.com/sushydev/stream_mount_api"
+)
+
+// Adds, streams and removes a torrent through every endpoint of the Real-Debrid api
+func TestRealDebrid(t *testing.T) {
+	h := newRealDebridHarness(t)
+
+	h.addTorrent("T1", "/a.mkv", "/b.mkv")
+	h.poll(t)
+
+	if ids := h.torrentIds(t); !slices.Equal(ids, []string{"T1"}) {
+		t.Fatalf("Expected T1 to be added, got %v", ids)
+	}
+
+	node, err := h.lookup(t, "media_manager/T1/b.mkv")
+	if err != nil {
+		t.Fatalf("Failed to look up file: %v", err)
+	}
+
+	response, err := h.client.GetStreamUrl(context.Background(), &api.GetStreamUrlRequest{NodeId: node.Id})
+	if err != nil {
+		t.Fatalf("Failed to get stream url: %v", err)
+	}
+
+	if response.Url != "https://download.test/T1/b.mkv" {
+		t.Errorf("Unexpected stream url %s", response.Url)
+	}
+
+	h.remove(t, "media_manager/T1", "b.mkv")
+
+	if deleted := h.server.GetDeleted(); !slices.Equal(deleted, []string{"T1"}) {
+		t.Fatalf("Expected T1 to be deleted remotely, got %v", deleted)
+	}
+
+	for _, endpoint := range []string{fake_server.EndpointTorrents, fake_server.EndpointInfo, fake_server.EndpointUnrestrict, fake_server.EndpointDelete} {
+		if h.server.GetRequests(endpoint) == 0 {
+			t.Errorf("Expected requests to the %s endpoint", endpoint)
+		}
+	}
+}
+
+func TestPollRetriesServerErrors(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Waits for the retry delay")
+	}
+
+	h := newRealDebridHarness(t)
+
+	h.addTorrent("T1", "/a.mkv")
+	h.server.Fail(fake_server.EndpointTorrents, 503, 1)
+
+	h.poll(t)
+
+	if ids := h.torrentIds(t); !slices.Equal(ids, []string{"T1"}) {
+		t.Fatalf("Expected T1 to be added after a retry, got %v", ids)
+	}
+
+	if requests := h.server.GetRequests(fake_server.EndpointTorrents); requests != 2 {
+		t.Errorf("Expected 2 listing requests, got %d", requests)
+	}
+}
+
+// Dead links and hoster outages are both a 503, only a new link in the torrent info shows the link was dead
+func TestGetStreamUrlDoesNotRecordServiceUnavailable(t *testing.T) {
+	h := newRealDebridHarness(t)
+
+	h.addTorrent("T1", "/a.mkv")
+	h.poll(t)
+
+	node, err := h.lookup(t, "media_manager/T1/a.mkv")
+	if err != nil {
+		t.Fatalf("Failed to look up file: %v", err)
+	}
+
+	h.server.Fail(fake_server.EndpointUnrestrict, 503, 1)
+
+	_, err = h.client.GetStreamUrl(context.Background(), &api.GetStreamUrlRequest{NodeId: node.Id})
+	if err == nil {
+		t.Fatalf("Expected getting the stream url to fail while the torrent has the same link")
+	}
+
+	if failures := h.torrentFile(t, "media_manager/T1/a.mkv").GetLinkFailures(); failures != 0 {
+		t.Errorf("Expected an outage not to count as a link failure, got %d", failures)
+	}
+
+	// The torrent was downloaded again, so the link was dead
+	link := fake_server.Link("T1new")
+	h.server.SetUrl(link, "https://download.test/T1/new/a.mkv")
+	h.server.SetTorrent(fake_server.Torrent{ID: "T1", Filename: "T1", Bytes: 1000, Status: "downloaded", Added: "2024-01-01T00:00:00.000Z", Links: []string{link}}, []fake_server.TorrentFile{
+		{ID: 1, Path: "/a.mkv", Bytes: 1000, Selected: 1},
+	})
+	h.server.Fail(fake_server.EndpointUnrestrict, 503, 1)
+
+	response, err := h.client.GetStreamUrl(context.Background(), &api.GetStreamUrlRequest{NodeId: node.Id})
+	if err != nil {
+		t.Fatalf("Failed to get stream url: %v", err)
+	}
+
+	if response.Url != "https://download.test/T1/new/a.mkv" {
+		t.Errorf("Expected the url of the refreshed link, got %s", response.Url)
+	}
+
+	if stored := h.torrentFile(t, "media_manager/T1/a.mkv").GetLink(); stored != link {
+		t.Errorf("Expected the refreshed link to be stored, got %s", stored)
+	}
+}
@@ -0,0 +1,252 @@
+package e2e
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"syscall"
+	"testing"
+
+	api "github.com/sushydev/stream_mount_api"
+)
+
+// Links the file into the root of the file system under the given name, like a library symlinking into the mount
+func (h *harness) link(t *testing.T, path string, name string) *api.Node {
+	t.Helper()
+
+	target, err := h.lookup(t, path)
+	if err != nil {
+		t.Fatalf("Failed to look up %s: %v", path, err)
+	}
+
+	root, err := h.client.Root(context.Background(), &api.RootRequest{})
+	if err != nil {
+		t.Fatalf("Failed to get root: %v", err)
+	}
+
+	response, err := h.client.Link(context.Background(), &api.LinkRequest{NodeId: target.Id, ParentNodeId: root.Root.Id, Name: name})
+	if err != nil {
+		t.Fatalf("Failed to link %s: %v", path, err)
+	}
+
+	return response.Node
+}
+
+func TestPollRemovesSymlinksOfRemovedTorrents(t *testing.T) {
+	setConfig(t, "removal_guard_max_percent: 50\n")
+
+	h := newHarness(t)
+
+	h.addTorrent("T1", "/a.mkv")
+	h.addTorrent("T2", "/a.mkv")
+	h.poll(t)
+
+	h.link(t, "media_manager/T1/a.mkv", "T1.mkv")
+	h.link(t, "media_manager/T2/a.mkv", "T2.mkv")
+
+	h.pollWithout(t, "T1")
+
+	if _, err := h.lookup(t, "T1.mkv"); err == nil {
+		t.Errorf("Expected the symlink to T1 to be removed")
+	}
+
+	if _, err := h.lookup(t, "T2.mkv"); err != nil {
+		t.Errorf("Expected the symlink to T2 to be kept: %v", err)
+	}
+}
+
+func TestRemoveQuarantinesSymlinks(t *testing.T) {
+	setConfig(t, "symlink_quarantine_directory: \"quarantine\"\n")
+
+	h := newHarness(t)
+
+	h.addTorrent("T1", "/a.mkv")
+	h.poll(t)
+
+	link := h.link(t, "media_manager/T1/a.mkv", "T1.mkv")
+
+	h.remove(t, "media_manager/T1", "a.mkv")
+
+	if _, err := h.lookup(t, "T1.mkv"); err == nil {
+		t.Errorf("Expected the symlink to be moved")
+	}
+
+	if _, err := h.lookup(t, fmt.Sprintf("quarantine/%d_T1.mkv", link.Id)); err != nil {
+		t.Errorf("Expected the symlink in the quarantine directory: %v", err)
+	}
+}
+
+func TestRemoveRemovesSymlinkChains(t *testing.T) {
+	h := newHarness(t)
+
+	h.addTorrent("T1", "/a.mkv")
+	h.poll(t)
+
+	h.link(t, "media_manager/T1/a.mkv", "first.mkv")
+	h.link(t, "first.mkv", "second.mkv")
+
+	h.remove(t, "media_manager/T1", "a.mkv")
+
+	for _, name := range []string{"first.mkv", "second.mkv"} {
+		if _, err := h.lookup(t, name); err == nil {
+			t.Errorf("Expected %s to be removed", name)
+		}
+	}
+}
+
+func TestRemoveRemovesSymlinksMadeBeforeRecording(t *testing.T) {
+	h := newHarness(t)
+
+	h.addTorrent("T1", "/a.mkv")
+	h.poll(t)
+
+	target, err := h.lookup(t, "media_manager/T1/a.mkv")
+	if err != nil {
+		t.Fatalf("Failed to look up a.mkv: %v", err)
+	}
+
+	root, err := h.fileSystem.Root()
+	if err != nil {
+		t.Fatalf("Failed to get root: %v", err)
+	}
+
+	// Straight on the file system, so the link is not recorded until the file system is indexed
+	err = h.fileSystem.Link(target.Id, "T1.mkv", root.GetId())
+	if err != nil {
+		t.Fatalf("Failed to link a.mkv: %v", err)
+	}
+
+	err = h.mediaService.IndexSymlinks()
+	if err != nil {
+		t.Fatalf("Failed to index symlinks: %v", err)
+	}
+
+	h.remove(t, "media_manager/T1", "a.mkv")
+
+	if _, err := h.lookup(t, "T1.mkv"); err == nil {
+		t.Errorf("Expected the symlink to be removed")
+	}
+}
+
+// Stream url of the node at the path
+func (h *harness) streamUrl(t *testing.T, path string) (string, error) {
+	t.Helper()
+
+	node, err := h.lookup(t, path)
+	if err != nil {
+		t.Fatalf("Failed to look up %s: %v", path, err)
+	}
+
+	response, err := h.client.GetStreamUrl(context.Background(), &api.GetStreamUrlRequest{NodeId: node.Id})
+	if err != nil {
+		return "", err
+	}
+
+	return response.Url, nil
+}
+
+func TestGetStreamUrlThroughSymlinkAfterRename(t *testing.T) {
+	h := newHarness(t)
+
+	h.addTorrent("T1", "/a.mkv")
+	h.poll(t)
+
+	h.link(t, "media_manager/T1/a.mkv", "T1.mkv")
+
+	directory, err := h.lookup(t, "media_manager/T1")
+	if err != nil {
+		t.Fatalf("Failed to look up directory: %v", err)
+	}
+
+	parent, err := h.lookup(t, "media_manager")
+	if err != nil {
+		t.Fatalf("Failed to look up parent: %v", err)
+	}
+
+	// Renaming a directory leaves the paths stored below it stale
+	err = h.fileSystem.Rename(directory.Id, "renamed", parent.Id)
+	if err != nil {
+		t.Fatalf("Failed to rename directory: %v", err)
+	}
+
+	url, err := h.streamUrl(t, "T1.mkv")
+	if err != nil {
+		t.Fatalf("Failed to get stream url: %v", err)
+	}
+
+	if url != "https://download.test/T1/a.mkv" {
+		t.Errorf("Unexpected stream url %s", url)
+	}
+}
+
+func TestGetStreamUrlThroughSymlinkChain(t *testing.T) {
+	h := newHarness(t)
+
+	h.addTorrent("T1", "/a.mkv")
+	h.poll(t)
+
+	h.link(t, "media_manager/T1/a.mkv", "first.mkv")
+	h.link(t, "first.mkv", "second.mkv")
+
+	url, err := h.streamUrl(t, "second.mkv")
+	if err != nil {
+		t.Fatalf("Failed to get stream url: %v", err)
+	}
+
+	if url != "https://download.test/T1/a.mkv" {
+		t.Errorf("Unexpected stream url %s", url)
+	}
+}
+
+// Links made straight on the file system are not recorded and are followed by the path ReadLink returns
+func TestGetStreamUrlThroughUnrecordedSymlink(t *testing.T) {
+	h := newHarness(t)
+
+	h.addTorrent("T1", "/a.mkv")
+	h.poll(t)
+
+	target, err := h.lookup(t, "media_manager/T1/a.mkv")
+	if err != nil {
+		t.Fatalf("Failed to look up a.mkv: %v", err)
+	}
+
+	root, err := h.fileSystem.Root()
+	if err != nil {
+		t.Fatalf("Failed to get root: %v", err)
+	}
+
+	err = h.fileSystem.Link(target.Id, "T1.mkv", root.GetId())
+	if err != nil {
+		t.Fatalf("Failed to link a.mkv: %v", err)
+	}
+
+	url, err := h.streamUrl(t, "T1.mkv")
+	if err != nil {
+		t.Fatalf("Failed to get stream url: %v", err)
+	}
+
+	if url != "https://download.test/T1/a.mkv" {
+		t.Errorf("Unexpected stream url %s", url)
+	}
+}
+
+func TestGetStreamUrlThroughSymlinkCycle(t *testing.T) {
+	h := newHarness(t)
+
+	h.addTorrent("T1", "/a.mkv")
+	h.poll(t)
+
+	first := h.link(t, "media_manager/T1/a.mkv", "first.mkv")
+	second := h.link(t, "first.mkv", "second.mkv")
+
+	// Links can only be made to existing nodes, so the cycle is closed in the recorded targets
+	err := h.mediaRepository.SetSymlink(first.Id, second.Id)
+	if err != nil {
+		t.Fatalf("Failed to close the cycle: %v", err)
+	}
+
+	_, err = h.streamUrl(t, "second.mkv")
+	if err == nil || !strings.Contains(err.Error(), syscall.ELOOP.Error()) {
+		t.Errorf("Expected a symlink loop error, got %v", err)
+	}
+}
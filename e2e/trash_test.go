@@ -0,0 +1,311 @@
+package e2e
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+
+	media_repository "debrid_drive/media/repository"
+
+	api "github.com/sushydev/stream_mount_api"
+)
+
+const trashConfig = "trash_retention_hours: 24\n"
+
+func (h *harness) trashEntries(t *testing.T) []*media_repository.TrashEntry {
+	t.Helper()
+
+	trashEntries, err := h.mediaRepository.GetTrashEntries()
+	if err != nil {
+		t.Fatalf("Failed to get trash entries: %v", err)
+	}
+
+	return trashEntries
+}
+
+func (h *harness) checkTrash(t *testing.T) {
+	t.Helper()
+
+	err := h.mediaService.CheckTrash(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to check trash: %v", err)
+	}
+}
+
+// Makes every trash entry older than the retention
+func (h *harness) expireTrash(t *testing.T) {
+	t.Helper()
+
+	_, err := h.database.GetDatabase().Exec("UPDATE trash_entries SET trashed_at = 0")
+	if err != nil {
+		t.Fatalf("Failed to update trash entries: %v", err)
+	}
+}
+
+func TestRemoveMovesTorrentToTrash(t *testing.T) {
+	setConfig(t, trashConfig)
+
+	h := newHarness(t)
+
+	h.addTorrent("T1", "/a.mkv", "/b.mkv")
+	h.poll(t)
+
+	h.remove(t, "media_manager/T1", "a.mkv")
+
+	if deleted := h.provider.GetDeleted(); len(deleted) != 0 {
+		t.Fatalf("Expected nothing to be deleted remotely, got %v", deleted)
+	}
+
+	if _, err := h.lookup(t, "media_manager/T1"); err == nil {
+		t.Errorf("Expected the torrent directory to be gone")
+	}
+
+	trashEntries := h.trashEntries(t)
+	if len(trashEntries) != 2 {
+		t.Fatalf("Expected both files in the trash, got %d entries", len(trashEntries))
+	}
+
+	for _, trashEntry := range trashEntries {
+		path := fmt.Sprintf(".trash/%d/%s", trashEntry.GetIdentifier(), trashEntry.GetOriginalName())
+
+		if _, err := h.lookup(t, path); err != nil {
+			t.Errorf("Expected %s in the trash: %v", trashEntry.GetOriginalPath(), err)
+		}
+	}
+
+	h.checkTrash(t)
+
+	if deleted := h.provider.GetDeleted(); len(deleted) != 0 {
+		t.Fatalf("Expected nothing to be deleted within the retention, got %v", deleted)
+	}
+
+	h.expireTrash(t)
+	h.checkTrash(t)
+
+	if deleted := h.provider.GetDeleted(); !slices.Equal(deleted, []string{"T1"}) {
+		t.Fatalf("Expected T1 to be deleted remotely after the retention, got %v", deleted)
+	}
+
+	if ids := h.torrentIds(t); len(ids) != 0 {
+		t.Errorf("Expected no torrents, got %v", ids)
+	}
+
+	if trashEntries := h.trashEntries(t); len(trashEntries) != 0 {
+		t.Errorf("Expected the trash to be empty, got %d entries", len(trashEntries))
+	}
+}
+
+func TestMoveToTrashKeepsFilesWhenASiblingFails(t *testing.T) {
+	setConfig(t, trashConfig)
+
+	h := newHarness(t)
+
+	h.addTorrent("T1", "/a.mkv", "/b.mkv")
+	h.poll(t)
+
+	// The second file of the batch can't be moved
+	sibling, err := h.lookup(t, "media_manager/T1/b.mkv")
+	if err != nil {
+		t.Fatalf("Failed to look up b.mkv: %v", err)
+	}
+
+	err = h.fileSystem.RemoveFile(sibling.Id)
+	if err != nil {
+		t.Fatalf("Failed to remove b.mkv: %v", err)
+	}
+
+	directory, err := h.lookup(t, "media_manager/T1")
+	if err != nil {
+		t.Fatalf("Failed to look up directory: %v", err)
+	}
+
+	_, err = h.client.Remove(context.Background(), &api.RemoveRequest{ParentNodeId: directory.Id, Name: "a.mkv"})
+	if err == nil {
+		t.Fatalf("Expected the removal to fail")
+	}
+
+	if _, err := h.lookup(t, "media_manager/T1/a.mkv"); err != nil {
+		t.Errorf("Expected a.mkv to stay in place: %v", err)
+	}
+
+	if trashEntries := h.trashEntries(t); len(trashEntries) != 0 {
+		t.Errorf("Expected the trash to be empty, got %d entries", len(trashEntries))
+	}
+
+	if _, err := h.lookup(t, ".trash/1"); err == nil {
+		t.Errorf("Expected no file in the trash")
+	}
+}
+
+func TestRestoreFromTrash(t *testing.T) {
+	setConfig(t, trashConfig)
+
+	h := newHarness(t)
+
+	h.addTorrent("T1", "/a.mkv", "/b.mkv")
+	h.poll(t)
+
+	h.remove(t, "media_manager/T1", "a.mkv")
+
+	_, err := h.mediaRepository.RequestTrashRestores(nil)
+	if err != nil {
+		t.Fatalf("Failed to request restores: %v", err)
+	}
+
+	h.checkTrash(t)
+
+	for _, path := range []string{"media_manager/T1/a.mkv", "media_manager/T1/b.mkv"} {
+		if _, err := h.lookup(t, path); err != nil {
+			t.Errorf("Expected %s to be restored: %v", path, err)
+		}
+	}
+
+	if trashEntries := h.trashEntries(t); len(trashEntries) != 0 {
+		t.Errorf("Expected the trash to be empty, got %d entries", len(trashEntries))
+	}
+
+	h.expireTrash(t)
+	h.checkTrash(t)
+
+	if deleted := h.provider.GetDeleted(); len(deleted) != 0 {
+		t.Fatalf("Expected nothing to be deleted remotely, got %v", deleted)
+	}
+}
+
+func TestMovingFileOutOfTrashKeepsIt(t *testing.T) {
+	setConfig(t, trashConfig)
+
+	h := newHarness(t)
+
+	h.addTorrent("T1", "/a.mkv", "/b.mkv")
+	h.poll(t)
+
+	h.remove(t, "media_manager/T1", "a.mkv")
+
+	var trashEntry *media_repository.TrashEntry
+	for _, entry := range h.trashEntries(t) {
+		if entry.GetOriginalName() == "a.mkv" {
+			trashEntry = entry
+		}
+	}
+
+	entryDirectory, err := h.lookup(t, fmt.Sprintf(".trash/%d", trashEntry.GetIdentifier()))
+	if err != nil {
+		t.Fatalf("Failed to look up trash entry: %v", err)
+	}
+
+	managerDirectory, err := h.lookup(t, "media_manager")
+	if err != nil {
+		t.Fatalf("Failed to look up media manager directory: %v", err)
+	}
+
+	_, err = h.client.Rename(context.Background(), &api.RenameRequest{
+		OldParentNodeId: entryDirectory.Id,
+		OldName:         "a.mkv",
+		NewParentNodeId: managerDirectory.Id,
+		NewName:         "a.mkv",
+	})
+	if err != nil {
+		t.Fatalf("Failed to move file out of the trash: %v", err)
+	}
+
+	h.checkTrash(t)
+
+	if trashEntries := h.trashEntries(t); len(trashEntries) != 1 {
+		t.Fatalf("Expected only b.mkv in the trash, got %d entries", len(trashEntries))
+	}
+
+	// The torrent is still in use, so only b.mkv goes
+	h.expireTrash(t)
+	h.checkTrash(t)
+
+	if deleted := h.provider.GetDeleted(); len(deleted) != 0 {
+		t.Fatalf("Expected nothing to be deleted remotely, got %v", deleted)
+	}
+
+	if _, err := h.lookup(t, "media_manager/a.mkv"); err != nil {
+		t.Errorf("Expected a.mkv to be kept: %v", err)
+	}
+
+	if trashEntries := h.trashEntries(t); len(trashEntries) != 0 {
+		t.Errorf("Expected the trash to be empty, got %d entries", len(trashEntries))
+	}
+
+	if _, err := h.lookup(t, ".trash"); err != nil {
+		t.Errorf("Expected the trash directory to be kept: %v", err)
+	}
+}
+
+func TestRemoveFromTrashDeletesTorrent(t *testing.T) {
+	setConfig(t, trashConfig)
+
+	h := newHarness(t)
+
+	h.addTorrent("T1", "/a.mkv")
+	h.poll(t)
+
+	h.remove(t, "media_manager/T1", "a.mkv")
+
+	trashEntries := h.trashEntries(t)
+	if len(trashEntries) != 1 {
+		t.Fatalf("Expected a.mkv in the trash, got %d entries", len(trashEntries))
+	}
+
+	h.remove(t, fmt.Sprintf(".trash/%d", trashEntries[0].GetIdentifier()), "a.mkv")
+
+	if deleted := h.provider.GetDeleted(); !slices.Equal(deleted, []string{"T1"}) {
+		t.Fatalf("Expected T1 to be deleted remotely, got %v", deleted)
+	}
+}
+
+func TestRemoveWithoutTrashDeletesTorrent(t *testing.T) {
+	h := newHarness(t)
+
+	h.addTorrent("T1", "/a.mkv")
+	h.poll(t)
+
+	h.remove(t, "media_manager/T1", "a.mkv")
+
+	if deleted := h.provider.GetDeleted(); !slices.Equal(deleted, []string{"T1"}) {
+		t.Fatalf("Expected T1 to be deleted remotely, got %v", deleted)
+	}
+
+	if trashEntries := h.trashEntries(t); len(trashEntries) != 0 {
+		t.Errorf("Expected the trash to be empty, got %d entries", len(trashEntries))
+	}
+}
+
+func TestTrashWithFilePolicy(t *testing.T) {
+	setConfig(t, trashConfig+"removal_policy: \"file\"\n")
+
+	h := newHarness(t)
+
+	h.addTorrent("T1", "/e01.mkv", "/e02.mkv")
+	h.poll(t)
+
+	h.remove(t, "media_manager/T1", "e01.mkv")
+
+	if trashEntries := h.trashEntries(t); len(trashEntries) != 1 {
+		t.Fatalf("Expected only e01.mkv in the trash, got %d entries", len(trashEntries))
+	}
+
+	if _, err := h.lookup(t, "media_manager/T1/e02.mkv"); err != nil {
+		t.Errorf("Expected e02.mkv to be kept: %v", err)
+	}
+
+	h.expireTrash(t)
+	h.checkTrash(t)
+
+	if deleted := h.provider.GetDeleted(); len(deleted) != 0 {
+		t.Fatalf("Expected nothing to be deleted remotely while e02.mkv is in use, got %v", deleted)
+	}
+
+	h.remove(t, "media_manager/T1", "e02.mkv")
+	h.expireTrash(t)
+	h.checkTrash(t)
+
+	if deleted := h.provider.GetDeleted(); !slices.Equal(deleted, []string{"T1"}) {
+		t.Fatalf("Expected T1 to be deleted remotely with its last file, got %v", deleted)
+	}
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+
+	"debrid_drive/config"
+	api "github.com/sushydev/stream_mount_api"
+
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	grpc_health_v1 "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Metadata key of the shared secret, sent as "Bearer <token>"
+const authorizationHeader = "authorization"
+
+// Server credentials from the configured certificate, with client certificates required when a client CA is set
+// Nil when TLS is not configured
+func transportCredentials() (credentials.TransportCredentials, error) {
+	certFile, keyFile := config.GetTlsFiles()
+	if certFile == "" {
+		return nil, nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load TLS certificate: %w", err)
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if caFile := config.GetTlsClientCaFile(); caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read TLS client CA: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in TLS client CA %s", caFile)
+		}
+
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return credentials.NewTLS(tlsConfig), nil
+}
+
+// Methods that change the file system, refused for read only clients
+var mutatingMethods = map[string]bool{
+	api.FileSystemService_Create_FullMethodName:    true,
+	api.FileSystemService_Remove_FullMethodName:    true,
+	api.FileSystemService_Rename_FullMethodName:    true,
+	api.FileSystemService_Mkdir_FullMethodName:     true,
+	api.FileSystemService_Link_FullMethodName:      true,
+	api.FileSystemService_WriteFile_FullMethodName: true,
+}
+
+// The client a call was authorized as
+type client struct {
+	// Empty for the shared auth token and when no token is required
+	name     string
+	readOnly bool
+}
+
+type clientKey struct{}
+
+func clientOf(ctx context.Context) client {
+	value, _ := ctx.Value(clientKey{}).(client)
+
+	return value
+}
+
+func (server *FileSystemServer) authorizeUnary(ctx context.Context, request any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	client, err := authorize(ctx, info.FullMethod)
+	if err != nil {
+		server.logRejection(ctx, info.FullMethod)
+		return nil, err
+	}
+
+	if client.readOnly && mutatingMethods[info.FullMethod] {
+		return nil, api.ToResponseError(syscall.EROFS, syscall.EROFS)
+	}
+
+	return handler(context.WithValue(ctx, clientKey{}, client), request)
+}
+
+func (server *FileSystemServer) authorizeStream(service any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	_, err := authorize(stream.Context(), info.FullMethod)
+	if err != nil {
+		server.logRejection(stream.Context(), info.FullMethod)
+		return err
+	}
+
+	return handler(service, stream)
+}
+
+// Rejected calls never reach logRequest, a client with a stale or guessed token shows up here
+func (server *FileSystemServer) logRejection(ctx context.Context, method string) {
+	address := "unknown"
+	if client, ok := peer.FromContext(ctx); ok && client.Addr != nil {
+		address = client.Addr.String()
+	}
+
+	server.logger.Warn("Rejected request with a missing or invalid token", "method", method, "peer", address)
+}
+
+// Tokens are read on every call so they can be rotated without a restart
+// Health checks are exempt, probes can't be expected to know a token
+func authorize(ctx context.Context, method string) (client, error) {
+	readOnly := config.GetReadOnly()
+
+	token := config.GetAuthToken()
+	clients := config.GetClients()
+
+	if token == "" && len(clients) == 0 {
+		return client{readOnly: readOnly}, nil
+	}
+
+	if strings.HasPrefix(method, "/"+grpc_health_v1.Health_ServiceDesc.ServiceName+"/") {
+		return client{readOnly: readOnly}, nil
+	}
+
+	for _, value := range metadata.ValueFromIncomingContext(ctx, authorizationHeader) {
+		bearer, ok := strings.CutPrefix(value, "Bearer ")
+		if !ok {
+			continue
+		}
+
+		if token != "" && tokenMatches(bearer, token) {
+			return client{readOnly: readOnly}, nil
+		}
+
+		for _, configured := range clients {
+			if tokenMatches(bearer, configured.Token) {
+				return client{name: configured.Name, readOnly: readOnly || configured.ReadOnly}, nil
+			}
+		}
+	}
+
+	return client{}, status.Error(codes.Unauthenticated, "Missing or invalid token")
+}
+
+func tokenMatches(bearer string, token string) bool {
+	return subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) == 1
+}
@@ -1,56 +1,112 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
 
 	"debrid_drive/config"
 	"debrid_drive/logger"
+	"debrid_drive/metrics"
 	api "github.com/sushydev/stream_mount_api"
 
 	media_service "debrid_drive/media/service"
 	filesystem_service "debrid_drive/filesystem/service"
 
-	real_debrid "github.com/sushydev/real_debrid_go"
 	"github.com/sushydev/vfs_go"
 	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
 )
 
+// Metadata key clients can set to correlate their logs with ours
+const requestIdHeader = "x-request-id"
+
+// Request ids for calls without one
+var requestCounter atomic.Uint64
+
 type FileSystemServer struct {
 	server *grpc.Server
 	logger *logger.Logger
+	tls    bool
 }
 
-func NewFileSystemServer(client *real_debrid.Client, fileSystem *filesystem.FileSystem, mediaService *media_service.MediaService) *FileSystemServer {
+func NewFileSystemServer(fileSystem *filesystem.FileSystem, mediaService *media_service.MediaService) *FileSystemServer {
 	logger, err := logger.NewLogger("File System Server")
 	if err != nil {
 		panic(err)
 	}
 
-	server := grpc.NewServer()
+	fileSystemServer := &FileSystemServer{
+		logger: logger,
+	}
 
-	fileSystemService := filesystem_service.NewFileSystemService(client, fileSystem, mediaService)
+	options := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(metrics.UnaryServerInterceptor, fileSystemServer.authorizeUnary, fileSystemServer.logRequest),
+		grpc.ChainStreamInterceptor(fileSystemServer.authorizeStream),
+	}
 
-	api.RegisterFileSystemServiceServer(server, fileSystemService)
+	creds, err := transportCredentials()
+	if err != nil {
+		panic(err)
+	}
 
-	fileSystemServer := &FileSystemServer{
-		server: server,
-		logger: logger,
+	if creds != nil {
+		options = append(options, grpc.Creds(creds))
+		fileSystemServer.tls = true
 	}
 
+	server := grpc.NewServer(options...)
+
+	fileSystemService := filesystem_service.NewFileSystemService(fileSystem, mediaService)
+
+	api.RegisterFileSystemServiceServer(server, fileSystemService)
+
+	fileSystemServer.server = server
+
 	return fileSystemServer
 }
 
+func (server *FileSystemServer) GetServer() *grpc.Server {
+	return server.server
+}
+
 func (server *FileSystemServer) Serve(ready chan struct{}) {
-	port := config.GetPort()
+	network, address := config.GetListenAddress()
+
+	if network == "unix" {
+		err := removeStaleSocket(address)
+		if err != nil {
+			server.error("failed to remove stale socket", err)
+			return
+		}
+	}
 
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	listener, err := net.Listen(network, address)
 	if err != nil {
 		server.error("failed to listen", err)
 		return
 	}
 
-	server.info(fmt.Sprintf("Listening on port %d", port))
+	if network == "unix" {
+		// Owner and group only, access to the socket is access to the library
+		err = os.Chmod(address, 0660)
+		if err != nil {
+			server.error("failed to restrict socket permissions", err)
+			listener.Close()
+			return
+		}
+	}
+
+	server.info(fmt.Sprintf("Listening on %s %s", network, address))
+
+	if network == "tcp" && !server.tls && config.GetAuthToken() == "" && len(config.GetClients()) == 0 {
+		server.logger.Warn("Listening without TLS or an auth token, any client that can reach the port has full access")
+	}
+
 	close(ready)
 
 	err = server.server.Serve(listener)
@@ -59,6 +115,76 @@ func (server *FileSystemServer) Serve(ready chan struct{}) {
 	}
 }
 
+// A socket left behind by a crash would fail the listen
+// Anything else at the path is left alone, it is likely a typo in the bind address
+func removeStaleSocket(address string) error {
+	info, err := os.Lstat(address)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", address)
+	}
+
+	return os.Remove(address)
+}
+
+// Waits for in flight calls until the timeout, after which they are cancelled
+func (server *FileSystemServer) Stop(timeout time.Duration) {
+	stopped := make(chan struct{})
+
+	go func() {
+		server.server.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(timeout):
+		server.info("Graceful stop timed out, forcing stop")
+		server.server.Stop()
+	}
+}
+
+// Logs every call at debug and failed calls at warn, tagged with the request id of the client or a generated one
+func (server *FileSystemServer) logRequest(ctx context.Context, request any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	requestId := ""
+	if values := metadata.ValueFromIncomingContext(ctx, requestIdHeader); len(values) > 0 {
+		requestId = values[0]
+	}
+
+	if requestId == "" {
+		requestId = strconv.FormatUint(requestCounter.Add(1), 10)
+	}
+
+	requestLogger := server.logger.With(logger.RequestId, requestId, "method", info.FullMethod)
+
+	if client := clientOf(ctx); client.name != "" {
+		requestLogger = requestLogger.With("client", client.name)
+	}
+
+	if nodeRequest, ok := request.(interface{ GetNodeId() uint64 }); ok {
+		requestLogger = requestLogger.With(logger.NodeId, nodeRequest.GetNodeId())
+	}
+
+	start := time.Now()
+	response, err := handler(ctx, request)
+	duration := time.Since(start)
+
+	if err != nil {
+		requestLogger.Warn("Request failed", "duration", duration, "error", err)
+	} else {
+		requestLogger.Debug("Request", "duration", duration)
+	}
+
+	return response, err
+}
+
 func (server *FileSystemServer) info(message string) {
 	server.logger.Info(message)
 }
@@ -9,11 +9,9 @@ import (
 
 	api "github.com/sushydev/stream_mount_api"
 
+	"debrid_drive/logger"
 	media_service "debrid_drive/media/service"
 
-	real_debrid "github.com/sushydev/real_debrid_go"
-	real_debrid_api "github.com/sushydev/real_debrid_go/api"
-
 	"github.com/sushydev/vfs_go"
 	filesystem_interfaces "github.com/sushydev/vfs_go/interfaces"
 	filesystem_service "github.com/sushydev/vfs_go/service"
@@ -24,16 +22,21 @@ var _ api.FileSystemServiceServer = &FileSystemService{}
 type FileSystemService struct {
 	api.UnimplementedFileSystemServiceServer
 
-	client       *real_debrid.Client
 	fileSystem   *filesystem.FileSystem
 	mediaManager *media_service.MediaService
+	logger       *logger.Logger
 }
 
-func NewFileSystemService(client *real_debrid.Client, fileSystem *filesystem.FileSystem, mediaService *media_service.MediaService) *FileSystemService {
+func NewFileSystemService(fileSystem *filesystem.FileSystem, mediaService *media_service.MediaService) *FileSystemService {
+	logger, err := logger.NewLogger("File System Service")
+	if err != nil {
+		panic(err)
+	}
+
 	return &FileSystemService{
-		client:       client,
 		fileSystem:   fileSystem,
 		mediaManager: mediaService,
+		logger:       logger,
 	}
 }
 
@@ -46,8 +49,12 @@ func (service *FileSystemService) isStreamable(node filesystem_interfaces.Node)
 	case fs.ModeDir:
 		return false
 	case fs.ModeSymlink:
-		// TODO: Get source node and check if it's streamable
-		return false
+		target, err := service.mediaManager.ResolveSymlink(node)
+		if err != nil {
+			return false
+		}
+
+		return service.isStreamable(target)
 	case fs.FileMode(0):
 		torrentFile, err := service.mediaManager.GetTorrentFileByFile(node)
 		if err != nil && err != sql.ErrNoRows {
@@ -223,23 +230,14 @@ func (service *FileSystemService) Remove(ctx context.Context, req *api.RemoveReq
 			}
 
 			if torrent != nil {
-				transaction, err := service.mediaManager.NewTransaction()
-				if err != nil {
-					fmt.Printf("Failed to create transaction: %v\n", err)
-					return nil, err
-				}
-
-				err = service.mediaManager.DeleteTorrent(transaction, torrent, true)
+				err = service.mediaManager.RemoveFile(torrent, torrentFile)
 				if err != nil {
-					fmt.Printf("Failed to delete torrent: %v\n", err)
+					fmt.Printf("Failed to remove torrent file: %v\n", err)
 					return nil, err
 				}
 
-				err = transaction.Commit()
-				if err != nil {
-					fmt.Printf("Failed to commit transaction: %v\n", err)
-					return nil, err
-				}
+				// Removing the torrent file already removed the file and its symlinks
+				return &api.RemoveResponse{}, nil
 			}
 		}
 
@@ -249,6 +247,13 @@ func (service *FileSystemService) Remove(ctx context.Context, req *api.RemoveReq
 			return nil, err
 		}
 
+		if file.GetMode() == fs.ModeSymlink {
+			err = service.mediaManager.ForgetSymlink(file)
+			if err != nil {
+				service.logger.Error("Failed to forget symlink", err, logger.NodeId, file.GetId())
+			}
+		}
+
 	case fs.ModeDir:
 		directory, err := service.fileSystem.Open(node.GetId())
 		if err != nil {
@@ -293,7 +298,7 @@ func (service *FileSystemService) Rename(ctx context.Context, req *api.RenameReq
 	}
 
 	if service.isStreamable(node) {
-		fmt.Printf("TORRENT RENAME")
+		service.logger.Debug("Torrent rename", logger.NodeId, node.GetId(), "name", req.NewName, "parent_node_id", req.NewParentNodeId)
 
 		err := service.fileSystem.Rename(node.GetId(), req.NewName, req.NewParentNodeId)
 		if err != nil {
@@ -317,7 +322,7 @@ func (service *FileSystemService) Rename(ctx context.Context, req *api.RenameReq
 			Node: service.getApiNode(updatedDirectory),
 		}, nil
 	} else {
-		fmt.Printf("REGULAR RENAME", req.OldParentNodeId, req.OldName, req.NewName, req.NewParentNodeId)
+		service.logger.Debug("Regular rename", logger.NodeId, node.GetId(), "name", req.NewName, "parent_node_id", req.NewParentNodeId)
 
 		err := service.fileSystem.Rename(node.GetId(), req.NewName, req.NewParentNodeId)
 		if err != nil {
@@ -407,6 +412,12 @@ func (service *FileSystemService) Link(ctx context.Context, req *api.LinkRequest
 		return nil, api.ToResponseError(syscall.ENOENT, fmt.Errorf("Linked node is nil"))
 	}
 
+	// The link is made either way, an unrecorded link is recorded on the next start
+	err = service.mediaManager.AddSymlink(linkedNode, req.NodeId)
+	if err != nil {
+		service.logger.Error("Failed to record symlink", err, logger.NodeId, linkedNode.GetId())
+	}
+
 	return &api.LinkResponse{
 		Node: service.getApiNode(linkedNode),
 	}, nil
@@ -525,6 +536,11 @@ func (service *FileSystemService) GetFileInfo(ctx context.Context, req *api.GetF
 		return nil, api.ToResponseError(syscall.ENOENT, fmt.Errorf("File is nil"))
 	}
 
+	file, err = service.mediaManager.ResolveSymlink(file)
+	if err != nil {
+		return nil, api.ToResponseError(err, err)
+	}
+
 	if !service.isStreamable(file) {
 		return nil, nil
 	}
@@ -562,6 +578,11 @@ func (service *FileSystemService) GetStreamUrl(ctx context.Context, req *api.Get
 		return nil, api.ToResponseError(syscall.ENOENT, fmt.Errorf("File is nil"))
 	}
 
+	file, err = service.mediaManager.ResolveSymlink(file)
+	if err != nil {
+		return nil, api.ToResponseError(err, err)
+	}
+
 	if !service.isStreamable(file) {
 		return nil, nil
 	}
@@ -579,13 +600,13 @@ func (service *FileSystemService) GetStreamUrl(ctx context.Context, req *api.Get
 		return nil, api.ToResponseError(syscall.ENOENT, fmt.Errorf("Torrent file is nil"))
 	}
 
-	unrestrictResponse, err := real_debrid_api.UnrestrictLink(service.client, torrentFile.GetLink())
+	streamUrl, err := service.mediaManager.GetStreamUrl(torrentFile)
 	if err != nil {
 		return nil, api.ToResponseError(err, err)
 	}
 
 	response := &api.GetStreamUrlResponse{
-		Url: unrestrictResponse.Download,
+		Url: streamUrl,
 	}
 
 	return response, nil
@@ -0,0 +1,137 @@
+package symlink
+
+import (
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"strings"
+	"syscall"
+
+	"github.com/sushydev/vfs_go"
+	"github.com/sushydev/vfs_go/interfaces"
+	"github.com/sushydev/vfs_go/service"
+)
+
+// Same limit the linux kernel uses when following symlinks
+const maxDepth = 40
+
+// Targets of symlinks by node id, recorded by the media database when links are made
+type Index interface {
+	GetSymlinkTarget(sourceNodeIdentifier uint64) (uint64, error)
+}
+
+// Follows symlinks by their recorded target, or by the path ReadLink returns for links that are not recorded
+// The path is the one stored for the target, which goes stale when a directory above it is renamed, the recorded id does not
+type Resolver struct {
+	fileSystem *filesystem.FileSystem
+	index      Index
+}
+
+func NewResolver(fileSystem *filesystem.FileSystem, index Index) *Resolver {
+	return &Resolver{
+		fileSystem: fileSystem,
+		index:      index,
+	}
+}
+
+// Node the symlink points at, which can be a symlink itself
+func (resolver *Resolver) Target(link interfaces.Node) (interfaces.Node, error) {
+	targetId, err := resolver.index.GetSymlinkTarget(link.GetId())
+	if err == nil {
+		return resolver.fileSystem.Open(targetId)
+	}
+
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	path, err := resolver.fileSystem.ReadLink(link.GetId())
+	if err != nil {
+		return nil, err
+	}
+
+	return Lookup(resolver.fileSystem, path)
+}
+
+// Follows a chain of symlinks until it reaches a node that is not a symlink
+// Non symlink nodes are returned as is
+func (resolver *Resolver) Resolve(node interfaces.Node) (interfaces.Node, error) {
+	visited := make(map[uint64]bool)
+
+	for depth := 0; node.GetMode() == fs.ModeSymlink; depth++ {
+		if depth >= maxDepth || visited[node.GetId()] {
+			return nil, syscall.ELOOP
+		}
+
+		visited[node.GetId()] = true
+
+		var err error
+
+		node, err = resolver.Target(node)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return node, nil
+}
+
+// Walks an absolute path from the root of the file system
+func Lookup(fileSystem *filesystem.FileSystem, path string) (interfaces.Node, error) {
+	node, err := service.GetRoot(fileSystem)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range strings.Split(path, "/") {
+		if name == "" {
+			continue
+		}
+
+		node, err = fileSystem.Lookup(node.GetId(), name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return node, nil
+}
+
+// Removes the given symlinks, or moves them into the quarantine directory in the root when one is given
+func RemoveLinks(fileSystem *filesystem.FileSystem, links []interfaces.Node, quarantineDirectory string) (int, error) {
+	var quarantine interfaces.Node
+
+	if quarantineDirectory != "" && len(links) > 0 {
+		root, err := service.GetRoot(fileSystem)
+		if err != nil {
+			return 0, err
+		}
+
+		quarantine, err = service.FindOrCreateDirectory(fileSystem, root.GetId(), quarantineDirectory)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	count := 0
+
+	for _, link := range links {
+		var err error
+
+		if quarantine != nil {
+			// Prefix with the id so links with the same name from different directories don't collide
+			name := fmt.Sprintf("%d_%s", link.GetId(), link.GetName())
+			err = fileSystem.Rename(link.GetId(), name, quarantine.GetId())
+		} else {
+			err = fileSystem.RemoveFile(link.GetId())
+		}
+
+		if err != nil {
+			return count, err
+		}
+
+		count++
+	}
+
+	return count, nil
+}
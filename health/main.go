@@ -0,0 +1,266 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"debrid_drive/account"
+	"debrid_drive/config"
+	"debrid_drive/database"
+	"debrid_drive/logger"
+	"debrid_drive/metrics"
+
+	"github.com/sushydev/vfs_go"
+	"github.com/sushydev/vfs_go/service"
+	grpc "google.golang.org/grpc"
+	grpc_health "google.golang.org/grpc/health"
+	grpc_health_v1 "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+const (
+	// Real debrid is asked at most this often, health checks in between reuse the result
+	apiCheckInterval = time.Minute
+	// How often the grpc health status is refreshed
+	refreshInterval = 30 * time.Second
+)
+
+type Check struct {
+	Healthy bool   `json:"healthy"`
+	Message string `json:"message,omitempty"`
+}
+
+type Report struct {
+	Healthy bool             `json:"healthy"`
+	Checks  map[string]Check `json:"checks"`
+}
+
+type Monitor struct {
+	database   *database.Instance
+	fileSystem *filesystem.FileSystem
+	accounts   []*account.Account
+	lastPoll   func() time.Time
+
+	grpcHealth *grpc_health.Server
+	logger     *logger.Logger
+
+	apiMutex     sync.Mutex
+	apiCheck     Check
+	apiCheckedAt time.Time
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewMonitor(database *database.Instance, fileSystem *filesystem.FileSystem, accounts []*account.Account, lastPoll func() time.Time) *Monitor {
+	logger, err := logger.NewLogger("Health")
+	if err != nil {
+		panic(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	grpcHealth := grpc_health.NewServer()
+	grpcHealth.SetServingStatus("", grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+
+	return &Monitor{
+		database:   database,
+		fileSystem: fileSystem,
+		accounts:   accounts,
+		lastPoll:   lastPoll,
+
+		grpcHealth: grpcHealth,
+		logger:     logger,
+
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Registers the standard grpc health service, it reports SERVING while the monitor is ready
+func (monitor *Monitor) RegisterGrpc(server *grpc.Server) {
+	grpc_health_v1.RegisterHealthServer(server, monitor.grpcHealth)
+}
+
+// Keeps the grpc health status up to date until stopped
+func (monitor *Monitor) Start() {
+	ticker := time.NewTicker(refreshInterval)
+	defer ticker.Stop()
+
+	for {
+		monitor.refresh()
+
+		select {
+		case <-monitor.ctx.Done():
+			monitor.grpcHealth.Shutdown()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (monitor *Monitor) Stop() {
+	monitor.cancel()
+}
+
+func (monitor *Monitor) refresh() {
+	status := grpc_health_v1.HealthCheckResponse_NOT_SERVING
+	if monitor.Readiness().Healthy {
+		status = grpc_health_v1.HealthCheckResponse_SERVING
+	}
+
+	monitor.grpcHealth.SetServingStatus("", status)
+}
+
+// Whether the process itself works: the database and file system respond
+func (monitor *Monitor) Liveness() Report {
+	return newReport(map[string]Check{
+		"database":    monitor.checkDatabase(),
+		"file_system": monitor.checkFileSystem(),
+	})
+}
+
+// Whether the server is fit to serve: alive, polling and able to reach real debrid
+func (monitor *Monitor) Readiness() Report {
+	return newReport(map[string]Check{
+		"database":    monitor.checkDatabase(),
+		"file_system": monitor.checkFileSystem(),
+		"poll":        monitor.checkPoll(),
+		"real_debrid": monitor.checkApi(),
+	})
+}
+
+func newReport(checks map[string]Check) Report {
+	report := Report{Healthy: true, Checks: checks}
+
+	for _, check := range checks {
+		if !check.Healthy {
+			report.Healthy = false
+		}
+	}
+
+	return report
+}
+
+func healthy(message string) Check {
+	return Check{Healthy: true, Message: message}
+}
+
+func unhealthy(message string) Check {
+	return Check{Healthy: false, Message: message}
+}
+
+func (monitor *Monitor) checkDatabase() Check {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := monitor.database.GetDatabase().PingContext(ctx)
+	if err != nil {
+		return unhealthy(err.Error())
+	}
+
+	return healthy("")
+}
+
+func (monitor *Monitor) checkFileSystem() Check {
+	_, err := service.GetRoot(monitor.fileSystem)
+	if err != nil {
+		return unhealthy(err.Error())
+	}
+
+	return healthy("")
+}
+
+// A poll is overdue after missing three intervals
+func (monitor *Monitor) checkPoll() Check {
+	lastPoll := monitor.lastPoll()
+	if lastPoll.IsZero() {
+		return unhealthy("no successful poll yet")
+	}
+
+	message := fmt.Sprintf("last successful poll at %s", lastPoll.Format(time.RFC3339))
+
+	if time.Since(lastPoll) > 3*config.GetPollIntervalSeconds() {
+		return unhealthy(message)
+	}
+
+	return healthy(message)
+}
+
+func (monitor *Monitor) checkApi() Check {
+	monitor.apiMutex.Lock()
+	defer monitor.apiMutex.Unlock()
+
+	if time.Since(monitor.apiCheckedAt) < apiCheckInterval {
+		return monitor.apiCheck
+	}
+
+	// Every account has to be reachable, the message names the ones that are not
+	failures := make([]string, 0)
+
+	for _, account := range monitor.accounts {
+		_, _, err := account.GetProvider().ListRecentTorrents(1)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", account.GetName(), err))
+		}
+	}
+
+	if len(failures) > 0 {
+		monitor.apiCheck = unhealthy(strings.Join(failures, "; "))
+	} else {
+		monitor.apiCheck = healthy("")
+	}
+
+	monitor.apiCheckedAt = time.Now()
+
+	return monitor.apiCheck
+}
+
+// Serves /healthz, /readyz and the prometheus /metrics on the given port
+func (monitor *Monitor) Serve(port int) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", monitor.handler(monitor.Liveness))
+	mux.HandleFunc("/readyz", monitor.handler(monitor.Readiness))
+	mux.Handle("/metrics", metrics.Handler())
+
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		monitor.logger.Error("failed to listen", err)
+		return
+	}
+
+	monitor.logger.Info(fmt.Sprintf("Listening on port %d", port))
+
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		<-monitor.ctx.Done()
+		server.Close()
+	}()
+
+	err = server.Serve(listener)
+	if err != nil && err != http.ErrServerClosed {
+		monitor.logger.Error("failed to serve", err)
+	}
+}
+
+func (monitor *Monitor) handler(check func() Report) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		report := check()
+
+		writer.Header().Set("Content-Type", "application/json")
+
+		if report.Healthy {
+			writer.WriteHeader(http.StatusOK)
+		} else {
+			writer.WriteHeader(http.StatusServiceUnavailable)
+		}
+
+		json.NewEncoder(writer).Encode(report)
+	}
+}
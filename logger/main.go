@@ -2,98 +2,257 @@ package logger
 
 import (
 	"fmt"
+	"log"
 	"os"
 	"path/filepath"
 	"strings"
-	"log"
+	"sync"
+	"time"
 
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
+// Keys for fields that show up across services
+const (
+	TorrentId = "torrent_id"
+	NodeId    = "node_id"
+	RequestId = "request_id"
+)
+
+const (
+	FormatText = "text"
+	FormatJson = "json"
+)
+
+// Directory of the log files, used until Configure is called
 var LogDir = "logs"
 
-var loggers = make(map[string]*zap.SugaredLogger)
+type Options struct {
+	Directory string
+	// Level of services without a level of their own, info when empty
+	Level string
+	// Levels by service name, e.g. "Actioner": "debug"
+	Levels map[string]string
+	// Format of the stdout output, text when empty
+	Format string
+	// Log files are rotated once they grow past this size, 0 disables rotation by size
+	MaxSizeMegabytes int
+	// Log files are rotated once they were written to for this long, 0 disables rotation by age
+	MaxAge time.Duration
+	// Rotated files kept per service, 0 keeps all of them
+	MaxBackups int
+}
 
-func createLogger(fileName string) (*zap.SugaredLogger, error) {
-	filePath := filepath.Join(LogDir, fileName)
+// One per service name, shared by every logger created for it
+type service struct {
+	name   string
+	level  zap.AtomicLevel
+	file   *zap.Logger
+	stdout *zap.Logger
+}
 
-	// Create the log directory if it doesn't exist
-	dir := filepath.Dir(filePath)
-	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
-		return nil, err
-	}
+var registry = struct {
+	mutex    sync.Mutex
+	options  Options
+	services map[string]*service
+}{
+	options:  Options{Level: "info", Format: FormatText},
+	services: make(map[string]*service),
+}
 
-	// Open the log file
-	logFile, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+// Applies the options to loggers created from now on, levels also apply to existing loggers
+func Configure(options Options) error {
+	_, err := ParseLevel(options.Level)
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	for _, level := range options.Levels {
+		_, err := ParseLevel(level)
+		if err != nil {
+			return err
+		}
+	}
+
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	if options.Directory != "" {
+		LogDir = options.Directory
+	}
+
+	if options.Format == "" {
+		options.Format = FormatText
+	}
+
+	registry.options = options
+
+	for _, service := range registry.services {
+		service.level.SetLevel(levelOf(options, service.name))
+	}
+
+	return nil
+}
+
+// Debug, info, warn or error, info when empty
+func ParseLevel(name string) (zapcore.Level, error) {
+	if name == "" {
+		return zapcore.InfoLevel, nil
+	}
+
+	level, err := zapcore.ParseLevel(name)
+	if err != nil || level > zapcore.ErrorLevel {
+		return zapcore.InfoLevel, fmt.Errorf("Unknown log level %s, must be debug, info, warn or error", name)
 	}
 
-	// Define the core for the logger
-	core := zapcore.NewCore(
-		zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), // Use JSON encoding for structured logs
-		zapcore.AddSync(logFile),                                 // Write logs to file
-		zap.InfoLevel,                                            // Set the log level
-	)
+	return level, nil
+}
 
-	// Return the new logger
-	logger := zap.New(core, zap.AddCaller())
+// Levels were validated by Configure
+func levelOf(options Options, name string) zapcore.Level {
+	levelName, ok := options.Levels[name]
+	if !ok {
+		levelName = options.Level
+	}
 
-	return logger.Sugar(), nil
+	level, _ := ParseLevel(levelName)
+
+	return level
 }
 
-func getLogger(fileName string) (*zap.SugaredLogger, error) {
-	if logger, ok := loggers[fileName]; ok {
-		return logger, nil
+func getService(name string) (*service, error) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	if existing, ok := registry.services[name]; ok {
+		return existing, nil
 	}
 
-	logger, err := createLogger(fileName)
+	options := registry.options
+	level := zap.NewAtomicLevelAt(levelOf(options, name))
+
+	fileName := strings.ToLower(strings.ReplaceAll(name, " ", "_")) + ".log"
+
+	err := os.MkdirAll(LogDir, os.ModePerm)
 	if err != nil {
 		return nil, err
 	}
 
-	loggers[fileName] = logger
+	file, err := openRotatingFile(filepath.Join(LogDir, fileName), options)
+	if err != nil {
+		return nil, err
+	}
+
+	encoderConfig := zap.NewProductionEncoderConfig()
+	encoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
 
-	return logger, nil
+	newService := &service{
+		name:  name,
+		level: level,
+		file:  zap.New(zapcore.NewCore(zapcore.NewJSONEncoder(encoderConfig), file, level)),
+	}
+
+	if options.Format == FormatJson {
+		newService.stdout = zap.New(zapcore.NewCore(zapcore.NewJSONEncoder(encoderConfig), zapcore.Lock(os.Stdout), level)).With(zap.String("service", name))
+	}
+
+	registry.services[name] = newService
+
+	return newService, nil
 }
 
 type Logger struct {
-	logger  *zap.SugaredLogger
-	service string
+	service *service
+	fields  []any
 }
 
-func NewLogger(service string) (*Logger, error) {
-	filename := strings.ToLower(strings.ReplaceAll(service, " ", "_"))
-
-	logger, err := getLogger(filename + ".log")
+// Loggers of the same service share their file and level, creating them is safe from any goroutine
+func NewLogger(name string) (*Logger, error) {
+	service, err := getService(name)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Logger{
-		logger:  logger,
-		service: service,
-	}, nil
+	return &Logger{service: service}, nil
 }
 
-// [Info] ExistingExtraFileService: Found 0 possible extra files, imported 0 files.
-func (instance *Logger) Info(message string) {
-	// replace tabs with spaces
-	loggerMessage := strings.ReplaceAll(message, "\t", " ")
+// A logger adding key value pairs to every entry, e.g. With(logger.TorrentId, id)
+func (instance *Logger) With(keysAndValues ...any) *Logger {
+	fields := make([]any, 0, len(instance.fields)+len(keysAndValues))
+	fields = append(fields, instance.fields...)
+	fields = append(fields, keysAndValues...)
 
-	instance.logger.Infof(loggerMessage)
+	return &Logger{service: instance.service, fields: fields}
+}
+
+func (instance *Logger) Debug(message string, keysAndValues ...any) {
+	instance.log(zapcore.DebugLevel, message, nil, keysAndValues)
+}
 
-	formattedMessage := fmt.Sprintf("INFO	%s:	%s", instance.service, message)
+// [Info] ExistingExtraFileService: Found 0 possible extra files, imported 0 files.
+func (instance *Logger) Info(message string, keysAndValues ...any) {
+	instance.log(zapcore.InfoLevel, message, nil, keysAndValues)
+}
 
-	log.Println(formattedMessage)
+func (instance *Logger) Warn(message string, keysAndValues ...any) {
+	instance.log(zapcore.WarnLevel, message, nil, keysAndValues)
 }
 
 // [Error] ExistingExtraFileService: Failed to import extra files: failed to read directory: open /path/to/directory: permission denied
-func (instance Logger) Error(message string, err error) {
-	instance.logger.Error(fmt.Sprintf("%s: %v", message, err))
+func (instance *Logger) Error(message string, err error, keysAndValues ...any) {
+	instance.log(zapcore.ErrorLevel, message, err, keysAndValues)
+}
+
+func (instance *Logger) log(level zapcore.Level, message string, err error, keysAndValues []any) {
+	if !instance.service.level.Enabled(level) {
+		return
+	}
+
+	fields := make([]any, 0, len(instance.fields)+len(keysAndValues)+1)
+	fields = append(fields, instance.fields...)
+	fields = append(fields, keysAndValues...)
 
-	formattedMessage := fmt.Sprintf("ERROR	%s:	%s: %v", instance.service, message, err)
+	if err != nil {
+		fields = append(fields, zap.Error(err))
+	}
+
+	instance.service.file.Sugar().Logw(level, message, fields...)
+
+	if instance.service.stdout != nil {
+		instance.service.stdout.Sugar().Logw(level, message, fields...)
+		return
+	}
+
+	text := fmt.Sprintf("%s	%s:	%s", strings.ToUpper(level.String()), instance.service.name, message)
+
+	if err != nil {
+		text = fmt.Sprintf("%s: %v", text, err)
+	}
+
+	log.Println(text + formatFields(instance.fields, keysAndValues))
+}
+
+// key=value pairs for the text output, values with spaces are quoted
+func formatFields(lists ...[]any) string {
+	var builder strings.Builder
+
+	for _, list := range lists {
+		for index := 0; index < len(list); index += 2 {
+			key := fmt.Sprint(list[index])
+
+			value := "<missing>"
+			if index+1 < len(list) {
+				value = fmt.Sprint(list[index+1])
+			}
+
+			if strings.ContainsAny(value, " \t\"") {
+				value = fmt.Sprintf("%q", value)
+			}
+
+			fmt.Fprintf(&builder, " %s=%s", key, value)
+		}
+	}
 
-	log.Println(formattedMessage)
+	return builder.String()
 }
@@ -0,0 +1,197 @@
+package logger
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Appended to the path of a rotated file, the time it was rotated at
+const rotationLayout = "20060102-150405.000"
+
+// A log file that is moved aside and started over once it is too large or too old
+// Rotated files are named after the file with the rotation time appended, e.g. actioner.log.20240101-150405.000
+type rotatingFile struct {
+	mutex sync.Mutex
+
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+
+	file      *os.File
+	size      int64
+	startedAt time.Time
+	// The file was moved aside but a new one could not be opened, entries go to the moved file until it can
+	reopen bool
+}
+
+func openRotatingFile(path string, options Options) (*rotatingFile, error) {
+	file := &rotatingFile{
+		path:       path,
+		maxSize:    int64(options.MaxSizeMegabytes) * 1024 * 1024,
+		maxAge:     options.MaxAge,
+		maxBackups: options.MaxBackups,
+	}
+
+	handle, info, err := file.open()
+	if err != nil {
+		return nil, err
+	}
+
+	file.file = handle
+	file.size = info.Size()
+	file.startedAt = file.startOf(info)
+
+	return file, nil
+}
+
+func (file *rotatingFile) open() (*os.File, os.FileInfo, error) {
+	handle, err := os.OpenFile(file.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	info, err := handle.Stat()
+	if err != nil {
+		handle.Close()
+		return nil, nil, err
+	}
+
+	return handle, info, nil
+}
+
+// An existing file started at the last rotation, or at its last write when it was never rotated
+func (file *rotatingFile) startOf(info os.FileInfo) time.Time {
+	if info.Size() == 0 {
+		return time.Now()
+	}
+
+	backups, err := file.backups()
+	if err != nil || len(backups) == 0 {
+		return info.ModTime()
+	}
+
+	rotatedAt, _ := time.ParseInLocation(rotationLayout, strings.TrimPrefix(backups[len(backups)-1], file.path+"."), time.Local)
+
+	return rotatedAt
+}
+
+func (file *rotatingFile) Write(data []byte) (int, error) {
+	file.mutex.Lock()
+	defer file.mutex.Unlock()
+
+	if file.reopen || file.shouldRotate(len(data)) {
+		err := file.rotate()
+		if err != nil {
+			// Keep writing to the current file rather than losing the entry
+			fmt.Fprintf(os.Stderr, "Failed to rotate %s: %v\n", file.path, err)
+		}
+	}
+
+	written, err := file.file.Write(data)
+	file.size += int64(written)
+
+	return written, err
+}
+
+func (file *rotatingFile) Sync() error {
+	file.mutex.Lock()
+	defer file.mutex.Unlock()
+
+	return file.file.Sync()
+}
+
+func (file *rotatingFile) shouldRotate(length int) bool {
+	if file.size == 0 {
+		return false
+	}
+
+	if file.maxSize > 0 && file.size+int64(length) > file.maxSize {
+		return true
+	}
+
+	return file.maxAge > 0 && time.Since(file.startedAt) > file.maxAge
+}
+
+// 1. Rename the current file, it stays open
+// 2. Start a new file at the same path and close the renamed one, when this fails it is retried on the next write
+// 3. Remove the oldest rotated files beyond the max backups
+func (file *rotatingFile) rotate() error {
+	if !file.reopen {
+		rotatedPath := fmt.Sprintf("%s.%s", file.path, time.Now().Format(rotationLayout))
+
+		err := os.Rename(file.path, rotatedPath)
+		if err != nil {
+			return err
+		}
+
+		file.reopen = true
+	}
+
+	handle, _, err := file.open()
+	if err != nil {
+		return err
+	}
+
+	file.file.Close()
+
+	file.file = handle
+	file.size = 0
+	file.startedAt = time.Now()
+	file.reopen = false
+
+	return file.removeBackups()
+}
+
+// Rotated files of this file, oldest first
+func (file *rotatingFile) backups() ([]string, error) {
+	matches, err := filepath.Glob(file.path + ".*")
+	if err != nil {
+		return nil, err
+	}
+
+	backups := make([]string, 0, len(matches))
+
+	for _, match := range matches {
+		_, err := time.Parse(rotationLayout, strings.TrimPrefix(match, file.path+"."))
+		if err != nil {
+			continue
+		}
+
+		backups = append(backups, match)
+	}
+
+	// The timestamp suffix sorts oldest first
+	slices.Sort(backups)
+
+	return backups, nil
+}
+
+func (file *rotatingFile) removeBackups() error {
+	if file.maxBackups <= 0 {
+		return nil
+	}
+
+	backups, err := file.backups()
+	if err != nil {
+		return err
+	}
+
+	if len(backups) <= file.maxBackups {
+		return nil
+	}
+
+	for _, backup := range backups[:len(backups)-file.maxBackups] {
+		err := os.Remove(backup)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
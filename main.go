@@ -1,24 +1,68 @@
 package main
 
 import (
-	"net/http"
+	"context"
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
 	"time"
 
+	"debrid_drive/account"
+	"debrid_drive/admin"
 	"debrid_drive/config"
 	"debrid_drive/database"
 	filesystem_server "debrid_drive/filesystem/server"
+	"debrid_drive/filesystem/symlink"
+	"debrid_drive/health"
 	"debrid_drive/logger"
 	media_repository "debrid_drive/media/repository"
 	media_service "debrid_drive/media/service"
+	"debrid_drive/metrics"
 	"debrid_drive/poller"
 	"debrid_drive/poller/action"
 
-	"github.com/sushydev/real_debrid_go"
 	"github.com/sushydev/vfs_go"
 )
 
+const configWatchInterval = 5 * time.Second
+
 func main() {
-	config.Validate()
+	configPath := flag.String("config", "config.yml", "Path to the config file")
+	flag.Parse()
+
+	err := config.Load(*configPath, isFlagSet("config"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	err = prepareDirectories()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	err = configureLogger()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	args := flag.Args()
+	if len(args) > 0 && args[0] == "admin" {
+		err := admin.Run(args[1:])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		return
+	}
 
 	logger, err := logger.NewLogger("Main")
 	if err != nil {
@@ -26,40 +70,234 @@ func main() {
 	}
 
 	logger.Info("Starting...")
-	logger.Info("Using Poll URL: " + config.GetPollUrl())
 
-	token := config.GetRealDebridToken()
-	client := real_debrid_go.NewClient(token, &http.Client{})
+	accounts := account.FromConfig()
 
-	database, err := database.NewInstance()
+	database, err := database.NewInstance(config.GetMediaDatabasePath())
 	if err != nil {
 		logger.Error("Failed to create database", err)
 		panic(err)
 	}
 
-	fileSystem, err := filesystem.New("app_data/filesystem.db")
+	fileSystemPath := config.GetFileSystemDatabasePath()
+	fileSystem, err := filesystem.New(fileSystemPath)
 	if err != nil {
 		logger.Error("Failed to create file system", err)
 		panic(err)
 	}
 
+	metrics.RegisterDatabaseSize("media", config.GetMediaDatabasePath())
+	metrics.RegisterDatabaseSize("file_system", fileSystemPath)
+
 	mediaService := media_repository.NewMediaService(database.GetDatabase())
-	mediaManager := media_service.NewMediaService(client, database, fileSystem, mediaService)
-	fileSystemServer := filesystem_server.NewFileSystemServer(client, fileSystem, mediaManager)
+	symlinks := symlink.NewResolver(fileSystem, mediaService)
+	mediaManager := media_service.NewMediaService(accounts, database, fileSystem, symlinks, mediaService)
+
+	// Before polling starts, so removals find symlinks made before they were recorded
+	err = mediaManager.IndexSymlinks()
+	if err != nil {
+		logger.Error("Failed to record symlinks", err)
+	}
+
+	// Init a poller per account
+	pollInterval := config.GetPollIntervalSeconds()
+	pollers := make([]*poller.Poller, 0, len(accounts))
+
+	for _, account := range accounts {
+		actioner := action.New(account, mediaService, mediaManager, fileSystem, fileSystemPath)
+
+		metrics.RegisterTorrentCount(account.GetName(), func() (int, error) {
+			return mediaService.CountTorrents(account.GetName())
+		})
+
+		// Init change detector
+		var detector poller.Detector
+
+		switch account.GetPollSource() {
+		case config.PollSourcePage:
+			logger.Info(fmt.Sprintf("Using Poll URL for account %s: %s", account.GetName(), account.GetPollUrl()))
+			detector = poller.NewPageDetector(account.GetPollUrl(), "table")
+		default:
+			logger.Info(fmt.Sprintf("Using torrents API for change detection for account %s", account.GetName()))
+			detector = poller.NewApiDetector(account.GetProvider())
+		}
+
+		accountPoller := poller.New(detector, pollInterval, func(ctx context.Context, hash [32]byte) error {
+			return actioner.Poll(ctx)
+		})
+		accountPoller.SetPending(actioner.HasPendingTorrents)
+
+		pollers = append(pollers, accountPoller)
+	}
+
+	// The oldest successful poll across the accounts
+	lastPoll := func() time.Time {
+		var oldest time.Time
+
+		for index, poller := range pollers {
+			lastSuccess := poller.LastSuccess()
+			if index == 0 || lastSuccess.Before(oldest) {
+				oldest = lastSuccess
+			}
+		}
+
+		return oldest
+	}
+
+	// Init health monitor
+	monitor := health.NewMonitor(database, fileSystem, accounts, lastPoll)
+	go monitor.Start()
+
+	if port := config.GetHttpPort(); port != 0 {
+		go monitor.Serve(port)
+	}
+
+	fileSystemServer := filesystem_server.NewFileSystemServer(fileSystem, mediaManager)
+	monitor.RegisterGrpc(fileSystemServer.GetServer())
 
 	fileSystemServerReady := make(chan struct{})
 	go fileSystemServer.Serve(fileSystemServerReady)
 	<-fileSystemServerReady
 
-	// Init actioner
-	actioner := action.New(client, mediaService, mediaManager, fileSystem)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	config.Subscribe(func(previous config.Config, next config.Config) {
+		if previous.PollIntervalSeconds != next.PollIntervalSeconds {
+			logger.Info(fmt.Sprintf("Poll interval changed to %s", config.GetPollIntervalSeconds()))
+
+			for _, poller := range pollers {
+				poller.SetInterval(config.GetPollIntervalSeconds())
+			}
+		}
 
-	// Init new poller
-	pollUrl := config.GetPollUrl()
-	pollInterval := time.Duration(config.GetPollIntervalSeconds()) * time.Second
-	poller := poller.New(pollUrl, "table", pollInterval, func([32]byte) {
-		actioner.Poll()
+		if previous.LogLevel != next.LogLevel || !maps.Equal(previous.LogLevels, next.LogLevels) {
+			err := configureLogger()
+			if err != nil {
+				logger.Error("Failed to apply log levels", err)
+				return
+			}
+
+			logger.Info("Log levels changed")
+		}
 	})
 
-	poller.Start()
+	go config.Watch(ctx, configWatchInterval, func(message string, err error) {
+		if err != nil {
+			logger.Error(message, err)
+			return
+		}
+
+		logger.Info(message)
+	})
+
+	var workersRunning sync.WaitGroup
+	for _, poller := range pollers {
+		workersRunning.Add(1)
+
+		go func() {
+			defer workersRunning.Done()
+			poller.Start()
+		}()
+	}
+
+	workersRunning.Add(1)
+	go func() {
+		defer workersRunning.Done()
+		mediaManager.StartLinkCheck(ctx)
+	}()
+
+	workersRunning.Add(1)
+	go func() {
+		defer workersRunning.Done()
+		mediaManager.StartTrashCheck(ctx)
+	}()
+
+	workersRunning.Add(1)
+	go func() {
+		defer workersRunning.Done()
+		mediaManager.StartStreamUrlCleanup(ctx)
+	}()
+
+	workersStopped := make(chan struct{})
+	go func() {
+		workersRunning.Wait()
+		close(workersStopped)
+	}()
+
+	<-ctx.Done()
+	logger.Info("Shutting down...")
+
+	// The grpc server and the workers share one deadline
+	shutdownTimeout := config.GetShutdownTimeout()
+	shutdownDeadline := time.Now().Add(shutdownTimeout)
+
+	for _, poller := range pollers {
+		poller.Stop()
+	}
+
+	monitor.Stop()
+	fileSystemServer.Stop(time.Until(shutdownDeadline))
+
+	select {
+	case <-workersStopped:
+	case <-time.After(time.Until(shutdownDeadline)):
+		logger.Error("Timed out waiting for reconciliation and link checks", fmt.Errorf("still running after %s", shutdownTimeout))
+	}
+
+	// The file system has no close of its own, its database is released when the process exits
+	database.Close()
+
+	logger.Info("Stopped")
+}
+
+// Levels are applied to running loggers, the other options to loggers created afterwards
+func configureLogger() error {
+	return logger.Configure(logger.Options{
+		Directory:        config.GetLogDirectory(),
+		Level:            config.GetLogLevel(),
+		Levels:           config.GetLogLevels(),
+		Format:           config.GetLogFormat(),
+		MaxSizeMegabytes: config.GetLogMaxSizeMegabytes(),
+		MaxAge:           config.GetLogMaxAge(),
+		MaxBackups:       config.GetLogMaxBackups(),
+	})
+}
+
+func isFlagSet(name string) bool {
+	set := false
+
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+
+	return set
+}
+
+// Creates the data and log directories and makes sure they are writable
+func prepareDirectories() error {
+	directories := map[string]string{
+		"Media database directory":       filepath.Dir(config.GetMediaDatabasePath()),
+		"File system database directory": filepath.Dir(config.GetFileSystemDatabasePath()),
+		"Log directory":                  config.GetLogDirectory(),
+	}
+
+	for name, directory := range directories {
+		err := os.MkdirAll(directory, 0755)
+		if err != nil {
+			return fmt.Errorf("%s %s could not be created: %w", name, directory, err)
+		}
+
+		file, err := os.CreateTemp(directory, ".write_test_*")
+		if err != nil {
+			return fmt.Errorf("%s %s is not writable: %w", name, directory, err)
+		}
+
+		file.Close()
+		os.Remove(file.Name())
+	}
+
+	return nil
 }
@@ -0,0 +1,182 @@
+package repository
+
+import (
+	"database/sql"
+)
+
+// Removal of a local torrent that was held back by the mass deletion guard
+type HeldRemoval struct {
+	identifier        uint64
+	account           string
+	torrentIdentifier string
+	name              string
+	heldAt            string
+	confirmed         bool
+}
+
+func (heldRemoval *HeldRemoval) GetIdentifier() uint64 {
+	return heldRemoval.identifier
+}
+
+// Name of the debrid account the torrent belongs to
+func (heldRemoval *HeldRemoval) GetAccount() string {
+	return heldRemoval.account
+}
+
+func (heldRemoval *HeldRemoval) GetTorrentIdentifier() string {
+	return heldRemoval.torrentIdentifier
+}
+
+func (heldRemoval *HeldRemoval) GetName() string {
+	return heldRemoval.name
+}
+
+func (heldRemoval *HeldRemoval) GetHeldAt() string {
+	return heldRemoval.heldAt
+}
+
+func (heldRemoval *HeldRemoval) IsConfirmed() bool {
+	return heldRemoval.confirmed
+}
+
+func (mediaRepository *MediaRepository) CountTorrents(account string) (int, error) {
+	query := `
+	SELECT COUNT(*) FROM torrents WHERE account = ?
+	`
+
+	var count int
+	err := mediaRepository.database.QueryRow(query, account).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+func (mediaRepository *MediaRepository) GetHeldRemovals(account string) ([]*HeldRemoval, error) {
+	query := `
+	SELECT id, account, torrent_id, name, held_at, confirmed
+	FROM held_removals
+	WHERE account = ?
+	ORDER BY held_at, id
+	`
+
+	rows, err := mediaRepository.database.Query(query, account)
+	if err != nil {
+		return nil, mediaRepository.error("Failed to query data", err)
+	}
+	defer rows.Close()
+
+	heldRemovals := make([]*HeldRemoval, 0)
+	for rows.Next() {
+		heldRemoval := &HeldRemoval{}
+
+		err := rows.Scan(&heldRemoval.identifier, &heldRemoval.account, &heldRemoval.torrentIdentifier, &heldRemoval.name, &heldRemoval.heldAt, &heldRemoval.confirmed)
+		if err != nil {
+			return nil, mediaRepository.error("Failed to scan data", err)
+		}
+
+		heldRemovals = append(heldRemovals, heldRemoval)
+	}
+
+	return heldRemovals, rows.Err()
+}
+
+// Whether held removals of the account were confirmed and are waiting for the next poll to apply them
+func (mediaRepository *MediaRepository) HasConfirmedHeldRemovals(account string) (bool, error) {
+	query := `
+	SELECT EXISTS(
+		SELECT 1
+		FROM held_removals
+		WHERE confirmed = 1
+		AND account = ?
+	)
+	`
+
+	var exists int
+	err := mediaRepository.database.QueryRow(query, account).Scan(&exists)
+	if err != nil {
+		return false, mediaRepository.error("Failed to query data", err)
+	}
+
+	return exists == 1, nil
+}
+
+func (mediaRepository *MediaRepository) HoldRemoval(transaction *sql.Tx, torrent *Torrent) error {
+	query := `
+	INSERT INTO held_removals (account, torrent_id, name)
+	VALUES (?, ?, ?)
+	ON CONFLICT(account, torrent_id) DO NOTHING;
+	`
+
+	_, err := transaction.Exec(query, torrent.account, torrent.torrentIdentifier, torrent.name)
+	if err != nil {
+		return mediaRepository.error("Failed to insert data", err)
+	}
+
+	return nil
+}
+
+func (mediaRepository *MediaRepository) RemoveHeldRemoval(transaction *sql.Tx, account string, torrentIdentifier string) error {
+	query := `
+	DELETE FROM held_removals
+	WHERE account = ?
+	AND torrent_id = ?;
+	`
+
+	_, err := transaction.Exec(query, account, torrentIdentifier)
+	if err != nil {
+		return mediaRepository.error("Failed to delete data", err)
+	}
+
+	return nil
+}
+
+// Held removals whose torrent came back in the account or is already gone locally no longer need a decision
+func (mediaRepository *MediaRepository) RemoveResolvedHeldRemovals(transaction *sql.Tx, account string) error {
+	query := `
+	DELETE FROM held_removals
+	WHERE account = ?
+	AND (
+		torrent_id IN (SELECT torrent_id FROM torrent_snapshots WHERE account = ?)
+		OR torrent_id NOT IN (SELECT torrent_id FROM torrents WHERE account = ?)
+	);
+	`
+
+	_, err := transaction.Exec(query, account, account, account)
+	if err != nil {
+		return mediaRepository.error("Failed to delete data", err)
+	}
+
+	return nil
+}
+
+// Confirms the given held removals of the account, or all of them when none are given
+func (mediaRepository *MediaRepository) ConfirmHeldRemovals(account string, torrentIdentifiers []string) (int64, error) {
+	if len(torrentIdentifiers) == 0 {
+		result, err := mediaRepository.database.Exec("UPDATE held_removals SET confirmed = 1 WHERE account = ?", account)
+		if err != nil {
+			return 0, mediaRepository.error("Failed to update data", err)
+		}
+
+		return result.RowsAffected()
+	}
+
+	var count int64
+
+	for _, torrentIdentifier := range torrentIdentifiers {
+		result, err := mediaRepository.database.Exec("UPDATE held_removals SET confirmed = 1 WHERE account = ? AND torrent_id = ?", account, torrentIdentifier)
+		if err != nil {
+			return count, mediaRepository.error("Failed to update data", err)
+		}
+
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return count, err
+		}
+
+		count += affected
+	}
+
+	return count, nil
+}
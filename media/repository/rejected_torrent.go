@@ -0,0 +1,217 @@
+package repository
+
+import (
+	"database/sql"
+	"time"
+
+	"debrid_drive/provider"
+)
+
+// A torrent that could not be added, retried at retryAt unless it is zero
+type RejectedTorrent struct {
+	identifier        uint64
+	torrentIdentifier string
+	name              string
+	account           string
+	reason            string
+	rejectedAt        time.Time
+	attempts          int
+	retryAt           time.Time
+}
+
+func (rejectedTorrent *RejectedTorrent) GetIdentifier() uint64 {
+	return rejectedTorrent.identifier
+}
+
+func (rejectedTorrent *RejectedTorrent) GetTorrentIdentifier() string {
+	return rejectedTorrent.torrentIdentifier
+}
+
+func (rejectedTorrent *RejectedTorrent) GetName() string {
+	return rejectedTorrent.name
+}
+
+func (rejectedTorrent *RejectedTorrent) GetAccount() string {
+	return rejectedTorrent.account
+}
+
+func (rejectedTorrent *RejectedTorrent) GetReason() string {
+	return rejectedTorrent.reason
+}
+
+func (rejectedTorrent *RejectedTorrent) GetRejectedAt() time.Time {
+	return rejectedTorrent.rejectedAt
+}
+
+// Number of times the torrent was rejected in a row
+func (rejectedTorrent *RejectedTorrent) GetAttempts() int {
+	return rejectedTorrent.attempts
+}
+
+// Zero when the torrent is not retried
+func (rejectedTorrent *RejectedTorrent) GetRetryAt() time.Time {
+	return rejectedTorrent.retryAt
+}
+
+func (mediaRepository *MediaRepository) TorrentRejected(account string, torrentId string) (bool, error) {
+	query := `
+	SELECT EXISTS(SELECT 1 FROM rejected_torrents WHERE account = ? AND torrent_id = ?)
+	`
+
+	row := mediaRepository.database.QueryRow(query, account, torrentId)
+
+	var exists int
+	err := row.Scan(&exists)
+	if err != nil {
+		return false, err
+	}
+
+	return exists == 1, nil
+}
+
+// Records the rejection, replacing an earlier one of the same torrent in the account
+// A zero retryAt means the torrent is not retried
+func (mediaRepository *MediaRepository) RejectTorrent(transaction *sql.Tx, account string, torrent *provider.Torrent, reason string, attempts int, retryAt time.Time) error {
+	query := `
+	INSERT INTO rejected_torrents (torrent_id, name, account, reason, rejected_at, attempts, retry_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT(account, torrent_id) DO UPDATE SET
+		name = excluded.name,
+		reason = excluded.reason,
+		rejected_at = excluded.rejected_at,
+		attempts = excluded.attempts,
+		retry_at = excluded.retry_at;
+	`
+
+	_, err := transaction.Exec(query, torrent.ID, torrent.Name, account, reason, time.Now().Unix(), attempts, toNullUnix(retryAt))
+	if err != nil {
+		return mediaRepository.error("Failed to insert data", err)
+	}
+
+	return nil
+}
+
+func (mediaRepository *MediaRepository) RemoveRejectedTorrent(transaction *sql.Tx, account string, torrentIdentifier string) error {
+	query := `
+	DELETE FROM rejected_torrents
+	WHERE account = ?
+	AND torrent_id = ?;
+	`
+
+	_, err := transaction.Exec(query, account, torrentIdentifier)
+	if err != nil {
+		return mediaRepository.error("Failed to delete data", err)
+	}
+
+	return nil
+}
+
+// Returns nil when the torrent was not rejected
+func (mediaRepository *MediaRepository) GetRejectedTorrent(account string, torrentIdentifier string) (*RejectedTorrent, error) {
+	query := `
+	SELECT id, torrent_id, name, account, reason, rejected_at, attempts, retry_at
+	FROM rejected_torrents
+	WHERE account = ?
+	AND torrent_id = ?
+	`
+
+	rejectedTorrents, err := mediaRepository.queryRejectedTorrents(query, account, torrentIdentifier)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rejectedTorrents) == 0 {
+		return nil, nil
+	}
+
+	return rejectedTorrents[0], nil
+}
+
+func (mediaRepository *MediaRepository) GetRejectedTorrents() ([]*RejectedTorrent, error) {
+	query := `
+	SELECT id, torrent_id, name, account, reason, rejected_at, attempts, retry_at
+	FROM rejected_torrents
+	ORDER BY rejected_at, id
+	`
+
+	return mediaRepository.queryRejectedTorrents(query)
+}
+
+// Clears the given rejections, or all of them when none are given, so the torrents are tried again
+func (mediaRepository *MediaRepository) ClearRejectedTorrents(torrentIdentifiers []string) (int64, error) {
+	if len(torrentIdentifiers) == 0 {
+		result, err := mediaRepository.database.Exec("DELETE FROM rejected_torrents")
+		if err != nil {
+			return 0, mediaRepository.error("Failed to delete data", err)
+		}
+
+		return result.RowsAffected()
+	}
+
+	var count int64
+
+	for _, torrentIdentifier := range torrentIdentifiers {
+		result, err := mediaRepository.database.Exec("DELETE FROM rejected_torrents WHERE torrent_id = ?", torrentIdentifier)
+		if err != nil {
+			return count, mediaRepository.error("Failed to delete data", err)
+		}
+
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return count, err
+		}
+
+		count += affected
+	}
+
+	return count, nil
+}
+
+func (mediaRepository *MediaRepository) queryRejectedTorrents(query string, args ...any) ([]*RejectedTorrent, error) {
+	rows, err := mediaRepository.database.Query(query, args...)
+	if err != nil {
+		return nil, mediaRepository.error("Failed to query data", err)
+	}
+	defer rows.Close()
+
+	rejectedTorrents := make([]*RejectedTorrent, 0)
+	for rows.Next() {
+		rejectedTorrent := &RejectedTorrent{}
+
+		var rejectedAt int64
+		var retryAt sql.NullInt64
+
+		err := rows.Scan(
+			&rejectedTorrent.identifier,
+			&rejectedTorrent.torrentIdentifier,
+			&rejectedTorrent.name,
+			&rejectedTorrent.account,
+			&rejectedTorrent.reason,
+			&rejectedAt,
+			&rejectedTorrent.attempts,
+			&retryAt,
+		)
+
+		if err != nil {
+			return nil, mediaRepository.error("Failed to scan data", err)
+		}
+
+		rejectedTorrent.rejectedAt = time.Unix(rejectedAt, 0)
+
+		if retryAt.Valid {
+			rejectedTorrent.retryAt = time.Unix(retryAt.Int64, 0)
+		}
+
+		rejectedTorrents = append(rejectedTorrents, rejectedTorrent)
+	}
+
+	return rejectedTorrents, rows.Err()
+}
+
+func toNullUnix(value time.Time) sql.NullInt64 {
+	if value.IsZero() {
+		return sql.NullInt64{}
+	}
+
+	return sql.NullInt64{Int64: value.Unix(), Valid: true}
+}
@@ -0,0 +1,110 @@
+package repository
+
+import (
+	"database/sql"
+	"time"
+)
+
+type StreamUrl struct {
+	link      string
+	url       string
+	expiresAt time.Time
+}
+
+func NewStreamUrl(link string, url string, expiresAt time.Time) *StreamUrl {
+	return &StreamUrl{
+		link:      link,
+		url:       url,
+		expiresAt: time.Unix(expiresAt.Unix(), 0),
+	}
+}
+
+func (streamUrl *StreamUrl) GetLink() string {
+	return streamUrl.link
+}
+
+func (streamUrl *StreamUrl) GetUrl() string {
+	return streamUrl.url
+}
+
+func (streamUrl *StreamUrl) GetExpiresAt() time.Time {
+	return streamUrl.expiresAt
+}
+
+func (streamUrl *StreamUrl) IsExpired() bool {
+	return !time.Now().Before(streamUrl.expiresAt)
+}
+
+func (mediaRepository *MediaRepository) GetStreamUrl(link string) (*StreamUrl, error) {
+	query := `
+	SELECT link, url, expires_at
+	FROM stream_urls
+	WHERE link = ?;
+	`
+
+	row := mediaRepository.database.QueryRow(query, link)
+
+	var expiresAt int64
+	streamUrl := &StreamUrl{}
+	err := row.Scan(&streamUrl.link, &streamUrl.url, &expiresAt)
+	if err != nil {
+		return nil, err
+	}
+
+	streamUrl.expiresAt = time.Unix(expiresAt, 0)
+
+	return streamUrl, nil
+}
+
+const setStreamUrlQuery = `
+INSERT INTO stream_urls (link, url, expires_at)
+VALUES (?, ?, ?)
+ON CONFLICT(link) DO UPDATE SET url = excluded.url, expires_at = excluded.expires_at;
+`
+
+func (mediaRepository *MediaRepository) SetStreamUrl(link string, url string, expiresAt time.Time) (*StreamUrl, error) {
+	_, err := mediaRepository.database.Exec(setStreamUrlQuery, link, url, expiresAt.Unix())
+	if err != nil {
+		return nil, mediaRepository.error("Failed to save stream url", err)
+	}
+
+	return NewStreamUrl(link, url, expiresAt), nil
+}
+
+// Like SetStreamUrl, the url is only kept when the transaction commits
+func (mediaRepository *MediaRepository) SaveStreamUrl(transaction *sql.Tx, link string, url string, expiresAt time.Time) error {
+	_, err := transaction.Exec(setStreamUrlQuery, link, url, expiresAt.Unix())
+	if err != nil {
+		return mediaRepository.error("Failed to save stream url", err)
+	}
+
+	return nil
+}
+
+func (mediaRepository *MediaRepository) RemoveStreamUrl(transaction *sql.Tx, link string) error {
+	query := `
+	DELETE FROM stream_urls
+	WHERE link = ?;
+	`
+
+	_, err := transaction.Exec(query, link)
+	if err != nil {
+		return mediaRepository.error("Failed to delete stream url", err)
+	}
+
+	return nil
+}
+
+func (mediaRepository *MediaRepository) RemoveExpiredStreamUrls() (int64, error) {
+	query := `
+	DELETE FROM stream_urls
+	WHERE expires_at <= ?;
+	`
+
+	result, err := mediaRepository.database.Exec(query, time.Now().Unix())
+	if err != nil {
+		return 0, mediaRepository.error("Failed to delete expired stream urls", err)
+	}
+
+	return result.RowsAffected()
+}
@@ -0,0 +1,76 @@
+package repository
+
+// Records the node a symlink points at, a link that already exists is pointed at the new target
+func (mediaRepository *MediaRepository) SetSymlink(sourceNodeIdentifier uint64, targetNodeIdentifier uint64) error {
+	query := `
+	INSERT INTO symlinks (source_node_id, target_node_id)
+	VALUES (?, ?)
+	ON CONFLICT(source_node_id) DO UPDATE SET target_node_id = excluded.target_node_id;
+	`
+
+	_, err := mediaRepository.database.Exec(query, sourceNodeIdentifier, targetNodeIdentifier)
+	if err != nil {
+		return mediaRepository.error("Failed to insert data", err)
+	}
+
+	return nil
+}
+
+func (mediaRepository *MediaRepository) GetSymlinkTarget(sourceNodeIdentifier uint64) (uint64, error) {
+	query := `
+	SELECT target_node_id
+	FROM symlinks
+	WHERE source_node_id = ?;
+	`
+
+	var targetNodeIdentifier uint64
+	err := mediaRepository.database.QueryRow(query, sourceNodeIdentifier).Scan(&targetNodeIdentifier)
+	if err != nil {
+		return 0, err
+	}
+
+	return targetNodeIdentifier, nil
+}
+
+// Symlinks pointing straight at the node, links to those links are not included
+func (mediaRepository *MediaRepository) GetSymlinkSources(targetNodeIdentifier uint64) ([]uint64, error) {
+	query := `
+	SELECT source_node_id
+	FROM symlinks
+	WHERE target_node_id = ?;
+	`
+
+	rows, err := mediaRepository.database.Query(query, targetNodeIdentifier)
+	if err != nil {
+		return nil, mediaRepository.error("Failed to query data", err)
+	}
+	defer rows.Close()
+
+	sourceNodeIdentifiers := make([]uint64, 0)
+	for rows.Next() {
+		var sourceNodeIdentifier uint64
+
+		err := rows.Scan(&sourceNodeIdentifier)
+		if err != nil {
+			return nil, mediaRepository.error("Failed to scan data", err)
+		}
+
+		sourceNodeIdentifiers = append(sourceNodeIdentifiers, sourceNodeIdentifier)
+	}
+
+	return sourceNodeIdentifiers, rows.Err()
+}
+
+func (mediaRepository *MediaRepository) RemoveSymlink(sourceNodeIdentifier uint64) error {
+	query := `
+	DELETE FROM symlinks
+	WHERE source_node_id = ?;
+	`
+
+	_, err := mediaRepository.database.Exec(query, sourceNodeIdentifier)
+	if err != nil {
+		return mediaRepository.error("Failed to delete data", err)
+	}
+
+	return nil
+}
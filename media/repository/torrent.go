@@ -3,13 +3,14 @@ package repository
 import (
 	"database/sql"
 
-	real_debrid_api "github.com/sushydev/real_debrid_go/api"
+	"debrid_drive/provider"
 )
 
 type Torrent struct {
 	identifier        uint64
 	torrentIdentifier string
 	name              string
+	account           string
 }
 
 func (torrent *Torrent) GetIdentifier() uint64 {
@@ -24,28 +25,17 @@ func (torrent *Torrent) GetName() string {
 	return torrent.name
 }
 
-func (mediaRepository *MediaRepository) TorrentExists(torrentId string) (bool, error) {
-	query := `
-	SELECT EXISTS(SELECT 1 FROM torrents WHERE torrent_id = ?)
-	`
-
-	row := mediaRepository.database.QueryRow(query, torrentId)
-
-	var exists int
-	err := row.Scan(&exists)
-	if err != nil {
-		return false, err
-	}
-
-	return exists == 1, nil
+// Name of the debrid account the torrent belongs to
+func (torrent *Torrent) GetAccount() string {
+	return torrent.account
 }
 
-func (mediaRepository *MediaRepository) TorrentRejected(torrentId string) (bool, error) {
+func (mediaRepository *MediaRepository) TorrentExists(account string, torrentId string) (bool, error) {
 	query := `
-	SELECT EXISTS(SELECT 1 FROM rejected_torrents WHERE torrent_id = ?)
+	SELECT EXISTS(SELECT 1 FROM torrents WHERE account = ? AND torrent_id = ?)
 	`
 
-	row := mediaRepository.database.QueryRow(query, torrentId)
+	row := mediaRepository.database.QueryRow(query, account, torrentId)
 
 	var exists int
 	err := row.Scan(&exists)
@@ -56,20 +46,21 @@ func (mediaRepository *MediaRepository) TorrentRejected(torrentId string) (bool,
 	return exists == 1, nil
 }
 
-func (mediaRepository *MediaRepository) AddTorrent(transaction *sql.Tx, torrent *real_debrid_api.Torrent) (*Torrent, error) {
+func (mediaRepository *MediaRepository) AddTorrent(transaction *sql.Tx, account string, torrent *provider.Torrent) (*Torrent, error) {
 	query := `
-	INSERT INTO torrents (torrent_id, name)
-	VALUES (?, ?)
-	RETURNING id, torrent_id, name;
+	INSERT INTO torrents (torrent_id, name, account)
+	VALUES (?, ?, ?)
+	RETURNING id, torrent_id, name, account;
 	`
 
-	row := transaction.QueryRow(query, torrent.ID, torrent.Filename)
+	row := transaction.QueryRow(query, torrent.ID, torrent.Name, account)
 
 	databaseTorrent := &Torrent{}
 	err := row.Scan(
 		&databaseTorrent.identifier,
 		&databaseTorrent.torrentIdentifier,
 		&databaseTorrent.name,
+		&databaseTorrent.account,
 	)
 
 	if err != nil {
@@ -93,27 +84,9 @@ func (mediaRepository *MediaRepository) RemoveTorrent(transaction *sql.Tx, torre
 	return nil
 }
 
-func (mediaRepository *MediaRepository) RejectTorrent(transaction *sql.Tx, torrent *real_debrid_api.Torrent) error {
-	query := `
-	INSERT INTO rejected_torrents (torrent_id, name)
-	VALUES (?, ?)
-	RETURNING id;
-	`
-
-	row := transaction.QueryRow(query, torrent.ID, torrent.Filename)
-
-	var identifier uint64
-	err := row.Scan(&identifier)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
 func (mediaRepository *MediaRepository) GetTorrentByTorrentFileId(torrentFileIdentifier uint64) (*Torrent, error) {
 	query := `
-	SELECT torrents.id, torrents.torrent_id, torrents.name
+	SELECT torrents.id, torrents.torrent_id, torrents.name, torrents.account
 	FROM torrents
 	LEFT JOIN torrent_files ON torrents.id = torrent_files.torrent_id
 	WHERE torrent_files.id = ?
@@ -122,7 +95,7 @@ func (mediaRepository *MediaRepository) GetTorrentByTorrentFileId(torrentFileIde
 	row := mediaRepository.database.QueryRow(query, torrentFileIdentifier)
 
 	torrent := &Torrent{}
-	err := row.Scan(&torrent.identifier, &torrent.torrentIdentifier, &torrent.name)
+	err := row.Scan(&torrent.identifier, &torrent.torrentIdentifier, &torrent.name, &torrent.account)
 	if err != nil {
 		return nil, err
 	}
@@ -132,44 +105,24 @@ func (mediaRepository *MediaRepository) GetTorrentByTorrentFileId(torrentFileIde
 
 func (mediaRepository *MediaRepository) GetTorrents() ([]*Torrent, error) {
 	query := `
-	SELECT id, torrent_id, name
+	SELECT id, torrent_id, name, account
 	FROM torrents
 	`
 
-	rows, err := mediaRepository.database.Query(query)
-	if err != nil {
-		return nil, err
-	}
-
-	torrents := make([]*Torrent, 0)
-	for rows.Next() {
-		torrent := &Torrent{}
-		err := rows.Scan(&torrent.identifier, &torrent.torrentIdentifier, &torrent.name)
-		if err != nil {
-			return nil, err
-		}
-
-		torrents = append(torrents, torrent)
-	}
-
-	return torrents, nil
+	return mediaRepository.queryTorrents(query)
 }
 
-func (mediaRepository *MediaRepository) GetRejectedTorrents() ([]*Torrent, error) {
-	query := `
-	SELECT id, torrent_id, name
-	FROM rejected_torrents
-	`
-
-	rows, err := mediaRepository.database.Query(query)
+func (mediaRepository *MediaRepository) queryTorrents(query string, args ...any) ([]*Torrent, error) {
+	rows, err := mediaRepository.database.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
 	torrents := make([]*Torrent, 0)
 	for rows.Next() {
 		torrent := &Torrent{}
-		err := rows.Scan(&torrent.identifier, &torrent.torrentIdentifier, &torrent.name)
+		err := rows.Scan(&torrent.identifier, &torrent.torrentIdentifier, &torrent.name, &torrent.account)
 		if err != nil {
 			return nil, err
 		}
@@ -177,5 +130,5 @@ func (mediaRepository *MediaRepository) GetRejectedTorrents() ([]*Torrent, error
 		torrents = append(torrents, torrent)
 	}
 
-	return torrents, nil
+	return torrents, rows.Err()
 }
@@ -2,8 +2,10 @@ package repository
 
 import (
 	"database/sql"
+	"time"
+
+	"debrid_drive/provider"
 
-	real_debrid_api "github.com/sushydev/real_debrid_go/api"
 	"github.com/sushydev/vfs_go/interfaces"
 )
 
@@ -15,6 +17,8 @@ type TorrentFile struct {
 	size              int
 	link              string
 	fsNodeIdentifier  uint64
+	linkCheckedAt     int64
+	linkFailures      int
 }
 
 func (torrentFile *TorrentFile) GetIdentifier() uint64 {
@@ -37,9 +41,28 @@ func (torrentFile *TorrentFile) GetFileIdentifier() uint64 {
 	return torrentFile.fsNodeIdentifier
 }
 
+// Index of the link in the links of the torrent
+func (torrentFile *TorrentFile) GetLinkIndex() int {
+	return torrentFile.torrentFileIndex
+}
+
+// When the link was last unrestricted, zero when it never was
+func (torrentFile *TorrentFile) GetLinkCheckedAt() time.Time {
+	if torrentFile.linkCheckedAt == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(torrentFile.linkCheckedAt, 0)
+}
+
+// Failed unrestricts of the link in a row
+func (torrentFile *TorrentFile) GetLinkFailures() int {
+	return torrentFile.linkFailures
+}
+
 func (mediaService *MediaRepository) GetTorrentFileByFileId(identifier uint64) (*TorrentFile, error) {
 	query := `
-	SELECT id, torrent_id, path, size, link, file_index, file_node_id
+	SELECT id, torrent_id, path, size, link, file_index, file_node_id, link_checked_at, link_failures
 	FROM torrent_files
 	WHERE file_node_id = ?;
 	`
@@ -55,6 +78,8 @@ func (mediaService *MediaRepository) GetTorrentFileByFileId(identifier uint64) (
 		&torrentFile.link,
 		&torrentFile.torrentFileIndex,
 		&torrentFile.fsNodeIdentifier,
+		&torrentFile.linkCheckedAt,
+		&torrentFile.linkFailures,
 	)
 
 	if err != nil {
@@ -64,11 +89,11 @@ func (mediaService *MediaRepository) GetTorrentFileByFileId(identifier uint64) (
 	return torrentFile, nil
 }
 
-func (mediaService *MediaRepository) AddTorrentFile(transaction *sql.Tx, databaseTorrent *Torrent, torrentFile real_debrid_api.TorrentFile, fileNode interfaces.Node, link string, index int) (*TorrentFile, error) {
+func (mediaService *MediaRepository) AddTorrentFile(transaction *sql.Tx, databaseTorrent *Torrent, torrentFile provider.TorrentFile, fileNode interfaces.Node, link string, index int) (*TorrentFile, error) {
 	query := `
 	INSERT INTO torrent_files (torrent_id, path, size, link, file_index, file_node_id)
 	VALUES (?, ?, ?, ?, ?, ?)
-	RETURNING id, torrent_id, path, size, link, file_index, file_node_id;
+	RETURNING id, torrent_id, path, size, link, file_index, file_node_id, link_checked_at, link_failures;
 	`
 
 	row := transaction.QueryRow(query, databaseTorrent.identifier, torrentFile.Path, torrentFile.Bytes, link, index, fileNode.GetId())
@@ -82,6 +107,8 @@ func (mediaService *MediaRepository) AddTorrentFile(transaction *sql.Tx, databas
 		&databaseTorrentFile.link,
 		&databaseTorrentFile.torrentFileIndex,
 		&databaseTorrentFile.fsNodeIdentifier,
+		&databaseTorrentFile.linkCheckedAt,
+		&databaseTorrentFile.linkFailures,
 	)
 
 	if err != nil {
@@ -91,13 +118,24 @@ func (mediaService *MediaRepository) AddTorrentFile(transaction *sql.Tx, databas
 	return databaseTorrentFile, nil
 }
 
+// Its trash entry goes with it
 func (mediaService *MediaRepository) RemoveTorrentFile(transaction *sql.Tx, torrentFile *TorrentFile) error {
 	query := `
+	DELETE FROM trash_entries
+	WHERE torrent_file_id = ?;
+	`
+
+	_, err := transaction.Exec(query, torrentFile.identifier)
+	if err != nil {
+		return mediaService.error("Failed to delete data", err)
+	}
+
+	query = `
 	DELETE FROM torrent_files
 	WHERE id = ?;
 	`
 
-	_, err := transaction.Exec(query, torrentFile.identifier)
+	_, err = transaction.Exec(query, torrentFile.identifier)
 	if err != nil {
 		return mediaService.error("Failed to delete data", err)
 	}
@@ -107,12 +145,78 @@ func (mediaService *MediaRepository) RemoveTorrentFile(transaction *sql.Tx, torr
 
 func (mediaService *MediaRepository) GetTorrentFiles(torrent *Torrent) ([]*TorrentFile, error) {
 	query := `
-	SELECT id, torrent_id, path, size, link, file_index, file_node_id
+	SELECT id, torrent_id, path, size, link, file_index, file_node_id, link_checked_at, link_failures
 	FROM torrent_files
 	WHERE torrent_id = ?
 	`
 
-	rows, err := mediaService.database.Query(query, torrent.identifier)
+	return mediaService.queryTorrentFiles(query, torrent.identifier)
+}
+
+// Files whose link was not unrestricted since before, least recently checked first
+func (mediaService *MediaRepository) GetTorrentFilesCheckedBefore(before time.Time, limit int) ([]*TorrentFile, error) {
+	query := `
+	SELECT id, torrent_id, path, size, link, file_index, file_node_id, link_checked_at, link_failures
+	FROM torrent_files
+	WHERE link_checked_at < ?
+	ORDER BY link_checked_at, id
+	LIMIT ?
+	`
+
+	return mediaService.queryTorrentFiles(query, before.Unix(), limit)
+}
+
+// Points the file at a new link of its torrent, the health of the old link no longer applies
+func (mediaService *MediaRepository) UpdateTorrentFileLink(transaction *sql.Tx, torrentFile *TorrentFile, link string, index int) error {
+	query := `
+	UPDATE torrent_files
+	SET link = ?, file_index = ?, link_checked_at = 0, link_failures = 0
+	WHERE id = ?;
+	`
+
+	_, err := transaction.Exec(query, link, index, torrentFile.identifier)
+	if err != nil {
+		return mediaService.error("Failed to update data", err)
+	}
+
+	return nil
+}
+
+// Records the outcome of unrestricting a link for every file using it
+func (mediaService *MediaRepository) SetLinkHealth(link string, healthy bool) error {
+	query := `
+	UPDATE torrent_files
+	SET link_checked_at = ?, link_failures = CASE WHEN ? THEN 0 ELSE link_failures + 1 END
+	WHERE link = ?;
+	`
+
+	_, err := mediaService.database.Exec(query, time.Now().Unix(), healthy, link)
+	if err != nil {
+		return mediaService.error("Failed to update data", err)
+	}
+
+	return nil
+}
+
+// Records that the link was tried without telling whether it works, e.g. when its hoster is down
+// The failures are kept as they were, so the link moves to the back of the checks without counting as dead
+func (mediaService *MediaRepository) SetLinkChecked(link string) error {
+	query := `
+	UPDATE torrent_files
+	SET link_checked_at = ?
+	WHERE link = ?;
+	`
+
+	_, err := mediaService.database.Exec(query, time.Now().Unix(), link)
+	if err != nil {
+		return mediaService.error("Failed to update data", err)
+	}
+
+	return nil
+}
+
+func (mediaService *MediaRepository) queryTorrentFiles(query string, args ...any) ([]*TorrentFile, error) {
+	rows, err := mediaService.database.Query(query, args...)
 	if err != nil {
 		return nil, mediaService.error("Failed to query data", err)
 	}
@@ -130,6 +234,8 @@ func (mediaService *MediaRepository) GetTorrentFiles(torrent *Torrent) ([]*Torre
 			&torrentFile.link,
 			&torrentFile.torrentFileIndex,
 			&torrentFile.fsNodeIdentifier,
+			&torrentFile.linkCheckedAt,
+			&torrentFile.linkFailures,
 		)
 
 		if err != nil {
@@ -139,5 +245,5 @@ func (mediaService *MediaRepository) GetTorrentFiles(torrent *Torrent) ([]*Torre
 		torrentFiles = append(torrentFiles, torrentFile)
 	}
 
-	return torrentFiles, nil
+	return torrentFiles, rows.Err()
 }
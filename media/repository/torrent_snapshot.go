@@ -0,0 +1,232 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"debrid_drive/provider"
+)
+
+// Last known state of a torrent in the debrid account
+type TorrentSnapshot struct {
+	torrentIdentifier string
+	name              string
+	status            string
+	bytes             int
+	added             string
+}
+
+func (snapshot *TorrentSnapshot) GetTorrentIdentifier() string {
+	return snapshot.torrentIdentifier
+}
+
+func (snapshot *TorrentSnapshot) GetName() string {
+	return snapshot.name
+}
+
+// Whether the torrent changed in a way that matters for reconciliation
+func (snapshot *TorrentSnapshot) Differs(torrent *provider.Torrent) bool {
+	return snapshot.name != torrent.Name ||
+		snapshot.status != torrent.Status ||
+		snapshot.bytes != torrent.Bytes ||
+		snapshot.added != torrent.Added
+}
+
+func (mediaRepository *MediaRepository) GetTorrentSnapshots(account string) (map[string]*TorrentSnapshot, error) {
+	query := `
+	SELECT torrent_id, name, status, bytes, added
+	FROM torrent_snapshots
+	WHERE account = ?
+	`
+
+	rows, err := mediaRepository.database.Query(query, account)
+	if err != nil {
+		return nil, mediaRepository.error("Failed to query data", err)
+	}
+	defer rows.Close()
+
+	snapshots := make(map[string]*TorrentSnapshot)
+	for rows.Next() {
+		snapshot := &TorrentSnapshot{}
+
+		err := rows.Scan(&snapshot.torrentIdentifier, &snapshot.name, &snapshot.status, &snapshot.bytes, &snapshot.added)
+		if err != nil {
+			return nil, mediaRepository.error("Failed to scan data", err)
+		}
+
+		snapshots[snapshot.torrentIdentifier] = snapshot
+	}
+
+	return snapshots, rows.Err()
+}
+
+func (mediaRepository *MediaRepository) SaveTorrentSnapshot(transaction *sql.Tx, account string, torrent *provider.Torrent) error {
+	query := `
+	INSERT INTO torrent_snapshots (torrent_id, name, status, bytes, added, account)
+	VALUES (?, ?, ?, ?, ?, ?)
+	ON CONFLICT(account, torrent_id) DO UPDATE SET
+		name = excluded.name,
+		status = excluded.status,
+		bytes = excluded.bytes,
+		added = excluded.added;
+	`
+
+	_, err := transaction.Exec(query, torrent.ID, torrent.Name, torrent.Status, torrent.Bytes, torrent.Added, account)
+	if err != nil {
+		return mediaRepository.error("Failed to save data", err)
+	}
+
+	return nil
+}
+
+func (mediaRepository *MediaRepository) RemoveTorrentSnapshot(transaction *sql.Tx, account string, torrentIdentifier string) error {
+	query := `
+	DELETE FROM torrent_snapshots
+	WHERE account = ?
+	AND torrent_id = ?;
+	`
+
+	_, err := transaction.Exec(query, account, torrentIdentifier)
+	if err != nil {
+		return mediaRepository.error("Failed to delete data", err)
+	}
+
+	return nil
+}
+
+// Downloaded torrents in the snapshot that are not added yet, and not rejected unless the rejection is due for a retry
+const pendingTorrentSnapshotsQuery = `
+	FROM torrent_snapshots
+	LEFT JOIN torrents ON torrents.torrent_id = torrent_snapshots.torrent_id AND torrents.account = torrent_snapshots.account
+	LEFT JOIN rejected_torrents ON rejected_torrents.torrent_id = torrent_snapshots.torrent_id AND rejected_torrents.account = torrent_snapshots.account
+	WHERE torrent_snapshots.account = ?
+	AND torrent_snapshots.status = ?
+	AND torrent_snapshots.bytes > 0
+	AND torrents.id IS NULL
+	AND (
+		rejected_torrents.id IS NULL
+		OR (rejected_torrents.retry_at IS NOT NULL AND rejected_torrents.retry_at <= ?)
+	)
+`
+
+func (mediaRepository *MediaRepository) GetPendingTorrentSnapshots(account string) ([]*TorrentSnapshot, error) {
+	query := `
+	SELECT torrent_snapshots.torrent_id, torrent_snapshots.name, torrent_snapshots.status, torrent_snapshots.bytes, torrent_snapshots.added
+	` + pendingTorrentSnapshotsQuery
+
+	rows, err := mediaRepository.database.Query(query, account, provider.StatusDownloaded, time.Now().Unix())
+	if err != nil {
+		return nil, mediaRepository.error("Failed to query data", err)
+	}
+	defer rows.Close()
+
+	snapshots := make([]*TorrentSnapshot, 0)
+	for rows.Next() {
+		snapshot := &TorrentSnapshot{}
+
+		err := rows.Scan(&snapshot.torrentIdentifier, &snapshot.name, &snapshot.status, &snapshot.bytes, &snapshot.added)
+		if err != nil {
+			return nil, mediaRepository.error("Failed to scan data", err)
+		}
+
+		snapshots = append(snapshots, snapshot)
+	}
+
+	return snapshots, rows.Err()
+}
+
+// Whether the account has torrents waiting to be added, e.g. a rejection that is due for a retry
+func (mediaRepository *MediaRepository) HasPendingTorrentSnapshots(account string) (bool, error) {
+	query := `SELECT EXISTS(SELECT 1 ` + pendingTorrentSnapshotsQuery + `)`
+
+	var exists int
+	err := mediaRepository.database.QueryRow(query, account, provider.StatusDownloaded, time.Now().Unix()).Scan(&exists)
+	if err != nil {
+		return false, mediaRepository.error("Failed to query data", err)
+	}
+
+	return exists == 1, nil
+}
+
+// Torrents that are no longer in the debrid account
+func (mediaRepository *MediaRepository) GetTorrentsMissingFromSnapshot(account string) ([]*Torrent, error) {
+	query := `
+	SELECT torrents.id, torrents.torrent_id, torrents.name, torrents.account
+	FROM torrents
+	LEFT JOIN torrent_snapshots ON torrent_snapshots.torrent_id = torrents.torrent_id AND torrent_snapshots.account = torrents.account
+	WHERE torrents.account = ?
+	AND torrent_snapshots.torrent_id IS NULL
+	`
+
+	return mediaRepository.queryTorrents(query, account)
+}
+
+func (mediaRepository *MediaRepository) GetTorrentsWithoutFiles(account string) ([]*Torrent, error) {
+	query := `
+	SELECT torrents.id, torrents.torrent_id, torrents.name, torrents.account
+	FROM torrents
+	WHERE torrents.account = ?
+	AND NOT EXISTS (
+		SELECT 1 FROM torrent_files WHERE torrent_files.torrent_id = torrents.id
+	)
+	`
+
+	return mediaRepository.queryTorrents(query, account)
+}
+
+// Torrent files of the account whose node no longer exists in the file system database
+func (mediaRepository *MediaRepository) GetOrphanedTorrentFiles(account string, fileSystemPath string) ([]*TorrentFile, error) {
+	ctx := context.Background()
+
+	// ATTACH only applies to a single connection, so pin one for the whole query
+	connection, err := mediaRepository.database.Conn(ctx)
+	if err != nil {
+		return nil, mediaRepository.error("Failed to get connection", err)
+	}
+	defer connection.Close()
+
+	_, err = connection.ExecContext(ctx, "ATTACH DATABASE ? AS file_system", fileSystemPath)
+	if err != nil {
+		return nil, mediaRepository.error("Failed to attach file system database", err)
+	}
+	defer connection.ExecContext(ctx, "DETACH DATABASE file_system")
+
+	query := `
+	SELECT torrent_files.id, torrent_files.torrent_id, torrent_files.path, torrent_files.size, torrent_files.link, torrent_files.file_index, torrent_files.file_node_id
+	FROM torrent_files
+	JOIN torrents ON torrents.id = torrent_files.torrent_id
+	LEFT JOIN file_system.nodes ON file_system.nodes.id = torrent_files.file_node_id
+	WHERE torrents.account = ?
+	AND file_system.nodes.id IS NULL
+	`
+
+	rows, err := connection.QueryContext(ctx, query, account)
+	if err != nil {
+		return nil, mediaRepository.error("Failed to query data", err)
+	}
+	defer rows.Close()
+
+	torrentFiles := make([]*TorrentFile, 0)
+	for rows.Next() {
+		torrentFile := &TorrentFile{}
+
+		err := rows.Scan(
+			&torrentFile.identifier,
+			&torrentFile.torrentIdentifier,
+			&torrentFile.path,
+			&torrentFile.size,
+			&torrentFile.link,
+			&torrentFile.torrentFileIndex,
+			&torrentFile.fsNodeIdentifier,
+		)
+
+		if err != nil {
+			return nil, mediaRepository.error("Failed to scan data", err)
+		}
+
+		torrentFiles = append(torrentFiles, torrentFile)
+	}
+
+	return torrentFiles, rows.Err()
+}
@@ -0,0 +1,245 @@
+package repository
+
+import (
+	"database/sql"
+	"time"
+)
+
+// A torrent file that was removed through the file system and waits in the trash
+type TrashEntry struct {
+	identifier            uint64
+	torrentFileIdentifier uint64
+	fsNodeIdentifier      uint64
+	torrentIdentifier     string
+	account               string
+	originalDirectory     string
+	originalName          string
+	trashedAt             time.Time
+	restoreRequested      bool
+}
+
+func (trashEntry *TrashEntry) GetIdentifier() uint64 {
+	return trashEntry.identifier
+}
+
+func (trashEntry *TrashEntry) GetTorrentFileIdentifier() uint64 {
+	return trashEntry.torrentFileIdentifier
+}
+
+func (trashEntry *TrashEntry) GetFileIdentifier() uint64 {
+	return trashEntry.fsNodeIdentifier
+}
+
+// Debrid id of the torrent the file belongs to
+func (trashEntry *TrashEntry) GetTorrentIdentifier() string {
+	return trashEntry.torrentIdentifier
+}
+
+func (trashEntry *TrashEntry) GetAccount() string {
+	return trashEntry.account
+}
+
+// Path of the directory the file was removed from
+func (trashEntry *TrashEntry) GetOriginalDirectory() string {
+	return trashEntry.originalDirectory
+}
+
+func (trashEntry *TrashEntry) GetOriginalName() string {
+	return trashEntry.originalName
+}
+
+func (trashEntry *TrashEntry) GetOriginalPath() string {
+	if trashEntry.originalDirectory == "/" {
+		return "/" + trashEntry.originalName
+	}
+
+	return trashEntry.originalDirectory + "/" + trashEntry.originalName
+}
+
+func (trashEntry *TrashEntry) GetTrashedAt() time.Time {
+	return trashEntry.trashedAt
+}
+
+func (trashEntry *TrashEntry) IsRestoreRequested() bool {
+	return trashEntry.restoreRequested
+}
+
+const trashEntryColumns = `
+	trash_entries.id, trash_entries.torrent_file_id, torrent_files.file_node_id, torrents.torrent_id, torrents.account,
+	trash_entries.original_directory, trash_entries.original_name, trash_entries.trashed_at, trash_entries.restore_requested
+`
+
+func (mediaRepository *MediaRepository) GetTrashEntries() ([]*TrashEntry, error) {
+	query := `
+	SELECT ` + trashEntryColumns + `
+	FROM trash_entries
+	JOIN torrent_files ON torrent_files.id = trash_entries.torrent_file_id
+	JOIN torrents ON torrents.id = torrent_files.torrent_id
+	ORDER BY trash_entries.trashed_at, trash_entries.id
+	`
+
+	return mediaRepository.queryTrashEntries(query)
+}
+
+// Entries trashed before the given time, whose torrent also has files outside the trash
+func (mediaRepository *MediaRepository) GetPartialTrashEntriesBefore(before time.Time) ([]*TrashEntry, error) {
+	query := `
+	SELECT ` + trashEntryColumns + `
+	FROM trash_entries
+	JOIN torrent_files ON torrent_files.id = trash_entries.torrent_file_id
+	JOIN torrents ON torrents.id = torrent_files.torrent_id
+	WHERE trash_entries.trashed_at <= ?
+	AND EXISTS (
+		SELECT 1 FROM torrent_files AS siblings
+		LEFT JOIN trash_entries AS sibling_entries ON sibling_entries.torrent_file_id = siblings.id
+		WHERE siblings.torrent_id = torrents.id AND sibling_entries.id IS NULL
+	)
+	ORDER BY trash_entries.trashed_at, trash_entries.id
+	`
+
+	return mediaRepository.queryTrashEntries(query, before.Unix())
+}
+
+func (mediaRepository *MediaRepository) queryTrashEntries(query string, args ...any) ([]*TrashEntry, error) {
+	rows, err := mediaRepository.database.Query(query, args...)
+	if err != nil {
+		return nil, mediaRepository.error("Failed to query data", err)
+	}
+	defer rows.Close()
+
+	trashEntries := make([]*TrashEntry, 0)
+	for rows.Next() {
+		trashEntry := &TrashEntry{}
+
+		var trashedAt int64
+
+		err := rows.Scan(
+			&trashEntry.identifier,
+			&trashEntry.torrentFileIdentifier,
+			&trashEntry.fsNodeIdentifier,
+			&trashEntry.torrentIdentifier,
+			&trashEntry.account,
+			&trashEntry.originalDirectory,
+			&trashEntry.originalName,
+			&trashedAt,
+			&trashEntry.restoreRequested,
+		)
+		if err != nil {
+			return nil, mediaRepository.error("Failed to scan data", err)
+		}
+
+		trashEntry.trashedAt = time.Unix(trashedAt, 0)
+
+		trashEntries = append(trashEntries, trashEntry)
+	}
+
+	return trashEntries, rows.Err()
+}
+
+func (mediaRepository *MediaRepository) TorrentFileTrashed(torrentFile *TorrentFile) (bool, error) {
+	query := `
+	SELECT EXISTS(SELECT 1 FROM trash_entries WHERE torrent_file_id = ?)
+	`
+
+	var exists int
+	err := mediaRepository.database.QueryRow(query, torrentFile.identifier).Scan(&exists)
+	if err != nil {
+		return false, err
+	}
+
+	return exists == 1, nil
+}
+
+// Torrents whose files are all in the trash since before the given time
+func (mediaRepository *MediaRepository) GetTorrentsTrashedBefore(before time.Time) ([]*Torrent, error) {
+	query := `
+	SELECT torrents.id, torrents.torrent_id, torrents.name, torrents.account
+	FROM torrents
+	WHERE EXISTS (
+		SELECT 1 FROM torrent_files
+		WHERE torrent_files.torrent_id = torrents.id
+	)
+	AND NOT EXISTS (
+		SELECT 1 FROM torrent_files
+		LEFT JOIN trash_entries ON trash_entries.torrent_file_id = torrent_files.id
+		WHERE torrent_files.torrent_id = torrents.id
+		AND (trash_entries.id IS NULL OR trash_entries.trashed_at > ?)
+	)
+	`
+
+	return mediaRepository.queryTorrents(query, before.Unix())
+}
+
+// Returns the id of the new entry
+func (mediaRepository *MediaRepository) AddTrashEntry(transaction *sql.Tx, torrentFile *TorrentFile, directory string, name string) (uint64, error) {
+	query := `
+	INSERT INTO trash_entries (torrent_file_id, original_directory, original_name, trashed_at)
+	VALUES (?, ?, ?, ?)
+	`
+
+	result, err := transaction.Exec(query, torrentFile.identifier, directory, name, time.Now().Unix())
+	if err != nil {
+		return 0, mediaRepository.error("Failed to insert data", err)
+	}
+
+	identifier, err := result.LastInsertId()
+	if err != nil {
+		return 0, mediaRepository.error("Failed to get inserted id", err)
+	}
+
+	return uint64(identifier), nil
+}
+
+func (mediaRepository *MediaRepository) RemoveTrashEntry(transaction *sql.Tx, identifier uint64) error {
+	query := `
+	DELETE FROM trash_entries
+	WHERE id = ?;
+	`
+
+	_, err := transaction.Exec(query, identifier)
+	if err != nil {
+		return mediaRepository.error("Failed to delete data", err)
+	}
+
+	return nil
+}
+
+// Restoring is left to the running server, e.g. the admin command only asks for it
+func (mediaRepository *MediaRepository) SetTrashRestoreRequested(trashEntry *TrashEntry, requested bool) error {
+	_, err := mediaRepository.database.Exec("UPDATE trash_entries SET restore_requested = ? WHERE id = ?", requested, trashEntry.identifier)
+	if err != nil {
+		return mediaRepository.error("Failed to update data", err)
+	}
+
+	return nil
+}
+
+// Asks for the given entries to be restored, or all of them when none are given
+func (mediaRepository *MediaRepository) RequestTrashRestores(identifiers []uint64) (int64, error) {
+	if len(identifiers) == 0 {
+		result, err := mediaRepository.database.Exec("UPDATE trash_entries SET restore_requested = 1")
+		if err != nil {
+			return 0, mediaRepository.error("Failed to update data", err)
+		}
+
+		return result.RowsAffected()
+	}
+
+	var count int64
+
+	for _, identifier := range identifiers {
+		result, err := mediaRepository.database.Exec("UPDATE trash_entries SET restore_requested = 1 WHERE id = ?", identifier)
+		if err != nil {
+			return count, mediaRepository.error("Failed to update data", err)
+		}
+
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return count, err
+		}
+
+		count += affected
+	}
+
+	return count, nil
+}
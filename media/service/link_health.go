@@ -0,0 +1,211 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"debrid_drive/account"
+	"debrid_drive/config"
+	"debrid_drive/logger"
+	"debrid_drive/provider"
+
+	media_repository "debrid_drive/media/repository"
+)
+
+// 1. Unrestrict the link with the account that owns the torrent
+// 2. When the link is dead or unconfirmed, get the current links of the torrent and store them
+// 3. Unrestrict the refreshed link once
+// The health of every link tried is recorded, when the provider couldn't tell a dead link from an outage only the check is
+// The link that worked is returned with the download
+func (instance *MediaService) unrestrictTorrentFile(torrentFile *media_repository.TorrentFile) (string, *provider.Download, error) {
+	link := torrentFile.GetLink()
+
+	// Links can only be unrestricted by the account that owns the torrent
+	torrent, err := instance.mediaRepository.GetTorrentByTorrentFileId(torrentFile.GetIdentifier())
+	if err != nil {
+		return "", nil, instance.error("Failed to get torrent of torrent file", err)
+	}
+
+	account, err := instance.getAccount(torrent.GetAccount())
+	if err != nil {
+		return "", nil, instance.error("Failed to get account", err)
+	}
+
+	download, err := account.GetProvider().UnrestrictLink(link)
+
+	// An outage of the hoster is not a failure of the link, it is only dead once the torrent has a new link for the file
+	unconfirmed := errors.Is(err, provider.ErrLinkUnconfirmed)
+	instance.recordLinkCheck(link, err)
+
+	if err == nil {
+		return link, download, nil
+	}
+
+	if !unconfirmed && !errors.Is(err, provider.ErrLinkUnavailable) {
+		return "", nil, instance.error("Failed to unrestrict link", err)
+	}
+
+	instance.logger.Warn("Link is unavailable, refreshing the links of the torrent", logger.TorrentId, torrent.GetTorrentIdentifier(), logger.NodeId, torrentFile.GetFileIdentifier(), "link", link, "error", err)
+
+	link, err = instance.refreshLinks(account, torrent, torrentFile)
+	if err != nil {
+		return "", nil, instance.error("Failed to refresh unavailable link", err)
+	}
+
+	download, err = account.GetProvider().UnrestrictLink(link)
+	instance.recordLinkCheck(link, err)
+
+	if err != nil {
+		return "", nil, instance.error("Failed to unrestrict refreshed link", err)
+	}
+
+	return link, download, nil
+}
+
+// Records the outcome of unrestricting the link, an unconfirmed link is only marked as checked
+func (instance *MediaService) recordLinkCheck(link string, err error) {
+	if errors.Is(err, provider.ErrLinkUnconfirmed) {
+		err = instance.mediaRepository.SetLinkChecked(link)
+	} else {
+		err = instance.mediaRepository.SetLinkHealth(link, err == nil)
+	}
+
+	if err != nil {
+		instance.logger.Error("Failed to record link health", err)
+	}
+}
+
+// Maps the current links of the torrent onto its stored files and returns the new link of the torrent file
+// Stored files keep their link when the torrent no longer has one for them
+func (instance *MediaService) refreshLinks(account *account.Account, torrent *media_repository.Torrent, torrentFile *media_repository.TorrentFile) (string, error) {
+	torrentInfo, err := account.GetProvider().GetTorrentInfo(torrent.GetTorrentIdentifier())
+	if err != nil {
+		return "", fmt.Errorf("Failed to get torrent info: %w", err)
+	}
+
+	selectedFiles := make([]provider.TorrentFile, 0)
+	for _, file := range torrentInfo.Files {
+		if file.Selected {
+			selectedFiles = append(selectedFiles, file)
+		}
+	}
+
+	linkedFiles, err := instance.linkFiles(account, torrentInfo, selectedFiles)
+	if err != nil {
+		return "", err
+	}
+
+	linkedPaths := make(map[string]linkedFile, len(linkedFiles))
+	for _, linkedFile := range linkedFiles {
+		linkedPaths[linkedFile.file.Path] = linkedFile
+	}
+
+	storedFiles, err := instance.mediaRepository.GetTorrentFiles(torrent)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get torrent files: %w", err)
+	}
+
+	transaction, err := instance.NewTransaction()
+	if err != nil {
+		return "", fmt.Errorf("Failed to begin transaction: %w", err)
+	}
+	defer transaction.Rollback()
+
+	updatedFiles := make([]*media_repository.TorrentFile, 0)
+
+	for _, storedFile := range storedFiles {
+		linkedFile, ok := linkedPaths[storedFile.GetPath()]
+		if !ok || linkedFile.link == storedFile.GetLink() {
+			continue
+		}
+
+		err = instance.invalidateStreamUrl(transaction, storedFile)
+		if err != nil {
+			return "", err
+		}
+
+		err = instance.mediaRepository.UpdateTorrentFileLink(transaction, storedFile, linkedFile.link, linkedFile.index)
+		if err != nil {
+			return "", err
+		}
+
+		instance.saveStreamUrl(transaction, linkedFile)
+
+		updatedFiles = append(updatedFiles, storedFile)
+	}
+
+	err = transaction.Commit()
+	if err != nil {
+		return "", fmt.Errorf("Failed to commit transaction: %w", err)
+	}
+
+	instance.ForgetStreamUrls(updatedFiles)
+
+	instance.logger.Info(fmt.Sprintf("Refreshed %d links", len(updatedFiles)), logger.TorrentId, torrent.GetTorrentIdentifier())
+
+	linkedFile, ok := linkedPaths[torrentFile.GetPath()]
+	if !ok {
+		return "", fmt.Errorf("Torrent %s no longer has a link for %s", torrent.GetTorrentIdentifier(), torrentFile.GetPath())
+	}
+
+	if linkedFile.link == torrentFile.GetLink() {
+		return "", fmt.Errorf("Torrent %s still has the same link for %s", torrent.GetTorrentIdentifier(), torrentFile.GetPath())
+	}
+
+	return linkedFile.link, nil
+}
+
+// Unrestricts links that were not checked within the max age, so dead links are refreshed before someone streams them
+// The resulting stream urls are cached like any other
+func (instance *MediaService) CheckLinks(ctx context.Context) error {
+	checkedBefore := time.Now().Add(-config.GetLinkCheckMaxAge())
+
+	torrentFiles, err := instance.mediaRepository.GetTorrentFilesCheckedBefore(checkedBefore, config.GetLinkCheckBatchSize())
+	if err != nil {
+		return instance.error("Failed to get torrent files to check", err)
+	}
+
+	failed := 0
+
+	for _, torrentFile := range torrentFiles {
+		if ctx.Err() != nil {
+			break
+		}
+
+		// Shares the call with players asking for the same link
+		_, err := instance.streamUrls.do(torrentFile.GetLink(), func() (*media_repository.StreamUrl, error) {
+			return instance.newStreamUrl(torrentFile)
+		})
+
+		if err != nil {
+			failed++
+		}
+	}
+
+	if len(torrentFiles) > 0 {
+		instance.logger.Info(fmt.Sprintf("Checked %d links, %d failed", len(torrentFiles), failed))
+	}
+
+	return nil
+}
+
+// Runs CheckLinks every link check interval until the context is done, the interval is read again after every run
+func (instance *MediaService) StartLinkCheck(ctx context.Context) {
+	for {
+		interval := config.GetLinkCheckInterval()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+
+		if !config.GetLinkCheckEnabled() {
+			continue
+		}
+
+		instance.CheckLinks(ctx)
+	}
+}
@@ -0,0 +1,121 @@
+package service
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+
+	"debrid_drive/account"
+	"debrid_drive/config"
+	"debrid_drive/logger"
+	"debrid_drive/provider"
+)
+
+// Archives and the parts of split archives, e.g. .rar, .part2.rar, .r00, .7z.001
+var archivePattern = regexp.MustCompile(`(?i)\.(rar|zip|7z|r\d{2}|\d{3})$`)
+
+// A file to list along with the link it streams from and the index of that link
+// Download is set when the link was unrestricted to find the file behind it
+type linkedFile struct {
+	file     provider.TorrentFile
+	link     string
+	index    int
+	download *provider.Download
+}
+
+func isArchive(filename string) bool {
+	return archivePattern.MatchString(filename)
+}
+
+// Maps the links of a torrent onto its selected files
+// With a link per file they are in the same order, with fewer links every link is unrestricted to find the file behind it
+// Files without a link of their own are packed in an archive, which is listed as a single file depending on the archive policy
+func (instance *MediaService) linkFiles(account *account.Account, torrentInfo *provider.TorrentInfo, selectedFiles []provider.TorrentFile) ([]linkedFile, error) {
+	if len(selectedFiles) <= len(torrentInfo.Links) {
+		linkedFiles := make([]linkedFile, 0, len(selectedFiles))
+
+		for index, torrentFile := range selectedFiles {
+			linkedFiles = append(linkedFiles, linkedFile{file: torrentFile, link: torrentInfo.Links[index], index: index})
+		}
+
+		return linkedFiles, nil
+	}
+
+	// Keyed by full path, files with the same name in different folders are told apart in matchFile
+	unlinked := make(map[string]provider.TorrentFile, len(selectedFiles))
+	for _, torrentFile := range selectedFiles {
+		unlinked[torrentFile.Path] = torrentFile
+	}
+
+	linkedFiles := make([]linkedFile, 0, len(torrentInfo.Links))
+	archives := 0
+
+	for index, link := range torrentInfo.Links {
+		download, err := account.GetProvider().UnrestrictLink(link)
+		if err != nil {
+			return nil, TorrentRejectedError{Reason: RejectionInfoUnavailable, Err: fmt.Errorf("Failed to unrestrict link %s: %w", link, err)}
+		}
+
+		if torrentFile, ok := instance.matchFile(torrentInfo, selectedFiles, unlinked, download); ok {
+			delete(unlinked, torrentFile.Path)
+			linkedFiles = append(linkedFiles, linkedFile{file: torrentFile, link: link, index: index, download: download})
+			continue
+		}
+
+		if !isArchive(download.Filename) {
+			instance.logger.Warn("Link does not match a selected file", logger.TorrentId, torrentInfo.ID, "link", link, "filename", download.Filename)
+			continue
+		}
+
+		if config.GetArchivePolicy() == config.ArchivePolicyReject {
+			return nil, TorrentRejectedError{Reason: RejectionArchive, Err: fmt.Errorf("Link %s is an archive: %s", link, download.Filename)}
+		}
+
+		archives++
+
+		archive := provider.TorrentFile{Path: "/" + download.Filename, Bytes: download.Bytes}
+		linkedFiles = append(linkedFiles, linkedFile{file: archive, link: link, index: index, download: download})
+	}
+
+	if len(unlinked) > 0 {
+		if archives == 0 {
+			return nil, TorrentRejectedError{
+				Reason: RejectionMissingLinks,
+				Err:    fmt.Errorf("%d selected files have no link", len(unlinked)),
+			}
+		}
+
+		instance.logger.Info(fmt.Sprintf("Listing %d archives instead of %d packed files", archives, len(unlinked)), logger.TorrentId, torrentInfo.ID)
+	}
+
+	return linkedFiles, nil
+}
+
+// Finds the unlinked file behind a download, which only has a filename
+// With several files of that name the one with the same size wins, otherwise the first in order as links follow the order of the files
+func (instance *MediaService) matchFile(torrentInfo *provider.TorrentInfo, selectedFiles []provider.TorrentFile, unlinked map[string]provider.TorrentFile, download *provider.Download) (provider.TorrentFile, bool) {
+	candidates := make([]provider.TorrentFile, 0, 1)
+	for _, torrentFile := range selectedFiles {
+		if _, ok := unlinked[torrentFile.Path]; ok && path.Base(torrentFile.Path) == download.Filename {
+			candidates = append(candidates, torrentFile)
+		}
+	}
+
+	if len(candidates) == 0 {
+		return provider.TorrentFile{}, false
+	}
+
+	if len(candidates) == 1 {
+		return candidates[0], true
+	}
+
+	for _, candidate := range candidates {
+		if candidate.Bytes == download.Bytes {
+			return candidate, true
+		}
+	}
+
+	instance.logger.Warn("Several files match the link, picking the first", logger.TorrentId, torrentInfo.ID, "filename", download.Filename, "path", candidates[0].Path)
+
+	return candidates[0], true
+}
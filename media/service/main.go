@@ -3,16 +3,20 @@ package service
 import (
 	"database/sql"
 	"fmt"
+	"io/fs"
+	"strings"
+	"sync"
 	"syscall"
 
+	"debrid_drive/account"
 	"debrid_drive/config"
 	"debrid_drive/database"
+	"debrid_drive/filesystem/symlink"
 	"debrid_drive/logger"
+	"debrid_drive/provider"
 
 	media_repository "debrid_drive/media/repository"
 
-	real_debrid "github.com/sushydev/real_debrid_go"
-	real_debrid_api "github.com/sushydev/real_debrid_go/api"
 	"github.com/sushydev/vfs_go"
 	"github.com/sushydev/vfs_go/interfaces"
 	filesystem_interfaces "github.com/sushydev/vfs_go/interfaces"
@@ -20,27 +24,23 @@ import (
 )
 
 type MediaService struct {
-	client          *real_debrid.Client
+	accounts        map[string]*account.Account
 	database        *database.Instance
 	fileSystem      *filesystem.FileSystem
+	symlinks        *symlink.Resolver
 	mediaRepository *media_repository.MediaRepository
 	logger          *logger.Logger
-}
-
-// create new error type named RejectedError
-
-var _ error = TorrentRejectedError{}
+	streamUrls      *streamUrlCache
 
-type TorrentRejectedError struct{}
-
-func (TorrentRejectedError) Error() string {
-	return "Rejected"
+	// Accounts share the database and the file system, so only one of them reconciles at a time and not while the trash is checked
+	reconciliation sync.Mutex
 }
 
 func NewMediaService(
-	client *real_debrid.Client,
+	accounts []*account.Account,
 	database *database.Instance,
 	fileSystem *filesystem.FileSystem,
+	symlinks *symlink.Resolver,
 	mediaRepository *media_repository.MediaRepository,
 ) *MediaService {
 	logger, err := logger.NewLogger("Media Service")
@@ -48,47 +48,125 @@ func NewMediaService(
 		panic(err)
 	}
 
+	// Naming is read when a torrent is added, so a change applies to new torrents only
+	config.Subscribe(func(previous config.Config, next config.Config) {
+		if previous.UseFilenameInLister != next.UseFilenameInLister || previous.UseIdInFilenameLister != next.UseIdInFilenameLister {
+			logger.Info("Lister naming changed, it applies to newly added torrents")
+		}
+	})
+
+	accountMap := make(map[string]*account.Account, len(accounts))
+	for _, account := range accounts {
+		accountMap[account.GetName()] = account
+	}
+
 	return &MediaService{
-		client:          client,
+		accounts:        accountMap,
 		database:        database,
 		fileSystem:      fileSystem,
+		symlinks:        symlinks,
 		mediaRepository: mediaRepository,
 		logger:          logger,
+		streamUrls:      newStreamUrlCache(),
 	}
 }
 
+// Held for the whole reconciliation of an account
+func (instance *MediaService) LockReconciliation() {
+	instance.reconciliation.Lock()
+}
+
+func (instance *MediaService) UnlockReconciliation() {
+	instance.reconciliation.Unlock()
+}
+
 func (instance *MediaService) error(message string, err error) error {
 	instance.logger.Error(message, err)
 	return fmt.Errorf("%s\n%w", message, err)
 }
 
-func (instance *MediaService) GetManagerDirectory() (filesystem_interfaces.Node, error) {
+// Directory of the account in the file system, missing directories along its path are created
+func (instance *MediaService) GetManagerDirectory(account *account.Account) (filesystem_interfaces.Node, error) {
+	directory, err := instance.findOrCreatePath(account.GetDirectory())
+	if err != nil {
+		return nil, instance.error("Failed to find media manager directory", err)
+	}
+
+	return directory, nil
+}
+
+// Directory at the slash separated path from the root, missing directories along it are created
+func (instance *MediaService) findOrCreatePath(path string) (filesystem_interfaces.Node, error) {
 	root, err := service.GetRoot(instance.fileSystem)
 	if err != nil {
-		return nil, instance.error("Failed to get root directory", err)
+		return nil, fmt.Errorf("Failed to get root directory: %w", err)
 	}
 
-	mediaManager, err := instance.fileSystem.Lookup(root.GetId(), "media_manager")
-	switch err {
-	case nil:
-		return mediaManager, nil
-	case syscall.ENOENT:
-		instance.logger.Info("Creating new media manager directory")
+	directory := root
 
-		err = instance.fileSystem.MkDir(root.GetId(), "media_manager")
+	for _, name := range strings.Split(path, "/") {
+		if name == "" {
+			continue
+		}
+
+		node, err := instance.fileSystem.Lookup(directory.GetId(), name)
+		switch err {
+		case nil:
+			directory = node
+			continue
+		case syscall.ENOENT:
+		default:
+			return nil, err
+		}
+
+		instance.logger.Info(fmt.Sprintf("Creating new directory: %s", name))
+
+		err = instance.fileSystem.MkDir(directory.GetId(), name)
 		if err != nil {
-			return nil, instance.error("Failed to create media manager directory", err)
+			return nil, err
 		}
 
-		mediaManager, err = instance.fileSystem.Lookup(root.GetId(), "media_manager")
+		node, err = instance.fileSystem.Lookup(directory.GetId(), name)
 		if err != nil {
-			return nil, instance.error("Failed to find media manager directory", err)
+			return nil, err
 		}
 
-		return mediaManager, nil
-	default:
-		return nil, instance.error("Failed to find media manager directory", err)
+		directory = node
 	}
+
+	if directory.GetMode() != fs.ModeDir {
+		return nil, fmt.Errorf("%s is not a directory", path)
+	}
+
+	return directory, nil
+}
+
+// Slash separated path of the node from the root, parents are followed since paths of nodes in renamed directories are not updated
+func (instance *MediaService) pathOf(node filesystem_interfaces.Node) (string, error) {
+	names := make([]string, 0)
+
+	for node.GetId() != 0 {
+		names = append([]string{node.GetName()}, names...)
+
+		parent, err := instance.fileSystem.Open(node.GetParentId())
+		if err != nil {
+			return "", err
+		}
+
+		node = parent
+	}
+
+	return "/" + strings.Join(names, "/"), nil
+}
+
+// Provider of the account a stored torrent belongs to
+func (instance *MediaService) getAccount(accountName string) (*account.Account, error) {
+	account, ok := instance.accounts[accountName]
+	if !ok {
+		return nil, fmt.Errorf("Account %s is not configured", accountName)
+	}
+
+	return account, nil
 }
 
 func (instance *MediaService) NewTransaction() (*sql.Tx, error) {
@@ -115,12 +193,71 @@ func (instance *MediaService) GetTorrentByTorrentFile(torrentFile *media_reposit
 	return torrent, nil
 }
 
-func (instance *MediaService) TorrentExists(torrent *real_debrid_api.Torrent) (bool, error) {
-	return instance.mediaRepository.TorrentExists(torrent.ID)
+func (instance *MediaService) TorrentExists(account *account.Account, torrent *provider.Torrent) (bool, error) {
+	return instance.mediaRepository.TorrentExists(account.GetName(), torrent.ID)
+}
+
+func (instance *MediaService) TorrentRejected(account *account.Account, torrent *provider.Torrent) (bool, error) {
+	return instance.mediaRepository.TorrentRejected(account.GetName(), torrent.ID)
+}
+
+// Whether the account has work that is due without a change in the account
+// Torrents waiting to be added, like rejections that are due or were cleared, and held removals that were confirmed
+func (instance *MediaService) HasPendingTorrents(account *account.Account) bool {
+	pending, err := instance.mediaRepository.HasPendingTorrentSnapshots(account.GetName())
+	if err != nil {
+		instance.logger.Error("Failed to check for pending torrents", err)
+		return false
+	}
+
+	if pending {
+		return true
+	}
+
+	confirmed, err := instance.mediaRepository.HasConfirmedHeldRemovals(account.GetName())
+	if err != nil {
+		instance.logger.Error("Failed to check for confirmed held removals", err)
+		return false
+	}
+
+	return confirmed
 }
 
-func (instance *MediaService) TorrentRejected(torrent *real_debrid_api.Torrent) (bool, error) {
-	return instance.mediaRepository.TorrentRejected(torrent.ID)
+// A torrent with its links mapped onto its files, ready to be added
+type PreparedTorrent struct {
+	torrent     *provider.Torrent
+	linkedFiles []linkedFile
+}
+
+// 1. Get the torrent info, rejecting the torrent when its files can't be listed
+// 2. Map the links onto the selected files, see linkFiles
+// Only the provider is called, so this is done before the transaction of AddTorrent
+func (instance *MediaService) PrepareTorrent(account *account.Account, torrent *provider.Torrent) (*PreparedTorrent, error) {
+	torrentInfo, err := account.GetProvider().GetTorrentInfo(torrent.ID)
+	if err != nil {
+		instance.logger.Error("Failed to get torrent info", err)
+		return nil, TorrentRejectedError{Reason: RejectionInfoUnavailable, Err: err}
+	}
+
+	selectedFiles := make([]provider.TorrentFile, 0)
+	for _, torrentFile := range torrentInfo.Files {
+		if !torrentFile.Selected {
+			continue
+		}
+
+		selectedFiles = append(selectedFiles, torrentFile)
+	}
+
+	if len(selectedFiles) == 0 {
+		return nil, TorrentRejectedError{Reason: RejectionNoSelectedFiles}
+	}
+
+	linkedFiles, err := instance.linkFiles(account, torrentInfo, selectedFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PreparedTorrent{torrent: torrent, linkedFiles: linkedFiles}, nil
 }
 
 // 1. Create directory for torrent
@@ -128,8 +265,11 @@ func (instance *MediaService) TorrentRejected(torrent *real_debrid_api.Torrent)
 // 3. For each file in torrent files:
 // -- 1. Create file for torrent file
 // -- 2. Add torrent file to database
-func (instance *MediaService) AddTorrent(transaction *sql.Tx, torrent *real_debrid_api.Torrent) error {
-	managerDirectory, err := instance.GetManagerDirectory()
+// 4. Clear an earlier rejection
+func (instance *MediaService) AddTorrent(transaction *sql.Tx, account *account.Account, preparedTorrent *PreparedTorrent) error {
+	torrent := preparedTorrent.torrent
+
+	managerDirectory, err := instance.GetManagerDirectory(account)
 	if err != nil {
 		instance.logger.Error("Failed to get new torrents directory", err)
 		return err
@@ -139,12 +279,12 @@ func (instance *MediaService) AddTorrent(transaction *sql.Tx, torrent *real_debr
 
 	if config.GetUseFilenameInLister() {
 		// TODO: This breaks if duplicate media in account
-		torrentDirectory = torrent.Filename
+		torrentDirectory = torrent.Name
 
 		if config.GetUseIdInFilenameLister() {
-			torrentDirectory = fmt.Sprintf("%s [%s]", torrent.Filename, torrent.ID)
+			torrentDirectory = fmt.Sprintf("%s [%s]", torrent.Name, torrent.ID)
 		} else {
-			torrentDirectory = torrent.Filename
+			torrentDirectory = torrent.Name
 		}
 	} else {
 		torrentDirectory = torrent.ID
@@ -156,40 +296,14 @@ func (instance *MediaService) AddTorrent(transaction *sql.Tx, torrent *real_debr
 		return err
 	}
 
-	databaseTorrent, err := instance.mediaRepository.AddTorrent(transaction, torrent)
+	databaseTorrent, err := instance.mediaRepository.AddTorrent(transaction, account.GetName(), torrent)
 	if err != nil {
 		instance.logger.Error("Failed to add torrent to database", err)
 		return err
 	}
 
-	torrentInfo, err := real_debrid_api.GetTorrentInfo(instance.client, torrent.ID)
-	if err != nil {
-		instance.logger.Error("Failed to get torrent info", err)
-		return err
-	}
-
-	selectedFiles := make([]real_debrid_api.TorrentFile, 0)
-	for _, torrentFile := range torrentInfo.Files {
-		if torrentFile.Selected != 1 {
-			continue
-		}
-
-		selectedFiles = append(selectedFiles, torrentFile)
-	}
-
-	if len(selectedFiles) > len(torrentInfo.Links) {
-		return TorrentRejectedError{}
-	}
-
-	for index, torrentFile := range selectedFiles {
-		name := torrentFile.Path[1:]
-
-		if index >= len(torrentInfo.Links) {
-			instance.logger.Error("Link index out of bounds", nil)
-			return err
-		}
-
-		link := torrentInfo.Links[index]
+	for _, linkedFile := range preparedTorrent.linkedFiles {
+		name := linkedFile.file.Path[1:]
 
 		fileNode, err := service.FindOrCreateFile(instance.fileSystem, directory.GetId(), name)
 		if err != nil {
@@ -207,24 +321,24 @@ func (instance *MediaService) AddTorrent(transaction *sql.Tx, torrent *real_debr
 			continue
 		}
 
-		_, err = instance.mediaRepository.AddTorrentFile(transaction, databaseTorrent, torrentFile, fileNode, link, index)
+		_, err = instance.mediaRepository.AddTorrentFile(transaction, databaseTorrent, linkedFile.file, fileNode, linkedFile.link, linkedFile.index)
 		if err != nil {
 			message := fmt.Sprintf("Failed to add torrent file to database: %s", name)
 			instance.logger.Error(message, err)
 			return err
 		}
-	}
 
-	return nil
-}
+		instance.saveStreamUrl(transaction, linkedFile)
+	}
 
-func (instance *MediaService) RejectTorrent(transaction *sql.Tx, torrent *real_debrid_api.Torrent) error {
-	return instance.mediaRepository.RejectTorrent(transaction, torrent)
+	return instance.mediaRepository.RemoveRejectedTorrent(transaction, databaseTorrent.GetAccount(), torrent.ID)
 }
 
-// 1. Remove torrent files
+// 1. Remove torrent files and their cached stream urls
 // 2. Remove torrent from database
 // 3. Remove torrent from API
+// Symlinks to the files and the stream urls kept in memory are left to the caller, see FindSymlinks and ForgetStreamUrls
+// The caller counts the removal once the transaction is committed, see metrics.TorrentRemoved
 func (instance *MediaService) DeleteTorrent(transaction *sql.Tx, torrent *media_repository.Torrent, remote bool) error {
 	var err error
 
@@ -261,58 +375,83 @@ func (instance *MediaService) removeTorrentFiles(transaction *sql.Tx, databaseTo
 	}
 
 	for _, torrentFile := range torrentFiles {
-		err = instance.mediaRepository.RemoveTorrentFile(transaction, torrentFile)
+		err = instance.removeTorrentFile(transaction, torrentFile)
 		if err != nil {
-			instance.logger.Error("Failed to remove torrent file", err)
 			return err
 		}
+	}
 
-		vfsFile, err := instance.fileSystem.Open(torrentFile.GetFileIdentifier())
-		if err != nil {
-			instance.logger.Error("Failed to get file", err)
-			return err
-		}
+	return nil
+}
 
-		if vfsFile == nil {
-			continue
-		}
+// Removes a single file from database and file system, its directory goes with it when it ends up empty
+// Symlinks and the stream url kept in memory are left to the caller
+func (instance *MediaService) removeTorrentFile(transaction *sql.Tx, torrentFile *media_repository.TorrentFile) error {
+	err := instance.mediaRepository.RemoveTorrentFile(transaction, torrentFile)
+	if err != nil {
+		instance.logger.Error("Failed to remove torrent file", err)
+		return err
+	}
 
-		err = instance.fileSystem.RemoveFile(vfsFile.GetId())
-		if err != nil {
-			instance.logger.Error("Failed to delete file", err)
-			return err
-		}
+	err = instance.invalidateStreamUrl(transaction, torrentFile)
+	if err != nil {
+		instance.logger.Error("Failed to invalidate stream url", err)
+		return err
+	}
 
-		childNodes, err := instance.fileSystem.ReadDir(vfsFile.GetParentId())
-		if err != nil {
-			instance.logger.Error("Failed to get child nodes", err)
-			continue
-		}
+	vfsFile, err := instance.fileSystem.Open(torrentFile.GetFileIdentifier())
+	if err != nil {
+		instance.logger.Error("Failed to get file", err)
+		return err
+	}
 
-		if len(childNodes) == 0 {
-			err = instance.fileSystem.RmDir(vfsFile.GetParentId())
-			if err != nil {
-				instance.logger.Error("Failed to delete parent directory", err)
-				continue
-			}
-		}
+	if vfsFile == nil {
+		return nil
 	}
 
+	err = instance.fileSystem.RemoveFile(vfsFile.GetId())
+	if err != nil {
+		instance.logger.Error("Failed to delete file", err)
+		return err
+	}
+
+	instance.removeDirectoryIfEmpty(vfsFile.GetParentId())
+
 	return nil
 }
 
+func (instance *MediaService) removeDirectoryIfEmpty(identifier uint64) {
+	childNodes, err := instance.fileSystem.ReadDir(identifier)
+	if err != nil {
+		instance.logger.Error("Failed to get child nodes", err)
+		return
+	}
+
+	if len(childNodes) == 0 {
+		err = instance.fileSystem.RmDir(identifier)
+		if err != nil {
+			instance.logger.Error("Failed to delete parent directory", err)
+		}
+	}
+}
+
 func (instance *MediaService) removeTorrentFromDatabase(transaction *sql.Tx, databaseTorrent *media_repository.Torrent) error {
 	return instance.mediaRepository.RemoveTorrent(transaction, databaseTorrent)
 }
 
 func (instance *MediaService) removeTorrentFromApi(torrent *media_repository.Torrent) error {
-	return real_debrid_api.Delete(instance.client, torrent.GetTorrentIdentifier())
+	account, err := instance.getAccount(torrent.GetAccount())
+	if err != nil {
+		return err
+	}
+
+	return account.GetProvider().Delete(torrent.GetTorrentIdentifier())
 }
 
 func (instance *MediaService) GetTorrents() ([]*media_repository.Torrent, error) {
 	return instance.mediaRepository.GetTorrents()
 }
 
-func (instance *MediaService) GetRejectedTorrents() ([]*media_repository.Torrent, error) {
+func (instance *MediaService) GetRejectedTorrents() ([]*media_repository.RejectedTorrent, error) {
 	return instance.mediaRepository.GetRejectedTorrents()
 }
@@ -0,0 +1,98 @@
+package service
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"debrid_drive/account"
+	"debrid_drive/provider"
+)
+
+const (
+	// The provider could not list the files of the torrent
+	RejectionInfoUnavailable = "info_unavailable"
+	// Selected files have no link and are not packed in an archive, links can show up later
+	RejectionMissingLinks = "missing_links"
+	// Files are packed in an archive and the archive policy rejects them
+	RejectionArchive = "archive"
+	// Nothing in the torrent is selected for download
+	RejectionNoSelectedFiles = "no_selected_files"
+)
+
+const (
+	initialRejectionRetry = 15 * time.Minute
+	maxRejectionRetry     = 24 * time.Hour
+	// Rejections are no longer retried after this many attempts in a row
+	maxRejectionAttempts = 10
+)
+
+var _ error = TorrentRejectedError{}
+
+type TorrentRejectedError struct {
+	Reason string
+	Err    error
+}
+
+func (err TorrentRejectedError) Error() string {
+	if err.Err == nil {
+		return fmt.Sprintf("Rejected: %s", err.Reason)
+	}
+
+	return fmt.Sprintf("Rejected: %s: %v", err.Reason, err.Err)
+}
+
+func (err TorrentRejectedError) Unwrap() error {
+	return err.Err
+}
+
+// Transient rejections are retried with exponential backoff
+func (err TorrentRejectedError) IsTransient() bool {
+	switch err.Reason {
+	case RejectionInfoUnavailable, RejectionMissingLinks:
+		return true
+	default:
+		return false
+	}
+}
+
+// Records the rejection and schedules the next attempt when the reason is transient
+// Returns when the torrent is retried, zero when it is not
+func (instance *MediaService) RejectTorrent(transaction *sql.Tx, account *account.Account, torrent *provider.Torrent, rejection TorrentRejectedError) (time.Time, error) {
+	previous, err := instance.mediaRepository.GetRejectedTorrent(account.GetName(), torrent.ID)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	attempts := 1
+	if previous != nil && previous.GetReason() == rejection.Reason {
+		attempts = previous.GetAttempts() + 1
+	}
+
+	var retryAt time.Time
+	if rejection.IsTransient() && attempts < maxRejectionAttempts {
+		retryAt = time.Now().Add(rejectionRetryDelay(attempts))
+	}
+
+	err = instance.mediaRepository.RejectTorrent(transaction, account.GetName(), torrent, rejection.Reason, attempts, retryAt)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return retryAt, nil
+}
+
+// Doubles with every attempt, starting at the initial delay and capped at the max delay
+func rejectionRetryDelay(attempts int) time.Duration {
+	delay := initialRejectionRetry
+
+	for attempt := 1; attempt < attempts; attempt++ {
+		delay *= 2
+
+		if delay >= maxRejectionRetry {
+			return maxRejectionRetry
+		}
+	}
+
+	return delay
+}
@@ -0,0 +1,72 @@
+package service
+
+import (
+	"debrid_drive/config"
+	"debrid_drive/logger"
+	"debrid_drive/metrics"
+
+	media_repository "debrid_drive/media/repository"
+)
+
+// Removes a file of a torrent on behalf of a client, what goes with it depends on the removal policy
+// With the trash enabled the file is moved to the trash first, see MoveToTrash
+// Holds the reconciliation lock, a poll could be adding or removing the same torrent
+func (instance *MediaService) RemoveFile(torrent *media_repository.Torrent, torrentFile *media_repository.TorrentFile) error {
+	instance.LockReconciliation()
+	defer instance.UnlockReconciliation()
+
+	trashed, err := instance.moveToTrash(torrent, torrentFile)
+	if err != nil {
+		return err
+	}
+
+	if trashed {
+		return nil
+	}
+
+	torrentFiles, err := instance.mediaRepository.GetTorrentFiles(torrent)
+	if err != nil {
+		return instance.error("Failed to get torrent files", err)
+	}
+
+	// The torrent is deleted with its last file
+	fileOnly := config.GetRemovalPolicy() == config.RemovalPolicyFile && len(torrentFiles) > 1
+	if fileOnly {
+		torrentFiles = []*media_repository.TorrentFile{torrentFile}
+	}
+
+	symlinks := instance.FindSymlinks(torrentFiles)
+
+	transaction, err := instance.NewTransaction()
+	if err != nil {
+		return instance.error("Failed to begin transaction", err)
+	}
+	defer transaction.Rollback()
+
+	if fileOnly {
+		err = instance.removeTorrentFile(transaction, torrentFile)
+	} else {
+		err = instance.DeleteTorrent(transaction, torrent, true)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	err = transaction.Commit()
+	if err != nil {
+		return instance.error("Failed to commit transaction", err)
+	}
+
+	instance.ForgetStreamUrls(torrentFiles)
+	instance.RemoveSymlinks(symlinks, torrentFiles)
+
+	if fileOnly {
+		instance.logger.Info("Removed file, the torrent has other files", logger.TorrentId, torrent.GetTorrentIdentifier(), "path", torrentFile.GetPath())
+		return nil
+	}
+
+	metrics.TorrentRemoved(torrent.GetAccount())
+
+	return nil
+}
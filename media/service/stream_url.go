@@ -0,0 +1,225 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"debrid_drive/config"
+	"debrid_drive/provider"
+
+	media_repository "debrid_drive/media/repository"
+)
+
+// In flight unrestrict call, shared by every caller asking for the same link
+type streamUrlCall struct {
+	wait      sync.WaitGroup
+	streamUrl *media_repository.StreamUrl
+	err       error
+	// The link was invalidated while the call ran, its result is not cached
+	invalidated bool
+}
+
+type streamUrlCache struct {
+	mutex   sync.Mutex
+	entries map[string]*media_repository.StreamUrl
+	calls   map[string]*streamUrlCall
+}
+
+func newStreamUrlCache() *streamUrlCache {
+	return &streamUrlCache{
+		entries: make(map[string]*media_repository.StreamUrl),
+		calls:   make(map[string]*streamUrlCall),
+	}
+}
+
+func (cache *streamUrlCache) get(link string) *media_repository.StreamUrl {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	streamUrl, ok := cache.entries[link]
+	if !ok {
+		return nil
+	}
+
+	if streamUrl.IsExpired() {
+		delete(cache.entries, link)
+		return nil
+	}
+
+	return streamUrl
+}
+
+// A call in flight for the link does not cache its result
+func (cache *streamUrlCache) remove(link string) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	delete(cache.entries, link)
+
+	if call, ok := cache.calls[link]; ok {
+		call.invalidated = true
+	}
+}
+
+func (cache *streamUrlCache) removeExpired() {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	for link, streamUrl := range cache.entries {
+		if streamUrl.IsExpired() {
+			delete(cache.entries, link)
+		}
+	}
+}
+
+// Runs fetch once per link, concurrent callers for the same link wait for and share its result
+// The result is cached unless the link was invalidated in the meantime
+func (cache *streamUrlCache) do(link string, fetch func() (*media_repository.StreamUrl, error)) (*media_repository.StreamUrl, error) {
+	cache.mutex.Lock()
+
+	if call, ok := cache.calls[link]; ok {
+		cache.mutex.Unlock()
+		call.wait.Wait()
+
+		return call.streamUrl, call.err
+	}
+
+	call := &streamUrlCall{}
+	call.wait.Add(1)
+	cache.calls[link] = call
+
+	cache.mutex.Unlock()
+
+	call.streamUrl, call.err = fetch()
+
+	cache.mutex.Lock()
+	delete(cache.calls, link)
+	if call.err == nil && !call.invalidated {
+		cache.entries[call.streamUrl.GetLink()] = call.streamUrl
+	}
+	cache.mutex.Unlock()
+
+	call.wait.Done()
+
+	return call.streamUrl, call.err
+}
+
+// 1. Check the memory cache
+// 2. Check the database cache
+// 3. Unrestrict the link and store the result in the database, a dead link is refreshed and tried once more
+// The memory cache holds the result of 2 or 3
+func (instance *MediaService) GetStreamUrl(torrentFile *media_repository.TorrentFile) (string, error) {
+	link := torrentFile.GetLink()
+
+	if streamUrl := instance.streamUrls.get(link); streamUrl != nil {
+		return streamUrl.GetUrl(), nil
+	}
+
+	streamUrl, err := instance.streamUrls.do(link, func() (*media_repository.StreamUrl, error) {
+		return instance.fetchStreamUrl(torrentFile)
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	return streamUrl.GetUrl(), nil
+}
+
+func (instance *MediaService) fetchStreamUrl(torrentFile *media_repository.TorrentFile) (*media_repository.StreamUrl, error) {
+	link := torrentFile.GetLink()
+
+	storedStreamUrl, err := instance.mediaRepository.GetStreamUrl(link)
+	if err != nil && err != sql.ErrNoRows {
+		instance.logger.Error("Failed to get stored stream url", err)
+	}
+
+	if storedStreamUrl != nil && !storedStreamUrl.IsExpired() {
+		return storedStreamUrl, nil
+	}
+
+	return instance.newStreamUrl(torrentFile)
+}
+
+// Unrestricts the link of the torrent file and stores the result in the database
+func (instance *MediaService) newStreamUrl(torrentFile *media_repository.TorrentFile) (*media_repository.StreamUrl, error) {
+	// The link changes when it was dead and could be refreshed
+	link, download, err := instance.unrestrictTorrentFile(torrentFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return instance.cacheStreamUrl(link, download), nil
+}
+
+// Stores the url of an unrestricted link in the database
+func (instance *MediaService) cacheStreamUrl(link string, download *provider.Download) *media_repository.StreamUrl {
+	expiresAt := time.Now().Add(config.GetStreamUrlTtl())
+
+	streamUrl, err := instance.mediaRepository.SetStreamUrl(link, download.Url, expiresAt)
+	if err != nil {
+		// The link is still usable, it just won't survive a restart
+		instance.logger.Error("Failed to store stream url", err)
+		streamUrl = media_repository.NewStreamUrl(link, download.Url, expiresAt)
+	}
+
+	return streamUrl
+}
+
+// Saves unrestricting the link of the file again when it is first streamed, nothing is kept when the transaction rolls back
+func (instance *MediaService) saveStreamUrl(transaction *sql.Tx, linkedFile linkedFile) {
+	if linkedFile.download == nil {
+		return
+	}
+
+	err := instance.mediaRepository.SaveStreamUrl(transaction, linkedFile.link, linkedFile.download.Url, time.Now().Add(config.GetStreamUrlTtl()))
+	if err != nil {
+		// The link is unrestricted again when streamed
+		instance.logger.Error("Failed to store stream url", err)
+	}
+}
+
+// The memory cache is left to the caller once the transaction is committed, see ForgetStreamUrls
+func (instance *MediaService) invalidateStreamUrl(transaction *sql.Tx, torrentFile *media_repository.TorrentFile) error {
+	return instance.mediaRepository.RemoveStreamUrl(transaction, torrentFile.GetLink())
+}
+
+// Drops the stream urls of the files from the memory cache
+// Called after the transaction that removed them commits, a lookup in between would cache the old url again
+func (instance *MediaService) ForgetStreamUrls(torrentFiles []*media_repository.TorrentFile) {
+	for _, torrentFile := range torrentFiles {
+		instance.streamUrls.remove(torrentFile.GetLink())
+	}
+}
+
+// Expired stream urls are removed from the memory cache as well, an entry that is never read again would stay forever
+func (instance *MediaService) RemoveExpiredStreamUrls() error {
+	instance.streamUrls.removeExpired()
+
+	count, err := instance.mediaRepository.RemoveExpiredStreamUrls()
+	if err != nil {
+		return instance.error("Failed to remove expired stream urls", err)
+	}
+
+	if count > 0 {
+		instance.logger.Info(fmt.Sprintf("Removed %d expired stream urls", count))
+	}
+
+	return nil
+}
+
+// Removes expired stream urls right away and then once per stream url ttl until ctx is cancelled
+func (instance *MediaService) StartStreamUrlCleanup(ctx context.Context) {
+	for {
+		instance.RemoveExpiredStreamUrls()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(config.GetStreamUrlTtl()):
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package service
+
+import (
+	"database/sql"
+	"fmt"
+	"io/fs"
+
+	"debrid_drive/config"
+	"debrid_drive/filesystem/symlink"
+
+	media_repository "debrid_drive/media/repository"
+
+	filesystem_interfaces "github.com/sushydev/vfs_go/interfaces"
+	"github.com/sushydev/vfs_go/service"
+)
+
+// Symlinks pointing at torrent files, by the file node they point at
+type Symlinks map[uint64][]filesystem_interfaces.Node
+
+// Records a symlink made through the file system service so it can be found from its target
+func (instance *MediaService) AddSymlink(link filesystem_interfaces.Node, targetId uint64) error {
+	return instance.mediaRepository.SetSymlink(link.GetId(), targetId)
+}
+
+func (instance *MediaService) ForgetSymlink(link filesystem_interfaces.Node) error {
+	return instance.mediaRepository.RemoveSymlink(link.GetId())
+}
+
+// Walks the file system once and records the symlinks that are not recorded yet, like links made before they were recorded
+func (instance *MediaService) IndexSymlinks() error {
+	root, err := service.GetRoot(instance.fileSystem)
+	if err != nil {
+		return err
+	}
+
+	directories := []filesystem_interfaces.Node{root}
+	count := 0
+
+	for len(directories) > 0 {
+		directory := directories[len(directories)-1]
+		directories = directories[:len(directories)-1]
+
+		children, err := instance.fileSystem.ReadDir(directory.GetId())
+		if err != nil {
+			return err
+		}
+
+		for _, child := range children {
+			switch child.GetMode() {
+			case fs.ModeDir:
+				directories = append(directories, child)
+			case fs.ModeSymlink:
+				_, err := instance.mediaRepository.GetSymlinkTarget(child.GetId())
+				if err == nil {
+					continue
+				}
+
+				if err != sql.ErrNoRows {
+					return err
+				}
+
+				target, err := instance.symlinks.Target(child)
+				if err != nil {
+					// Already dangling, not ours to clean up
+					continue
+				}
+
+				err = instance.AddSymlink(child, target.GetId())
+				if err != nil {
+					return err
+				}
+
+				count++
+			}
+		}
+	}
+
+	if count > 0 {
+		instance.logger.Info(fmt.Sprintf("Recorded %d symlinks", count))
+	}
+
+	return nil
+}
+
+// Symlinks to the files would be left dangling when the files are removed, so they go with them
+// They are looked up before the files are removed, a dangling symlink can't be traced back
+// Remove them with RemoveSymlinks once the removal is committed, a rolled back removal keeps them
+func (instance *MediaService) FindSymlinks(torrentFiles []*media_repository.TorrentFile) Symlinks {
+	if len(torrentFiles) == 0 {
+		return nil
+	}
+
+	// File each link resolves to, by the node the next round looks up the links to
+	files := make(map[uint64]uint64, len(torrentFiles))
+	pending := make([]uint64, 0, len(torrentFiles))
+
+	for _, torrentFile := range torrentFiles {
+		files[torrentFile.GetFileIdentifier()] = torrentFile.GetFileIdentifier()
+		pending = append(pending, torrentFile.GetFileIdentifier())
+	}
+
+	links := make(Symlinks)
+
+	// Links to links are found in the next round, until a round finds no new links
+	for len(pending) > 0 {
+		next := make([]uint64, 0)
+
+		for _, targetId := range pending {
+			sourceIds, err := instance.mediaRepository.GetSymlinkSources(targetId)
+			if err != nil {
+				instance.logger.Error("Failed to find symlinks", err)
+				return nil
+			}
+
+			for _, sourceId := range sourceIds {
+				// Seen before, the links form a cycle
+				if _, ok := files[sourceId]; ok {
+					continue
+				}
+
+				files[sourceId] = files[targetId]
+
+				// Removed or replaced without going through the file system service
+				link, err := instance.fileSystem.Open(sourceId)
+				if err != nil || link.GetMode() != fs.ModeSymlink {
+					continue
+				}
+
+				links[files[targetId]] = append(links[files[targetId]], link)
+				next = append(next, sourceId)
+			}
+		}
+
+		pending = next
+	}
+
+	return links
+}
+
+// Follows a chain of symlinks to the node at its end, other nodes are returned as is
+func (instance *MediaService) ResolveSymlink(node filesystem_interfaces.Node) (filesystem_interfaces.Node, error) {
+	return instance.symlinks.Resolve(node)
+}
+
+// Removes the symlinks to the given files, or moves them into the quarantine directory when one is configured
+func (instance *MediaService) RemoveSymlinks(symlinks Symlinks, torrentFiles []*media_repository.TorrentFile) {
+	links := make([]filesystem_interfaces.Node, 0)
+	for _, torrentFile := range torrentFiles {
+		links = append(links, symlinks[torrentFile.GetFileIdentifier()]...)
+	}
+
+	if len(links) == 0 {
+		return
+	}
+
+	count, err := symlink.RemoveLinks(instance.fileSystem, links, config.GetSymlinkQuarantineDirectory())
+	if err != nil {
+		instance.logger.Error("Failed to remove symlinks", err)
+	}
+
+	// Quarantined links point at a removed file as well, neither is looked up again
+	for _, link := range links[:count] {
+		err = instance.ForgetSymlink(link)
+		if err != nil {
+			instance.logger.Error("Failed to forget symlink", err)
+		}
+	}
+
+	if count > 0 {
+		instance.logger.Info(fmt.Sprintf("Removed %d symlinks", count))
+	}
+}
@@ -0,0 +1,410 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"syscall"
+	"time"
+
+	"debrid_drive/config"
+	"debrid_drive/logger"
+	"debrid_drive/metrics"
+
+	media_repository "debrid_drive/media/repository"
+
+	filesystem_interfaces "github.com/sushydev/vfs_go/interfaces"
+	"github.com/sushydev/vfs_go/service"
+)
+
+// Directory in the root of the file system holding removed files, each in a directory named after its trash entry
+const TrashDirectory = "/.trash"
+
+const trashCheckInterval = time.Minute
+
+// Moves the file to the trash, with the torrent removal policy its siblings go with it
+// The torrent is deleted from debrid once all of its files were there for the retention
+// False when the trash is disabled or the file is in the trash already, it should be removed right away then
+// Holds the reconciliation lock, a poll could be adding or removing the same torrent
+func (instance *MediaService) MoveToTrash(torrent *media_repository.Torrent, torrentFile *media_repository.TorrentFile) (bool, error) {
+	instance.LockReconciliation()
+	defer instance.UnlockReconciliation()
+
+	return instance.moveToTrash(torrent, torrentFile)
+}
+
+// MoveToTrash for callers that hold the reconciliation lock
+func (instance *MediaService) moveToTrash(torrent *media_repository.Torrent, torrentFile *media_repository.TorrentFile) (bool, error) {
+	if !config.GetTrashEnabled() {
+		return false, nil
+	}
+
+	trashed, err := instance.mediaRepository.TorrentFileTrashed(torrentFile)
+	if err != nil {
+		return false, instance.error("Failed to check the trash", err)
+	}
+
+	if trashed {
+		return false, nil
+	}
+
+	torrentFiles := []*media_repository.TorrentFile{torrentFile}
+
+	if config.GetRemovalPolicy() == config.RemovalPolicyTorrent {
+		torrentFiles, err = instance.mediaRepository.GetTorrentFiles(torrent)
+		if err != nil {
+			return false, instance.error("Failed to get torrent files", err)
+		}
+	}
+
+	moves := make([]*trashMove, 0, len(torrentFiles))
+
+	for _, torrentFile := range torrentFiles {
+		trashed, err := instance.mediaRepository.TorrentFileTrashed(torrentFile)
+		if err != nil {
+			return false, instance.error("Failed to check the trash", err)
+		}
+
+		if trashed {
+			continue
+		}
+
+		move, err := instance.newTrashMove(torrentFile)
+		if err != nil {
+			return false, instance.error("Failed to find file to move to the trash", err)
+		}
+
+		moves = append(moves, move)
+	}
+
+	trashDirectory, err := instance.findOrCreatePath(TrashDirectory)
+	if err != nil {
+		return false, instance.error("Failed to find the trash directory", err)
+	}
+
+	transaction, err := instance.NewTransaction()
+	if err != nil {
+		return false, instance.error("Failed to begin transaction", err)
+	}
+	defer transaction.Rollback()
+
+	for _, move := range moves {
+		move.identifier, err = instance.mediaRepository.AddTrashEntry(transaction, move.torrentFile, move.directory, move.node.GetName())
+		if err != nil {
+			return false, instance.error("Failed to add trash entry", err)
+		}
+	}
+
+	err = transaction.Commit()
+	if err != nil {
+		return false, instance.error("Failed to commit transaction", err)
+	}
+
+	// Files only move once their entries are committed, so every file in the trash has an entry
+	var moveErr error
+
+	for _, move := range moves {
+		err = instance.moveFileToTrash(trashDirectory, move)
+		if err != nil {
+			instance.logger.Error("Failed to move file to the trash", err, logger.NodeId, move.node.GetId())
+
+			// The file stays where it is, without an entry it is not purged
+			instance.forgetTrashEntry(move.identifier)
+			moveErr = err
+		}
+	}
+
+	if moveErr != nil {
+		return false, moveErr
+	}
+
+	instance.logger.Info(
+		fmt.Sprintf("Moved %d files to the trash, they are purged in %s", len(moves), config.GetTrashRetention()),
+		logger.TorrentId, torrent.GetTorrentIdentifier(),
+		"name", torrent.GetName(),
+	)
+
+	return true, nil
+}
+
+// A file on its way to the trash, with its original location
+type trashMove struct {
+	torrentFile *media_repository.TorrentFile
+	node        filesystem_interfaces.Node
+	parent      filesystem_interfaces.Node
+	directory   string
+	identifier  uint64
+}
+
+func (instance *MediaService) newTrashMove(torrentFile *media_repository.TorrentFile) (*trashMove, error) {
+	node, err := instance.fileSystem.Open(torrentFile.GetFileIdentifier())
+	if err != nil {
+		return nil, err
+	}
+
+	parent, err := instance.fileSystem.Open(node.GetParentId())
+	if err != nil {
+		return nil, err
+	}
+
+	directory, err := instance.pathOf(parent)
+	if err != nil {
+		return nil, err
+	}
+
+	return &trashMove{torrentFile: torrentFile, node: node, parent: parent, directory: directory}, nil
+}
+
+// Moves the file into the directory of its entry, a directory left empty is removed
+func (instance *MediaService) moveFileToTrash(trashDirectory filesystem_interfaces.Node, move *trashMove) error {
+	entryDirectory, err := service.FindOrCreateDirectory(instance.fileSystem, trashDirectory.GetId(), strconv.FormatUint(move.identifier, 10))
+	if err != nil {
+		return err
+	}
+
+	err = instance.fileSystem.Rename(move.node.GetId(), move.node.GetName(), entryDirectory.GetId())
+	if err != nil {
+		instance.removeDirectoryIfEmpty(entryDirectory.GetId())
+		return err
+	}
+
+	instance.removeDirectoryIfEmpty(move.parent.GetId())
+
+	return nil
+}
+
+// 1. Forget entries whose file was moved out of the trash, it is in use again
+// 2. Restore entries that were asked for, e.g. by "admin trash restore"
+// 3. Delete torrents whose files were all in the trash for the retention, from debrid too
+// 4. Remove files that were in the trash for the retention while their torrent has other files in use
+func (instance *MediaService) CheckTrash(ctx context.Context) error {
+	instance.LockReconciliation()
+	defer instance.UnlockReconciliation()
+
+	trashEntries, err := instance.mediaRepository.GetTrashEntries()
+	if err != nil {
+		return instance.error("Failed to get trash entries", err)
+	}
+
+	if len(trashEntries) == 0 {
+		return nil
+	}
+
+	trashDirectory, err := instance.findOrCreatePath(TrashDirectory)
+	if err != nil {
+		return instance.error("Failed to find the trash directory", err)
+	}
+
+	for _, trashEntry := range trashEntries {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		node, err := instance.fileSystem.Open(trashEntry.GetFileIdentifier())
+		if err != nil {
+			// A missing file is cleaned up with its torrent file on the next poll
+			continue
+		}
+
+		if !instance.inTrash(trashDirectory, trashEntry, node) {
+			instance.logger.Info("File was moved out of the trash, it is kept", "name", node.GetName(), logger.TorrentId, trashEntry.GetTorrentIdentifier())
+			instance.forgetTrashEntry(trashEntry.GetIdentifier())
+			continue
+		}
+
+		if trashEntry.IsRestoreRequested() {
+			instance.restore(trashEntry, node)
+		}
+	}
+
+	expiredBefore := time.Now().Add(-config.GetTrashRetention())
+
+	torrents, err := instance.mediaRepository.GetTorrentsTrashedBefore(expiredBefore)
+	if err != nil {
+		return instance.error("Failed to get torrents to purge from the trash", err)
+	}
+
+	for _, torrent := range torrents {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		instance.purgeTorrent(torrent)
+	}
+
+	partialEntries, err := instance.mediaRepository.GetPartialTrashEntriesBefore(expiredBefore)
+	if err != nil {
+		return instance.error("Failed to get files to purge from the trash", err)
+	}
+
+	for _, trashEntry := range partialEntries {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		instance.purgeFile(trashEntry)
+	}
+
+	return nil
+}
+
+// Runs CheckTrash every minute until the context is done
+func (instance *MediaService) StartTrashCheck(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(trashCheckInterval):
+		}
+
+		instance.CheckTrash(ctx)
+	}
+}
+
+// Whether the file is still where the entry put it
+func (instance *MediaService) inTrash(trashDirectory filesystem_interfaces.Node, trashEntry *media_repository.TrashEntry, node filesystem_interfaces.Node) bool {
+	parent, err := instance.fileSystem.Open(node.GetParentId())
+	if err != nil {
+		return false
+	}
+
+	return parent.GetParentId() == trashDirectory.GetId() && parent.GetName() == strconv.FormatUint(trashEntry.GetIdentifier(), 10)
+}
+
+// Moves the file back to its original location, directories along the way are created again
+// A file that took its place in the meantime is left alone and the restore is given up
+func (instance *MediaService) restore(trashEntry *media_repository.TrashEntry, node filesystem_interfaces.Node) {
+	entryLogger := instance.logger.With(logger.TorrentId, trashEntry.GetTorrentIdentifier(), "path", trashEntry.GetOriginalPath())
+
+	directory, err := instance.findOrCreatePath(trashEntry.GetOriginalDirectory())
+	if err != nil {
+		entryLogger.Error("Failed to find the original directory", err)
+		return
+	}
+
+	_, err = instance.fileSystem.Lookup(directory.GetId(), trashEntry.GetOriginalName())
+	if err != nil && err != syscall.ENOENT {
+		entryLogger.Error("Failed to look up the original path", err)
+		return
+	}
+
+	if err == nil {
+		entryLogger.Warn("Cannot restore from the trash, the original path is taken")
+
+		err = instance.mediaRepository.SetTrashRestoreRequested(trashEntry, false)
+		if err != nil {
+			entryLogger.Error("Failed to give up restore", err)
+		}
+
+		return
+	}
+
+	entryDirectory := node.GetParentId()
+
+	err = instance.fileSystem.Rename(node.GetId(), trashEntry.GetOriginalName(), directory.GetId())
+	if err != nil {
+		entryLogger.Error("Failed to move file out of the trash", err)
+		return
+	}
+
+	instance.removeDirectoryIfEmpty(entryDirectory)
+	instance.forgetTrashEntry(trashEntry.GetIdentifier())
+
+	entryLogger.Info("Restored from the trash")
+}
+
+func (instance *MediaService) forgetTrashEntry(identifier uint64) {
+	transaction, err := instance.NewTransaction()
+	if err != nil {
+		instance.logger.Error("Failed to begin transaction", err)
+		return
+	}
+	defer transaction.Rollback()
+
+	err = instance.mediaRepository.RemoveTrashEntry(transaction, identifier)
+	if err != nil {
+		return
+	}
+
+	err = transaction.Commit()
+	if err != nil {
+		instance.logger.Error("Failed to commit transaction", err)
+	}
+}
+
+// Failures are retried on the next check
+func (instance *MediaService) purgeTorrent(torrent *media_repository.Torrent) {
+	torrentFiles, err := instance.mediaRepository.GetTorrentFiles(torrent)
+	if err != nil {
+		instance.logger.Error("Failed to get torrent files", err, logger.TorrentId, torrent.GetTorrentIdentifier())
+		return
+	}
+
+	symlinks := instance.FindSymlinks(torrentFiles)
+
+	transaction, err := instance.NewTransaction()
+	if err != nil {
+		instance.logger.Error("Failed to begin transaction", err)
+		return
+	}
+	defer transaction.Rollback()
+
+	err = instance.DeleteTorrent(transaction, torrent, true)
+	if err != nil {
+		instance.logger.Error("Failed to delete torrent from the trash", err, logger.TorrentId, torrent.GetTorrentIdentifier())
+		return
+	}
+
+	err = transaction.Commit()
+	if err != nil {
+		instance.logger.Error("Failed to commit transaction", err)
+		return
+	}
+
+	instance.ForgetStreamUrls(torrentFiles)
+	instance.RemoveSymlinks(symlinks, torrentFiles)
+
+	metrics.TorrentRemoved(torrent.GetAccount())
+
+	instance.logger.Info("Deleted torrent from the trash", logger.TorrentId, torrent.GetTorrentIdentifier(), "name", torrent.GetName())
+}
+
+func (instance *MediaService) purgeFile(trashEntry *media_repository.TrashEntry) {
+	torrentFile, err := instance.mediaRepository.GetTorrentFileByFileId(trashEntry.GetFileIdentifier())
+	if err != nil {
+		instance.logger.Error("Failed to get torrent file", err, logger.NodeId, trashEntry.GetFileIdentifier())
+		return
+	}
+
+	torrent, err := instance.mediaRepository.GetTorrentByTorrentFileId(torrentFile.GetIdentifier())
+	if err != nil {
+		instance.logger.Error("Failed to get torrent", err, logger.NodeId, trashEntry.GetFileIdentifier())
+		return
+	}
+
+	torrentFiles := []*media_repository.TorrentFile{torrentFile}
+	symlinks := instance.FindSymlinks(torrentFiles)
+
+	transaction, err := instance.NewTransaction()
+	if err != nil {
+		instance.logger.Error("Failed to begin transaction", err)
+		return
+	}
+	defer transaction.Rollback()
+
+	err = instance.removeTorrentFile(transaction, torrentFile)
+	if err != nil {
+		return
+	}
+
+	err = transaction.Commit()
+	if err != nil {
+		instance.logger.Error("Failed to commit transaction", err)
+		return
+	}
+
+	instance.ForgetStreamUrls(torrentFiles)
+	instance.RemoveSymlinks(symlinks, torrentFiles)
+
+	instance.logger.Info("Deleted file from the trash, the torrent has other files", logger.TorrentId, torrent.GetTorrentIdentifier(), "path", trashEntry.GetOriginalPath())
+}
@@ -0,0 +1,181 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+const namespace = "debrid_drive"
+
+// Outcomes of a poll
+const (
+	PollSucceeded   = "success"
+	PollFailed      = "failed"
+	PollInterrupted = "interrupted"
+)
+
+var (
+	grpcRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "grpc",
+		Name:      "requests_total",
+		Help:      "Grpc calls by method and status code",
+	}, []string{"method", "code"})
+
+	grpcDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "grpc",
+		Name:      "request_duration_seconds",
+		Help:      "Duration of grpc calls by method",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method"})
+
+	polls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "poll",
+		Name:      "total",
+		Help:      "Reconciliations by account and outcome",
+	}, []string{"account", "outcome"})
+
+	pollDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "poll",
+		Name:      "duration_seconds",
+		Help:      "Duration of reconciliations by account",
+		Buckets:   []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+	}, []string{"account"})
+
+	lastPollSuccess = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "poll",
+		Name:      "last_success_timestamp_seconds",
+		Help:      "Unix time of the last successful reconciliation by account",
+	}, []string{"account"})
+
+	torrentsAdded = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "torrents",
+		Name:      "added_total",
+		Help:      "Torrents added to the library by account",
+	}, []string{"account"})
+
+	torrentsRemoved = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "torrents",
+		Name:      "removed_total",
+		Help:      "Torrents removed from the library by account",
+	}, []string{"account"})
+
+	torrentsRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "torrents",
+		Name:      "rejected_total",
+		Help:      "Torrents rejected by account and reason, retries count again",
+	}, []string{"account", "reason"})
+
+	providerRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "provider",
+		Name:      "requests_total",
+		Help:      "Debrid api calls by account, endpoint and http status code, \"error\" when no response was received",
+	}, []string{"account", "endpoint", "code"})
+
+	providerDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "provider",
+		Name:      "request_duration_seconds",
+		Help:      "Duration of debrid api calls by account and endpoint",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"account", "endpoint"})
+)
+
+// Serves every registered metric in the prometheus text format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Counts and times every unary grpc call
+func UnaryServerInterceptor(ctx context.Context, request any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	start := time.Now()
+	response, err := handler(ctx, request)
+
+	grpcDuration.WithLabelValues(info.FullMethod).Observe(time.Since(start).Seconds())
+	grpcRequests.WithLabelValues(info.FullMethod, status.Code(err).String()).Inc()
+
+	return response, err
+}
+
+func ObservePoll(account string, outcome string, duration time.Duration) {
+	polls.WithLabelValues(account, outcome).Inc()
+	pollDuration.WithLabelValues(account).Observe(duration.Seconds())
+
+	if outcome == PollSucceeded {
+		lastPollSuccess.WithLabelValues(account).SetToCurrentTime()
+	}
+}
+
+func TorrentAdded(account string) {
+	torrentsAdded.WithLabelValues(account).Inc()
+}
+
+func TorrentRemoved(account string) {
+	torrentsRemoved.WithLabelValues(account).Inc()
+}
+
+func TorrentRejected(account string, reason string) {
+	torrentsRejected.WithLabelValues(account, reason).Inc()
+}
+
+func ObserveProviderRequest(account string, endpoint string, code string, duration time.Duration) {
+	providerRequests.WithLabelValues(account, endpoint, code).Inc()
+	providerDuration.WithLabelValues(account, endpoint).Observe(duration.Seconds())
+}
+
+// Reports the size of a sqlite database on disk, including its write ahead log
+// Must be called once per name
+func RegisterDatabaseSize(name string, path string) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Name:        "database_size_bytes",
+		Help:        "Size of the database files on disk",
+		ConstLabels: prometheus.Labels{"database": name},
+	}, func() float64 {
+		var size int64
+
+		for _, file := range []string{path, path + "-wal"} {
+			info, err := os.Stat(file)
+			if err == nil {
+				size += info.Size()
+			}
+		}
+
+		return float64(size)
+	})
+}
+
+// Reports the number of torrents in the library of an account, count errors are reported as -1
+// Must be called once per account
+func RegisterTorrentCount(account string, count func() (int, error)) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   "torrents",
+		Name:        "count",
+		Help:        "Torrents in the library by account",
+		ConstLabels: prometheus.Labels{"account": account},
+	}, func() float64 {
+		value, err := count()
+		if err != nil {
+			return -1
+		}
+
+		return float64(value)
+	})
+}
@@ -0,0 +1,81 @@
+package action
+
+import (
+	"database/sql"
+	"fmt"
+
+	"debrid_drive/config"
+
+	media_repository "debrid_drive/media/repository"
+)
+
+// Returns the removals that may be applied
+// When the unconfirmed removals exceed the max count or the max percentage of the library they are held until confirmed
+// Removals that would empty the library are always held, an empty listing looks the same
+func (a *Actioner) guardRemovals(transaction *sql.Tx, removedTorrents []*media_repository.Torrent) ([]*media_repository.Torrent, error) {
+	if len(removedTorrents) == 0 {
+		return removedTorrents, nil
+	}
+
+	heldRemovals, err := a.mediaRepository.GetHeldRemovals(a.account.GetName())
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get held removals: %w", err)
+	}
+
+	confirmed := make(map[string]bool, len(heldRemovals))
+	for _, heldRemoval := range heldRemovals {
+		if heldRemoval.IsConfirmed() {
+			confirmed[heldRemoval.GetTorrentIdentifier()] = true
+		}
+	}
+
+	allowed := make([]*media_repository.Torrent, 0, len(removedTorrents))
+	unconfirmed := make([]*media_repository.Torrent, 0, len(removedTorrents))
+
+	for _, torrent := range removedTorrents {
+		if confirmed[torrent.GetTorrentIdentifier()] {
+			allowed = append(allowed, torrent)
+		} else {
+			unconfirmed = append(unconfirmed, torrent)
+		}
+	}
+
+	libraryCount, err := a.mediaRepository.CountTorrents(a.account.GetName())
+	if err != nil {
+		return nil, fmt.Errorf("Failed to count torrents: %w", err)
+	}
+
+	if len(unconfirmed) == 0 {
+		return allowed, nil
+	}
+
+	maxCount := config.GetRemovalGuardMaxCount()
+	maxPercent := config.GetRemovalGuardMaxPercent()
+
+	percent := 100
+	if libraryCount > 0 {
+		percent = len(unconfirmed) * 100 / libraryCount
+	}
+
+	exceedsCount := len(unconfirmed) > maxCount
+	exceedsPercent := len(unconfirmed)*100 > maxPercent*libraryCount
+	emptiesLibrary := libraryCount > 0 && len(unconfirmed) >= libraryCount
+
+	if !exceedsCount && !exceedsPercent && !emptiesLibrary {
+		return append(allowed, unconfirmed...), nil
+	}
+
+	for _, torrent := range unconfirmed {
+		err = a.mediaRepository.HoldRemoval(transaction, torrent)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to hold removal: %w", err)
+		}
+	}
+
+	a.logger.Error(
+		fmt.Sprintf("Holding %d removals (%d%% of %d torrents), list them with \"admin removals list\" and apply them with \"admin removals confirm\"", len(unconfirmed), percent, libraryCount),
+		fmt.Errorf("removals exceed the guard of %d torrents or %d%%, or would empty the library", maxCount, maxPercent),
+	)
+
+	return allowed, nil
+}
@@ -1,112 +1,173 @@
 package action
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"fmt"
+	"time"
 
+	"debrid_drive/account"
+	"debrid_drive/config"
 	"debrid_drive/logger"
+	"debrid_drive/metrics"
+	"debrid_drive/provider"
 
 	media_repository "debrid_drive/media/repository"
 	media_service "debrid_drive/media/service"
 
-	real_debrid "github.com/sushydev/real_debrid_go"
-	real_debrid_api "github.com/sushydev/real_debrid_go/api"
-	"github.com/sushydev/vfs_go/service"
-
 	"github.com/sushydev/vfs_go"
 )
 
 type Actioner struct {
-	client          *real_debrid.Client
+	account         *account.Account
 	mediaRepository *media_repository.MediaRepository
 	mediaService    *media_service.MediaService
 	fileSystem      *filesystem.FileSystem
+	fileSystemPath  string
 	logger          *logger.Logger
 }
 
 func New(
-	client *real_debrid.Client,
+	account *account.Account,
 	mediaRepository *media_repository.MediaRepository,
 	mediaService *media_service.MediaService,
 	fileSystem *filesystem.FileSystem,
+	fileSystemPath string,
 ) *Actioner {
-	logger, err := logger.NewLogger("Actioner")
+	service := "Actioner"
+	if account.GetName() != config.DefaultAccountName {
+		service = fmt.Sprintf("Actioner %s", account.GetName())
+	}
+
+	logger, err := logger.NewLogger(service)
 	if err != nil {
 		panic(err)
 	}
 
 	return &Actioner{
-		client:          client,
+		account:         account,
 		mediaRepository: mediaRepository,
 		mediaService:    mediaService,
 		fileSystem:      fileSystem,
+		fileSystemPath:  fileSystemPath,
 		logger:          logger,
 	}
 }
 
-func (actioner *Actioner) Poll() {
+// Errors mean nothing was reconciled, failures of individual entries are only logged
+// Cancelling ctx stops after the entry being processed, everything done until then is kept
+func (actioner *Actioner) Poll(ctx context.Context) error {
+	start := time.Now()
+
+	err := actioner.reconcile(ctx)
+
+	switch {
+	case err == nil:
+		metrics.ObservePoll(actioner.account.GetName(), metrics.PollSucceeded, time.Since(start))
+	case ctx.Err() != nil:
+		metrics.ObservePoll(actioner.account.GetName(), metrics.PollInterrupted, time.Since(start))
+	default:
+		metrics.ObservePoll(actioner.account.GetName(), metrics.PollFailed, time.Since(start))
+	}
+
+	return err
+}
+
+func (actioner *Actioner) reconcile(ctx context.Context) error {
 	actioner.logger.Info("Changes detected")
 
-	torrents, err := getAllTorrents(actioner.client, []*real_debrid_api.Torrent{}, 0, 1)
+	actioner.mediaService.LockReconciliation()
+	defer actioner.mediaService.UnlockReconciliation()
+
+	// An incomplete listing would make every missing torrent look removed, so nothing is touched
+	torrents, err := actioner.account.GetProvider().ListTorrents(ctx)
 	if err != nil {
-		actioner.logger.Error("Failed to get torrents", err)
-		return
+		actioner.logger.Error("Failed to get torrents, skipping reconciliation", err)
+		return err
 	}
 
 	if torrents == nil {
-		actioner.logger.Error("Empty torrents response from API", nil)
-		return
+		err = fmt.Errorf("empty torrents response from API")
+		actioner.logger.Error("Empty torrents response from API", err)
+		return err
+	}
+
+	torrentMap, err := actioner.updateSnapshots(torrents)
+	if err != nil {
+		actioner.logger.Error("Failed to update torrent snapshots", err)
+		return err
+	}
+
+	actioner.processNewEntries(ctx, torrentMap)
+	actioner.cleanupRemovedEntries(ctx)
+
+	if ctx.Err() != nil {
+		actioner.logger.Info("Reconciliation interrupted")
+		return ctx.Err()
 	}
 
-	actioner.processNewEntries(torrents)
-	actioner.cleanupRemovedEntries(torrents)
 	actioner.checkFiles()
 
 	actioner.logger.Info("Changes processed")
+
+	return nil
 }
 
-func (action *Actioner) processNewEntries(torrents []*real_debrid_api.Torrent) {
-	entries := filterDownloadedEntries(torrents)
-	if len(entries) == 0 {
-		return
-	}
+// A pending torrent along with the outcome of preparing it
+type newEntry struct {
+	torrent         *provider.Torrent
+	preparedTorrent *media_service.PreparedTorrent
+	err             error
+}
 
-	transaction, err := action.mediaService.NewTransaction()
+// Only torrents that are downloaded but neither added nor rejected are looked at
+func (action *Actioner) processNewEntries(ctx context.Context, torrentMap map[string]*provider.Torrent) {
+	pendingTorrents, err := action.mediaRepository.GetPendingTorrentSnapshots(action.account.GetName())
 	if err != nil {
-		action.logger.Error("Failed to begin transaction", err)
+		action.logger.Error("Failed to fetch pending torrents", err)
 		return
 	}
-	defer transaction.Rollback()
 
-	existingTorrents, err := action.mediaService.GetTorrents()
-	if err != nil {
-		action.logger.Error("Failed to fetch existing torrents", err)
+	if len(pendingTorrents) == 0 {
 		return
 	}
 
-	existingTorrentMap := make(map[string]bool)
-	for _, t := range existingTorrents {
-		existingTorrentMap[t.GetTorrentIdentifier()] = true
+	// The provider is called before the transaction, so it isn't held open on the network
+	entries := make([]newEntry, 0, len(pendingTorrents))
+
+	for _, pendingTorrent := range pendingTorrents {
+		if ctx.Err() != nil {
+			break
+		}
+
+		torrent, ok := torrentMap[pendingTorrent.GetTorrentIdentifier()]
+		if !ok {
+			continue
+		}
+
+		preparedTorrent, err := action.mediaService.PrepareTorrent(action.account, torrent)
+
+		entries = append(entries, newEntry{torrent: torrent, preparedTorrent: preparedTorrent, err: err})
 	}
 
-	rejectedTorrents, err := action.mediaService.GetRejectedTorrents()
-	if err != nil {
-		action.logger.Error("Failed to fetch rejected torrents", err)
+	if len(entries) == 0 {
 		return
 	}
 
-	rejectedTorrentMap := make(map[string]bool)
-	for _, t := range rejectedTorrents {
-		rejectedTorrentMap[t.GetTorrentIdentifier()] = true
+	transaction, err := action.mediaService.NewTransaction()
+	if err != nil {
+		action.logger.Error("Failed to begin transaction", err)
+		return
 	}
+	defer transaction.Rollback()
 
-	for _, torrent := range entries {
-		if existingTorrentMap[torrent.ID] {
-			continue
-		}
+	// Counted once the transaction is committed
+	added := 0
+	rejectedReasons := make([]string, 0)
 
-		if rejectedTorrentMap[torrent.ID] {
-			continue
-		}
+	for _, entry := range entries {
+		torrent := entry.torrent
 
 		_, err := transaction.Exec("SAVEPOINT add_entry")
 		if err != nil {
@@ -114,42 +175,83 @@ func (action *Actioner) processNewEntries(torrents []*real_debrid_api.Torrent) {
 			continue
 		}
 
-		err = action.mediaService.AddTorrent(transaction, torrent)
-		if err != nil {
-			switch err.(type) {
-			case media_service.TorrentRejectedError:
-				if err := action.mediaService.RejectTorrent(transaction, torrent); err != nil {
-					transaction.Exec("ROLLBACK TO SAVEPOINT add_entry")
-					action.logger.Error(fmt.Sprintf("Failed to reject torrent: %s", torrent.ID), err)
-					continue
-				}
-
-				action.logger.Info(fmt.Sprintf("Rejected entry: %s [%s]", torrent.Filename, torrent.ID))
-			default:
-				transaction.Exec("ROLLBACK TO SAVEPOINT add_entry")
-				action.logger.Error(fmt.Sprintf("Failed to add torrent: %s [%s]", torrent.Filename, torrent.ID), err)
-				continue
-			}
+		err = entry.err
+		if err == nil {
+			err = action.mediaService.AddTorrent(transaction, action.account, entry.preparedTorrent)
 		}
 
-		_, err = transaction.Exec("RELEASE SAVEPOINT add_entry")
-		if err != nil {
-			action.logger.Error("Failed to release savepoint", err)
+		rejected := false
+
+		var rejection media_service.TorrentRejectedError
+		if errors.As(err, &rejection) {
+			// Nothing the failed add wrote is kept, only the rejection
+			transaction.Exec("ROLLBACK TO SAVEPOINT add_entry")
+			rejected = action.rejectEntry(transaction, torrent, rejection)
+		} else if err != nil {
+			transaction.Exec("ROLLBACK TO SAVEPOINT add_entry")
+			action.logger.Error("Failed to add torrent", err, logger.TorrentId, torrent.ID, "name", torrent.Name)
+		} else {
+			action.logger.Info("Added entry", logger.TorrentId, torrent.ID, "name", torrent.Name)
+		}
+
+		_, releaseErr := transaction.Exec("RELEASE SAVEPOINT add_entry")
+		if releaseErr != nil {
+			action.logger.Error("Failed to release savepoint", releaseErr)
 			continue
 		}
 
-		action.logger.Info(fmt.Sprintf("Added entry: %s [%s]", torrent.Filename, torrent.ID))
+		if rejected {
+			rejectedReasons = append(rejectedReasons, rejection.Reason)
+		} else if err == nil {
+			added++
+		}
 	}
 
 	if err := transaction.Commit(); err != nil {
 		action.logger.Error("Failed to commit transaction", err)
+		return
+	}
+
+	for range added {
+		metrics.TorrentAdded(action.account.GetName())
+	}
+
+	for _, reason := range rejectedReasons {
+		metrics.TorrentRejected(action.account.GetName(), reason)
+	}
+}
+
+// Whether the rejection was recorded
+func (action *Actioner) rejectEntry(transaction *sql.Tx, torrent *provider.Torrent, rejection media_service.TorrentRejectedError) bool {
+	retryAt, err := action.mediaService.RejectTorrent(transaction, action.account, torrent, rejection)
+	if err != nil {
+		action.logger.Error("Failed to reject torrent", err, logger.TorrentId, torrent.ID)
+		return false
+	}
+
+	fields := []any{logger.TorrentId, torrent.ID, "name", torrent.Name, "reason", rejection.Error()}
+
+	if retryAt.IsZero() {
+		action.logger.Warn("Rejected entry", fields...)
+		return true
 	}
+
+	action.logger.Warn("Rejected entry", append(fields, "retry_at", retryAt.Format(time.RFC3339))...)
+
+	return true
+}
+
+// Whether torrents are waiting to be added or held removals were confirmed, so polling is needed even when nothing changed
+func (actioner *Actioner) HasPendingTorrents() bool {
+	return actioner.mediaService.HasPendingTorrents(actioner.account)
 }
 
-func (a *Actioner) cleanupRemovedEntries(torrents []*real_debrid_api.Torrent) {
-	torrentMap := make(map[string]bool, len(torrents))
-	for _, torrent := range torrents {
-		torrentMap[torrent.ID] = true
+// Only torrents that are missing from the snapshot are looked at
+func (a *Actioner) cleanupRemovedEntries(ctx context.Context) {
+	removedTorrents, err := a.mediaRepository.GetTorrentsMissingFromSnapshot(a.account.GetName())
+	if err != nil {
+		a.logger.Error("Failed to get removed torrents from database", err)
+		return
 	}
 
 	transaction, err := a.mediaService.NewTransaction()
@@ -159,30 +261,60 @@ func (a *Actioner) cleanupRemovedEntries(torrents []*real_debrid_api.Torrent) {
 	}
 	defer transaction.Rollback()
 
-	databaseTorrents, err := a.mediaService.GetTorrents()
+	err = a.mediaRepository.RemoveResolvedHeldRemovals(transaction, a.account.GetName())
 	if err != nil {
-		a.logger.Error("Failed to get torrents from database", err)
+		a.logger.Error("Failed to remove resolved held removals", err)
 		return
 	}
 
-	for _, dbTorrent := range databaseTorrents {
-		_, err := transaction.Exec("SAVEPOINT remove_entry")
+	removedTorrents, err = a.guardRemovals(transaction, removedTorrents)
+	if err != nil {
+		a.logger.Error("Failed to check removals against the guard", err)
+		return
+	}
+
+	torrentFiles := make(map[string][]*media_repository.TorrentFile, len(removedTorrents))
+	allTorrentFiles := make([]*media_repository.TorrentFile, 0)
+
+	for _, dbTorrent := range removedTorrents {
+		files, err := a.mediaRepository.GetTorrentFiles(dbTorrent)
 		if err != nil {
-			a.logger.Error("Failed to create savepoint", err)
-			continue
+			a.logger.Error("Failed to get torrent files", err, logger.TorrentId, dbTorrent.GetTorrentIdentifier())
+			return
+		}
+
+		torrentFiles[dbTorrent.GetTorrentIdentifier()] = files
+		allTorrentFiles = append(allTorrentFiles, files...)
+	}
+
+	// Looked up before the torrents are deleted, a dangling symlink can't be traced back
+	symlinks := a.mediaService.FindSymlinks(allTorrentFiles)
+	removedFiles := make([]*media_repository.TorrentFile, 0, len(allTorrentFiles))
+	removed := 0
+
+	for _, dbTorrent := range removedTorrents {
+		if ctx.Err() != nil {
+			break
 		}
 
 		torrentID := dbTorrent.GetTorrentIdentifier()
-		if torrentMap[torrentID] {
-			// Exists
+
+		_, err := transaction.Exec("SAVEPOINT remove_entry")
+		if err != nil {
+			a.logger.Error("Failed to create savepoint", err)
 			continue
 		}
 
-		a.logger.Info(fmt.Sprintf("Removing entry: %s [%s]", dbTorrent.GetName(), torrentID))
+		a.logger.Info("Removing entry", logger.TorrentId, torrentID, "name", dbTorrent.GetName())
 
 		err = a.mediaService.DeleteTorrent(transaction, dbTorrent, false)
+		if err == nil {
+			err = a.mediaRepository.RemoveHeldRemoval(transaction, dbTorrent.GetAccount(), torrentID)
+		}
+
 		if err != nil {
-			a.logger.Error(fmt.Sprintf("Failed to delete torrent: %s", torrentID), err)
+			transaction.Exec("ROLLBACK TO SAVEPOINT remove_entry")
+			a.logger.Error("Failed to delete torrent", err, logger.TorrentId, torrentID)
 			continue
 		}
 
@@ -192,78 +324,46 @@ func (a *Actioner) cleanupRemovedEntries(torrents []*real_debrid_api.Torrent) {
 			continue
 		}
 
-		a.logger.Info(fmt.Sprintf("Removed entry: %s [%s]", dbTorrent.GetName(), torrentID))
+		removedFiles = append(removedFiles, torrentFiles[torrentID]...)
+		removed++
+
+		a.logger.Info("Removed entry", logger.TorrentId, torrentID, "name", dbTorrent.GetName())
 	}
 
 	if err := transaction.Commit(); err != nil {
 		a.logger.Error("Failed to commit transaction", err)
+		return
+	}
+
+	a.mediaService.ForgetStreamUrls(removedFiles)
+	a.mediaService.RemoveSymlinks(symlinks, removedFiles)
+
+	for range removed {
+		metrics.TorrentRemoved(a.account.GetName())
 	}
 }
 
 // Check torrent_files for files that are not in the filesystem
 func (a *Actioner) checkFiles() {
-	databaseTorrents, err := a.mediaService.GetTorrents()
+	orphanedTorrentFiles, err := a.mediaRepository.GetOrphanedTorrentFiles(a.account.GetName(), a.fileSystemPath)
 	if err != nil {
-		a.logger.Error("Failed to get torrents", err)
+		a.logger.Error("Failed to get orphaned torrent files", err)
 		return
 	}
 
-	for _, databaseTorrent := range databaseTorrents {
-		torrentFiles, err := a.mediaRepository.GetTorrentFiles(databaseTorrent)
-		if err != nil {
-			a.logger.Error("Failed to get torrent files", err)
-			continue
-		}
-
-		for _, torrentFile := range torrentFiles {
-			node, err := service.GetFile(a.fileSystem, torrentFile.GetFileIdentifier())
-			if err != nil {
-				a.logger.Error("Failed to get file node", err)
-				continue
-			}
-
-			if node != nil {
-				continue
-			}
-
-			a.logger.Info(fmt.Sprintf("File not found: %d", torrentFile.GetFileIdentifier()))
-
-			tx, err := a.mediaService.NewTransaction()
-			if err != nil {
-				a.logger.Error("Failed to begin transaction", err)
-				continue
-			}
-
-			err = a.mediaRepository.RemoveTorrentFile(tx, torrentFile)
-			if err != nil {
-				a.logger.Error("Failed to remove torrent file", err)
-				tx.Rollback()
-				continue
-			}
-
-			err = tx.Commit()
-			if err != nil {
-				a.logger.Error("Failed to commit transaction", err)
-				continue
-			}
-
-			a.logger.Info(fmt.Sprintf("Deleted file: %d", torrentFile.GetFileIdentifier()))
-		}
+	if len(orphanedTorrentFiles) > 0 {
+		a.removeOrphanedTorrentFiles(orphanedTorrentFiles)
 	}
 
-	// for each `torrents` where `torrent_files.torrent_id` is not in `torrents`
-	for _, databaseTorrent := range databaseTorrents {
-		torrentFiles, err := a.mediaRepository.GetTorrentFiles(databaseTorrent)
-		if err != nil {
-			a.logger.Error("Failed to get torrent files", err)
-			continue
-		}
-
-		if len(torrentFiles) > 0 {
-			continue
-		}
+	// Torrents that lost all of their files
+	emptyTorrents, err := a.mediaRepository.GetTorrentsWithoutFiles(a.account.GetName())
+	if err != nil {
+		a.logger.Error("Failed to get torrents without files", err)
+		return
+	}
 
-		a.logger.Info(fmt.Sprintf("Removing torrent: %s", databaseTorrent.GetTorrentIdentifier()))
+	for _, databaseTorrent := range emptyTorrents {
+		a.logger.Info("Removing torrent without files", logger.TorrentId, databaseTorrent.GetTorrentIdentifier())
 
 		tx, err := a.mediaService.NewTransaction()
 		if err != nil {
@@ -273,7 +373,7 @@ func (a *Actioner) checkFiles() {
 
 		err = a.mediaService.DeleteTorrent(tx, databaseTorrent, true)
 		if err != nil {
-			a.logger.Error("Failed to delete torrent", err)
+			a.logger.Error("Failed to delete torrent", err, logger.TorrentId, databaseTorrent.GetTorrentIdentifier())
 			tx.Rollback()
 			continue
 		}
@@ -284,43 +384,35 @@ func (a *Actioner) checkFiles() {
 			continue
 		}
 
-		a.logger.Info(fmt.Sprintf("Deleted torrent: %s", databaseTorrent.GetTorrentIdentifier()))
-	}
-}
-
-func filterDownloadedEntries(torrents []*real_debrid_api.Torrent) []*real_debrid_api.Torrent {
-	var entries []*real_debrid_api.Torrent
+		metrics.TorrentRemoved(databaseTorrent.GetAccount())
 
-	for _, torrent := range torrents {
-		if torrent.Status != "downloaded" || torrent.Bytes == 0 {
-			continue
-		}
-
-		entries = append(entries, torrent)
+		a.logger.Info("Deleted torrent", logger.TorrentId, databaseTorrent.GetTorrentIdentifier())
 	}
-
-	return entries
 }
 
-func getAllTorrents(client *real_debrid.Client, fetched_torrents []*real_debrid_api.Torrent, total_torrent_count int, page uint) ([]*real_debrid_api.Torrent, error) {
-	const limit = uint(5000)
-
-	torrents, total, err := real_debrid_api.GetTorrents(client, limit, page)
+func (a *Actioner) removeOrphanedTorrentFiles(torrentFiles []*media_repository.TorrentFile) {
+	tx, err := a.mediaService.NewTransaction()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get torrents: %w", err)
+		a.logger.Error("Failed to begin transaction", err)
+		return
 	}
+	defer tx.Rollback()
 
-	if torrents == nil {
-		return nil, fmt.Errorf("empty torrents response from API")
-	}
+	for _, torrentFile := range torrentFiles {
+		a.logger.Warn("File not found", logger.NodeId, torrentFile.GetFileIdentifier())
 
-	fetched_torrents = append(fetched_torrents, torrents...)
+		err = a.mediaRepository.RemoveTorrentFile(tx, torrentFile)
+		if err != nil {
+			a.logger.Error("Failed to remove torrent file", err)
+			return
+		}
+	}
 
-	if len(fetched_torrents) >= total_torrent_count {
-		fmt.Printf("Fetched %d/%d torrents\n", len(fetched_torrents), total)
-		return fetched_torrents, nil
+	err = tx.Commit()
+	if err != nil {
+		a.logger.Error("Failed to commit transaction", err)
+		return
 	}
 
-	page++
-	return getAllTorrents(client, fetched_torrents, total_torrent_count, page)
+	a.logger.Info(fmt.Sprintf("Deleted %d files", len(torrentFiles)))
 }
@@ -0,0 +1,68 @@
+package action
+
+import (
+	"fmt"
+
+	"debrid_drive/provider"
+)
+
+// Brings the stored snapshot in line with the api listing, only rows that were added, changed or removed are written
+func (actioner *Actioner) updateSnapshots(torrents []*provider.Torrent) (map[string]*provider.Torrent, error) {
+	snapshots, err := actioner.mediaRepository.GetTorrentSnapshots(actioner.account.GetName())
+	if err != nil {
+		return nil, err
+	}
+
+	torrentMap := make(map[string]*provider.Torrent, len(torrents))
+	for _, torrent := range torrents {
+		torrentMap[torrent.ID] = torrent
+	}
+
+	transaction, err := actioner.mediaService.NewTransaction()
+	if err != nil {
+		return nil, err
+	}
+	defer transaction.Rollback()
+
+	var added, changed, removed int
+
+	for _, torrent := range torrentMap {
+		snapshot, ok := snapshots[torrent.ID]
+
+		switch {
+		case !ok:
+			added++
+		case snapshot.Differs(torrent):
+			changed++
+		default:
+			continue
+		}
+
+		err = actioner.mediaRepository.SaveTorrentSnapshot(transaction, actioner.account.GetName(), torrent)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for torrentIdentifier := range snapshots {
+		if _, ok := torrentMap[torrentIdentifier]; ok {
+			continue
+		}
+
+		removed++
+
+		err = actioner.mediaRepository.RemoveTorrentSnapshot(transaction, actioner.account.GetName(), torrentIdentifier)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = transaction.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	actioner.logger.Info(fmt.Sprintf("Snapshot updated: %d added, %d changed, %d removed", added, changed, removed))
+
+	return torrentMap, nil
+}
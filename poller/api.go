@@ -0,0 +1,41 @@
+package poller
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+
+	"debrid_drive/provider"
+)
+
+// Newest torrents are listed first, so a small page covers new additions and recent status changes
+const apiDetectorPageSize = 100
+
+var _ Detector = &apiDetector{}
+
+// Fingerprints the torrents api: the total count plus id, status and added time of the newest torrents
+type apiDetector struct {
+	provider provider.Provider
+}
+
+func NewApiDetector(provider provider.Provider) Detector {
+	return &apiDetector{
+		provider: provider,
+	}
+}
+
+func (detector *apiDetector) Hash() ([32]byte, error) {
+	torrents, total, err := detector.provider.ListRecentTorrents(apiDetectorPageSize)
+	if err != nil {
+		return [32]byte{}, fmt.Errorf("failed to get torrents: %w", err)
+	}
+
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "%d\n", total)
+
+	for _, torrent := range torrents {
+		fmt.Fprintf(&builder, "%s\t%s\t%s\n", torrent.ID, torrent.Status, torrent.Added)
+	}
+
+	return sha256.Sum256([]byte(builder.String())), nil
+}
@@ -2,48 +2,49 @@ package poller
 
 import (
 	"context"
-	"net/http"
+	"sync/atomic"
 	"time"
 )
 
-type changeFunc func(hash [32]byte)
+// A failed change is retried on the next tick, ctx is cancelled when the poller stops
+type changeFunc func(ctx context.Context, hash [32]byte) error
 
-type poller struct {
-	url     string
-	element string
-	action  func(hash [32]byte)
+// Detector fingerprints the remote state, a different hash means something changed
+type Detector interface {
+	Hash() ([32]byte, error)
+}
+
+type Poller struct {
+	detector Detector
+	action   changeFunc
+	pending  func() bool
 
-	lastHash [32]byte
-	client   *http.Client
-	req      *http.Request
-	ticks    time.Duration
+	lastHash    [32]byte
+	lastSuccess atomic.Int64
+	ticks       time.Duration
+	retune      chan time.Duration
 
 	ctx    context.Context
 	cancel context.CancelFunc
 }
 
-func New(url string, element string, ticks time.Duration, action func(hash [32]byte)) *poller {
-	client := setupHttpClient()
-	req := createRequest(url)
-
+func New(detector Detector, ticks time.Duration, action changeFunc) *Poller {
 	ctx, cancel := context.WithCancel(context.Background())
 
-	return &poller{
-		url:     url,
-		element: element,
-		action:  action,
+	return &Poller{
+		detector: detector,
+		action:   action,
 
 		lastHash: [32]byte{},
-		client:   client,
-		req:      req,
 		ticks:    ticks,
+		retune:   make(chan time.Duration, 1),
 
 		ctx:    ctx,
 		cancel: cancel,
 	}
 }
 
-func (p *poller) Start() {
+func (p *Poller) Start() {
 	p.exec()
 
 	ticker := time.NewTicker(p.ticks)
@@ -53,25 +54,60 @@ func (p *poller) Start() {
 		select {
 		case <-p.ctx.Done():
 			return
+		case ticks := <-p.retune:
+			p.ticks = ticks
+			ticker.Reset(ticks)
 		case <-ticker.C:
 			p.exec()
 		}
 	}
 }
 
-func (p *poller) Stop() {
+// Pending reports work that is due without a remote change, the action then runs on the next tick regardless of the hash
+// Must be set before Start
+func (p *Poller) SetPending(pending func() bool) {
+	p.pending = pending
+}
+
+// Changes the interval between polls, takes effect from the next tick
+func (p *Poller) SetInterval(ticks time.Duration) {
+	select {
+	case <-p.retune:
+	default:
+	}
+
+	p.retune <- ticks
+}
+
+// Start returns once the change being processed, if any, is done
+func (p *Poller) Stop() {
 	p.cancel()
 }
 
-func (p *poller) exec() {
-	hash, err := getHash(p.client, p.req, p.element)
+// Time of the last tick that detected no change or successfully processed one, zero before the first
+func (p *Poller) LastSuccess() time.Time {
+	lastSuccess := p.lastSuccess.Load()
+	if lastSuccess == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, lastSuccess)
+}
+
+func (p *Poller) exec() {
+	hash, err := p.detector.Hash()
 	if err != nil {
 		return
 	}
 
-	if hash != p.lastHash {
+	if hash != p.lastHash || (p.pending != nil && p.pending()) {
+		err = p.action(p.ctx, hash)
+		if err != nil {
+			return
+		}
+
 		p.lastHash = hash
-		p.action(hash)
 	}
-}
 
+	p.lastSuccess.Store(time.Now().UnixNano())
+}
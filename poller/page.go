@@ -0,0 +1,26 @@
+package poller
+
+import (
+	"net/http"
+)
+
+var _ Detector = &pageDetector{}
+
+// Hashes an element of a html page, e.g. the torrents table on your personal real debrid page
+type pageDetector struct {
+	element string
+	client  *http.Client
+	req     *http.Request
+}
+
+func NewPageDetector(url string, element string) Detector {
+	return &pageDetector{
+		element: element,
+		client:  setupHttpClient(),
+		req:     createRequest(url),
+	}
+}
+
+func (detector *pageDetector) Hash() ([32]byte, error) {
+	return getHash(detector.client, detector.req, detector.element)
+}
@@ -0,0 +1,244 @@
+package fake
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sync"
+
+	"debrid_drive/provider"
+)
+
+var _ provider.Provider = &Fake{}
+
+// Method names for SetError and GetCalls
+const (
+	MethodListTorrents       = "ListTorrents"
+	MethodListRecentTorrents = "ListRecentTorrents"
+	MethodGetTorrentInfo     = "GetTorrentInfo"
+	MethodUnrestrictLink     = "UnrestrictLink"
+	MethodDelete             = "Delete"
+)
+
+type torrent struct {
+	torrent provider.Torrent
+	files   []provider.TorrentFile
+	links   []string
+}
+
+// In memory provider with scriptable state, for tests and local development
+type Fake struct {
+	mutex       sync.Mutex
+	torrents    []*torrent
+	downloads   map[string]provider.Download
+	unavailable map[string]error
+	errors      map[string]error
+	calls       map[string]int
+	deleted     []string
+}
+
+func New() *Fake {
+	return &Fake{
+		torrents:    make([]*torrent, 0),
+		downloads:   make(map[string]provider.Download),
+		unavailable: make(map[string]error),
+		errors:      make(map[string]error),
+		calls:       make(map[string]int),
+		deleted:     make([]string, 0),
+	}
+}
+
+// Adds a torrent as the newest one, or replaces the torrent with the same id in place
+func (fake *Fake) SetTorrent(torrentValue provider.Torrent, files []provider.TorrentFile, links []string) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	entry := &torrent{torrent: torrentValue, files: files, links: links}
+
+	for index, existing := range fake.torrents {
+		if existing.torrent.ID == torrentValue.ID {
+			fake.torrents[index] = entry
+			return
+		}
+	}
+
+	fake.torrents = append([]*torrent{entry}, fake.torrents...)
+}
+
+func (fake *Fake) RemoveTorrent(id string) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	fake.removeTorrent(id)
+}
+
+func (fake *Fake) removeTorrent(id string) bool {
+	for index, existing := range fake.torrents {
+		if existing.torrent.ID == id {
+			fake.torrents = append(fake.torrents[:index], fake.torrents[index+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// Download returned when the link is unrestricted, links without one get a url derived from the link
+func (fake *Fake) SetDownload(link string, download provider.Download) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	fake.downloads[link] = download
+}
+
+// Unrestricting the link fails with ErrLinkUnavailable
+func (fake *Fake) SetUnavailable(link string) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	fake.unavailable[link] = provider.ErrLinkUnavailable
+}
+
+// Unrestricting the link fails with ErrLinkUnconfirmed, like a hoster that is down
+func (fake *Fake) SetUnconfirmed(link string) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	fake.unavailable[link] = provider.ErrLinkUnconfirmed
+}
+
+// Makes every call of the method fail with err, nil clears it
+func (fake *Fake) SetError(method string, err error) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	if err == nil {
+		delete(fake.errors, method)
+		return
+	}
+
+	fake.errors[method] = err
+}
+
+// Number of times the method was called, including failed calls
+func (fake *Fake) GetCalls(method string) int {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	return fake.calls[method]
+}
+
+// Ids passed to Delete, in order
+func (fake *Fake) GetDeleted() []string {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	return append([]string{}, fake.deleted...)
+}
+
+// Records the call and returns the scripted error of the method, the caller holds the mutex
+func (fake *Fake) call(method string) error {
+	fake.calls[method]++
+
+	return fake.errors[method]
+}
+
+func (fake *Fake) ListTorrents(ctx context.Context) ([]*provider.Torrent, error) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	if err := fake.call(MethodListTorrents); err != nil {
+		return nil, err
+	}
+
+	return fake.list(len(fake.torrents)), nil
+}
+
+func (fake *Fake) ListRecentTorrents(limit int) ([]*provider.Torrent, int, error) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	if err := fake.call(MethodListRecentTorrents); err != nil {
+		return nil, 0, err
+	}
+
+	return fake.list(limit), len(fake.torrents), nil
+}
+
+func (fake *Fake) list(limit int) []*provider.Torrent {
+	torrents := make([]*provider.Torrent, 0, len(fake.torrents))
+
+	for index, entry := range fake.torrents {
+		if index >= limit {
+			break
+		}
+
+		torrentValue := entry.torrent
+		torrents = append(torrents, &torrentValue)
+	}
+
+	return torrents
+}
+
+func (fake *Fake) GetTorrentInfo(id string) (*provider.TorrentInfo, error) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	if err := fake.call(MethodGetTorrentInfo); err != nil {
+		return nil, err
+	}
+
+	for _, entry := range fake.torrents {
+		if entry.torrent.ID != id {
+			continue
+		}
+
+		return &provider.TorrentInfo{
+			ID:    entry.torrent.ID,
+			Name:  entry.torrent.Name,
+			Files: append([]provider.TorrentFile{}, entry.files...),
+			Links: append([]string{}, entry.links...),
+		}, nil
+	}
+
+	return nil, fmt.Errorf("torrent %s not found", id)
+}
+
+// Without a scripted download the filename is the last segment of the url
+func (fake *Fake) UnrestrictLink(link string) (*provider.Download, error) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	if err := fake.call(MethodUnrestrictLink); err != nil {
+		return nil, err
+	}
+
+	if err, ok := fake.unavailable[link]; ok {
+		return nil, fmt.Errorf("%w: %s", err, link)
+	}
+
+	download, ok := fake.downloads[link]
+	if !ok {
+		download.Url = "https://download.fake.invalid/" + link
+		download.Filename = path.Base(download.Url)
+	}
+
+	return &download, nil
+}
+
+func (fake *Fake) Delete(id string) error {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	if err := fake.call(MethodDelete); err != nil {
+		return err
+	}
+
+	if !fake.removeTorrent(id) {
+		return fmt.Errorf("torrent %s not found", id)
+	}
+
+	fake.deleted = append(fake.deleted, id)
+
+	return nil
+}
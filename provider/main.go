@@ -0,0 +1,61 @@
+package provider
+
+import (
+	"context"
+	"errors"
+)
+
+// Torrents with this status are fully downloaded and have links
+const StatusDownloaded = "downloaded"
+
+// Returned by UnrestrictLink when the link itself is dead, e.g. the hoster expired it or the torrent was downloaded again
+var ErrLinkUnavailable = errors.New("Link is unavailable")
+
+// Returned by UnrestrictLink when the link may be dead or its hoster may be down, the provider can't tell which
+// The link is only dead when the torrent has a new link for the file
+var ErrLinkUnconfirmed = errors.New("Link is unavailable or its hoster is down")
+
+// A torrent as listed by the provider
+type Torrent struct {
+	ID     string
+	Name   string
+	Status string
+	Bytes  int
+	Added  string
+}
+
+type TorrentFile struct {
+	ID       int
+	Path     string
+	Bytes    int
+	Selected bool
+}
+
+// Files of a torrent, every selected file has a link in the same order
+// unless the provider packed several files into an archive, then there are fewer links than selected files
+type TorrentInfo struct {
+	ID    string
+	Name  string
+	Files []TorrentFile
+	Links []string
+}
+
+// An unrestricted link
+type Download struct {
+	Url      string
+	Filename string
+	Bytes    int
+}
+
+// A debrid service holding the torrents of an account
+type Provider interface {
+	// Every torrent in the account, an error when the listing could not be completed
+	ListTorrents(ctx context.Context) ([]*Torrent, error)
+	// Newest torrents first, along with the total number of torrents in the account
+	ListRecentTorrents(limit int) ([]*Torrent, int, error)
+	GetTorrentInfo(id string) (*TorrentInfo, error)
+	// Direct download url for a link of a torrent, along with the name and size of the file behind it
+	// Dead links return an error wrapping ErrLinkUnavailable, or ErrLinkUnconfirmed when they can't be told apart from an outage
+	UnrestrictLink(link string) (*Download, error)
+	Delete(id string) error
+}
@@ -0,0 +1,324 @@
+package fake_server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	EndpointTorrents   = "torrents"
+	EndpointInfo       = "info"
+	EndpointUnrestrict = "unrestrict"
+	EndpointDelete     = "delete"
+)
+
+const apiPath = "/rest/1.0"
+
+type Torrent struct {
+	ID       string   `json:"id"`
+	Filename string   `json:"filename"`
+	Bytes    int      `json:"bytes"`
+	Status   string   `json:"status"`
+	Added    string   `json:"added"`
+	Links    []string `json:"links"`
+}
+
+type TorrentFile struct {
+	ID       int    `json:"id"`
+	Path     string `json:"path"`
+	Bytes    int    `json:"bytes"`
+	Selected int    `json:"selected"`
+}
+
+type torrentInfo struct {
+	ID       string        `json:"id"`
+	Filename string        `json:"filename"`
+	Bytes    int           `json:"bytes"`
+	Status   string        `json:"status"`
+	Added    string        `json:"added"`
+	Files    []TorrentFile `json:"files"`
+	Links    []string      `json:"links"`
+}
+
+type entry struct {
+	torrent Torrent
+	files   []TorrentFile
+}
+
+// Status codes returned instead of handling the request, for the next count requests to an endpoint
+type failure struct {
+	statusCode int
+	count      int
+}
+
+// In process Real-Debrid api with scriptable state, serving the torrents list, torrent info, unrestrict and delete endpoints
+type Server struct {
+	server *httptest.Server
+	token  string
+
+	mutex    sync.Mutex
+	torrents []*entry
+	urls     map[string]string
+	failures map[string]*failure
+	requests map[string]int
+	deleted  []string
+}
+
+// Starts a server that only accepts requests with the given token
+func New(token string) *Server {
+	server := &Server{
+		token:    token,
+		torrents: make([]*entry, 0),
+		urls:     make(map[string]string),
+		failures: make(map[string]*failure),
+		requests: make(map[string]int),
+		deleted:  make([]string, 0),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+apiPath+"/torrents", server.handle(EndpointTorrents, server.listTorrents))
+	mux.HandleFunc("GET "+apiPath+"/torrents/info/{id}", server.handle(EndpointInfo, server.getTorrentInfo))
+	mux.HandleFunc("POST "+apiPath+"/unrestrict/link", server.handle(EndpointUnrestrict, server.unrestrictLink))
+	mux.HandleFunc("DELETE "+apiPath+"/torrents/delete/{id}", server.handle(EndpointDelete, server.deleteTorrent))
+
+	server.server = httptest.NewServer(mux)
+
+	return server
+}
+
+func (server *Server) Close() {
+	server.server.Close()
+}
+
+func (server *Server) GetUrl() string {
+	return server.server.URL
+}
+
+// Http client that sends requests for the Real-Debrid api host to this server
+func (server *Server) Client() *http.Client {
+	target, _ := url.Parse(server.server.URL)
+
+	return &http.Client{
+		Transport: &rewriteTransport{
+			target:    target,
+			transport: server.server.Client().Transport,
+		},
+	}
+}
+
+type rewriteTransport struct {
+	target    *url.URL
+	transport http.RoundTripper
+}
+
+func (transport *rewriteTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	request = request.Clone(request.Context())
+	request.URL.Scheme = transport.target.Scheme
+	request.URL.Host = transport.target.Host
+	request.Host = transport.target.Host
+
+	return transport.transport.RoundTrip(request)
+}
+
+// Adds a torrent as the newest one, or replaces the torrent with the same id in place
+func (server *Server) SetTorrent(torrent Torrent, files []TorrentFile) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	newEntry := &entry{torrent: torrent, files: files}
+
+	for index, existing := range server.torrents {
+		if existing.torrent.ID == torrent.ID {
+			server.torrents[index] = newEntry
+			return
+		}
+	}
+
+	server.torrents = append([]*entry{newEntry}, server.torrents...)
+}
+
+func (server *Server) removeTorrent(id string) bool {
+	for index, existing := range server.torrents {
+		if existing.torrent.ID == id {
+			server.torrents = append(server.torrents[:index], server.torrents[index+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// Download url returned when the link is unrestricted, links without one are unavailable
+func (server *Server) SetUrl(link string, downloadUrl string) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	server.urls[link] = downloadUrl
+}
+
+// Answers the next count requests to the endpoint with the status code
+func (server *Server) Fail(endpoint string, statusCode int, count int) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	server.failures[endpoint] = &failure{statusCode: statusCode, count: count}
+}
+
+// Number of requests to the endpoint, including failed ones
+func (server *Server) GetRequests(endpoint string) int {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	return server.requests[endpoint]
+}
+
+// Ids of deleted torrents, in order
+func (server *Server) GetDeleted() []string {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	return append([]string{}, server.deleted...)
+}
+
+// Counts the request, checks the token and applies scripted failures before the handler runs with the mutex held
+func (server *Server) handle(endpoint string, handler func(writer http.ResponseWriter, request *http.Request)) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		server.mutex.Lock()
+		defer server.mutex.Unlock()
+
+		server.requests[endpoint]++
+
+		if request.Header.Get("Authorization") != "Bearer "+server.token {
+			writeError(writer, http.StatusUnauthorized, "bad_token")
+			return
+		}
+
+		if failure, ok := server.failures[endpoint]; ok && failure.count > 0 {
+			failure.count--
+			writeError(writer, failure.statusCode, "scripted_failure")
+			return
+		}
+
+		handler(writer, request)
+	}
+}
+
+func (server *Server) listTorrents(writer http.ResponseWriter, request *http.Request) {
+	limit, err := strconv.Atoi(request.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = 100
+	}
+
+	page, err := strconv.Atoi(request.URL.Query().Get("page"))
+	if err != nil || page <= 0 {
+		page = 1
+	}
+
+	start := (page - 1) * limit
+	if start >= len(server.torrents) {
+		writer.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	end := min(start+limit, len(server.torrents))
+
+	torrents := make([]Torrent, 0, end-start)
+	for _, entry := range server.torrents[start:end] {
+		torrents = append(torrents, entry.torrent)
+	}
+
+	writer.Header().Set("X-Total-Count", strconv.Itoa(len(server.torrents)))
+	writeJson(writer, http.StatusOK, torrents)
+}
+
+func (server *Server) getTorrentInfo(writer http.ResponseWriter, request *http.Request) {
+	for _, entry := range server.torrents {
+		if entry.torrent.ID != request.PathValue("id") {
+			continue
+		}
+
+		writeJson(writer, http.StatusOK, torrentInfo{
+			ID:       entry.torrent.ID,
+			Filename: entry.torrent.Filename,
+			Bytes:    entry.torrent.Bytes,
+			Status:   entry.torrent.Status,
+			Added:    entry.torrent.Added,
+			Files:    entry.files,
+			Links:    entry.torrent.Links,
+		})
+
+		return
+	}
+
+	writeError(writer, http.StatusNotFound, "unknown_ressource")
+}
+
+func (server *Server) unrestrictLink(writer http.ResponseWriter, request *http.Request) {
+	// The client sends the form without a content type, which Real-Debrid accepts
+	body, err := io.ReadAll(request.Body)
+	if err != nil {
+		writeError(writer, http.StatusBadRequest, "parameter_missing")
+		return
+	}
+
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		writeError(writer, http.StatusBadRequest, "parameter_missing")
+		return
+	}
+
+	link := form.Get("link")
+
+	downloadUrl, ok := server.urls[link]
+	if !ok {
+		writeError(writer, http.StatusServiceUnavailable, "file_unavailable")
+		return
+	}
+
+	writeJson(writer, http.StatusOK, map[string]any{
+		"id":       strings.TrimPrefix(link, "https://real-debrid.com/d/"),
+		"filename": path.Base(downloadUrl),
+		"filesize": 0,
+		"link":     link,
+		"download": downloadUrl,
+	})
+}
+
+func (server *Server) deleteTorrent(writer http.ResponseWriter, request *http.Request) {
+	id := request.PathValue("id")
+
+	if !server.removeTorrent(id) {
+		writeError(writer, http.StatusNotFound, "unknown_ressource")
+		return
+	}
+
+	server.deleted = append(server.deleted, id)
+
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+func writeJson(writer http.ResponseWriter, statusCode int, value any) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(statusCode)
+	json.NewEncoder(writer).Encode(value)
+}
+
+func writeError(writer http.ResponseWriter, statusCode int, message string) {
+	writeJson(writer, statusCode, map[string]any{
+		"error":      message,
+		"error_code": statusCode,
+	})
+}
+
+// Link in the format Real-Debrid uses for hoster links
+func Link(id string) string {
+	return fmt.Sprintf("https://real-debrid.com/d/%s", id)
+}
@@ -0,0 +1,122 @@
+package real_debrid
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"debrid_drive/provider"
+
+	real_debrid_client "github.com/sushydev/real_debrid_go"
+	real_debrid_api "github.com/sushydev/real_debrid_go/api"
+)
+
+var _ provider.Provider = &RealDebrid{}
+
+type RealDebrid struct {
+	client *real_debrid_client.Client
+}
+
+func New(token string, httpClient *http.Client) *RealDebrid {
+	return &RealDebrid{
+		client: real_debrid_client.NewClient(token, httpClient),
+	}
+}
+
+func (realDebrid *RealDebrid) ListTorrents(ctx context.Context) ([]*provider.Torrent, error) {
+	torrents, err := getAllTorrents(ctx, realDebrid.client)
+	if err != nil {
+		return nil, err
+	}
+
+	return toTorrents(torrents), nil
+}
+
+func (realDebrid *RealDebrid) ListRecentTorrents(limit int) ([]*provider.Torrent, int, error) {
+	torrents, total, err := real_debrid_api.GetTorrents(realDebrid.client, uint(limit), 1)
+	if err != nil {
+		if isNoContent(err) {
+			return []*provider.Torrent{}, 0, nil
+		}
+
+		return nil, 0, err
+	}
+
+	return toTorrents(torrents), total, nil
+}
+
+func (realDebrid *RealDebrid) GetTorrentInfo(id string) (*provider.TorrentInfo, error) {
+	torrentInfo, err := real_debrid_api.GetTorrentInfo(realDebrid.client, id)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]provider.TorrentFile, 0, len(torrentInfo.Files))
+	for _, file := range torrentInfo.Files {
+		files = append(files, provider.TorrentFile{
+			ID:       file.ID,
+			Path:     file.Path,
+			Bytes:    file.Bytes,
+			Selected: file.Selected == 1,
+		})
+	}
+
+	return &provider.TorrentInfo{
+		ID:    torrentInfo.ID,
+		Name:  torrentInfo.Filename,
+		Files: files,
+		Links: torrentInfo.Links,
+	}, nil
+}
+
+func (realDebrid *RealDebrid) UnrestrictLink(link string) (*provider.Download, error) {
+	response, err := real_debrid_api.UnrestrictLink(realDebrid.client, link)
+	if err != nil {
+		if isLinkUnavailable(err) {
+			return nil, fmt.Errorf("%w: %v", provider.ErrLinkUnavailable, err)
+		}
+
+		if isServiceUnavailable(err) {
+			return nil, fmt.Errorf("%w: %v", provider.ErrLinkUnconfirmed, err)
+		}
+
+		return nil, err
+	}
+
+	return &provider.Download{
+		Url:      response.Download,
+		Filename: response.Filename,
+		Bytes:    int(response.FileSize),
+	}, nil
+}
+
+func (realDebrid *RealDebrid) Delete(id string) error {
+	return real_debrid_api.Delete(realDebrid.client, id)
+}
+
+// The client drops the error body, unknown links are answered with 404 (unknown_ressource)
+func isLinkUnavailable(err error) bool {
+	return err.Error() == "[404] Unknown error"
+}
+
+// Dead links (file_unavailable) and hoster outages (hoster_unavailable) are both answered with 503, without the body they look the same
+func isServiceUnavailable(err error) bool {
+	return strings.HasPrefix(err.Error(), "Service unavailable")
+}
+
+func toTorrents(torrents []*real_debrid_api.Torrent) []*provider.Torrent {
+	converted := make([]*provider.Torrent, 0, len(torrents))
+
+	for _, torrent := range torrents {
+		converted = append(converted, &provider.Torrent{
+			ID:     torrent.ID,
+			Name:   torrent.Filename,
+			Status: torrent.Status,
+			Bytes:  torrent.Bytes,
+			Added:  torrent.Added,
+		})
+	}
+
+	return converted
+}
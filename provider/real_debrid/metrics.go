@@ -0,0 +1,58 @@
+package real_debrid
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"debrid_drive/metrics"
+)
+
+const apiPrefix = "/rest/1.0"
+
+// Records the latency and status code of every api call of an account
+type instrumentedTransport struct {
+	account string
+	next    http.RoundTripper
+}
+
+// A copy of the client whose calls are recorded in the provider metrics of the account
+func Instrument(account string, httpClient *http.Client) *http.Client {
+	next := httpClient.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	instrumented := *httpClient
+	instrumented.Transport = &instrumentedTransport{account: account, next: next}
+
+	return &instrumented
+}
+
+func (transport *instrumentedTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	start := time.Now()
+	response, err := transport.next.RoundTrip(request)
+
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(response.StatusCode)
+	}
+
+	metrics.ObserveProviderRequest(transport.account, endpointOf(request.URL.Path), code, time.Since(start))
+
+	return response, err
+}
+
+// The path without the api prefix and torrent ids, e.g. /torrents/info/{id}
+func endpointOf(path string) string {
+	path = strings.TrimPrefix(path, apiPrefix)
+
+	for _, prefix := range []string{"/torrents/info/", "/torrents/delete/", "/torrents/selectFiles/"} {
+		if strings.HasPrefix(path, prefix) {
+			return prefix + "{id}"
+		}
+	}
+
+	return path
+}
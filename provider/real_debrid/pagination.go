@@ -0,0 +1,163 @@
+package real_debrid
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	real_debrid_client "github.com/sushydev/real_debrid_go"
+	real_debrid_api "github.com/sushydev/real_debrid_go/api"
+)
+
+const (
+	pageLimit         = uint(5000)
+	maxPageAttempts   = 5
+	maxListAttempts   = 3
+	initialRetryDelay = 2 * time.Second
+)
+
+var statusCodePattern = regexp.MustCompile(`^\[(\d{3})\]`)
+
+var _ error = IncompleteListingError{}
+
+type IncompleteListingError struct {
+	Fetched int
+	Total   int
+}
+
+func (err IncompleteListingError) Error() string {
+	return fmt.Sprintf("incomplete torrents listing: fetched %d of %d", err.Fetched, err.Total)
+}
+
+// Fetches every page of the torrents listing
+// The listing is restarted when the account changes while paging, and an error is returned unless every torrent was fetched
+func getAllTorrents(ctx context.Context, client *real_debrid_client.Client) ([]*real_debrid_api.Torrent, error) {
+	var err error
+
+	for attempt := 1; attempt <= maxListAttempts; attempt++ {
+		var torrents []*real_debrid_api.Torrent
+
+		torrents, err = listTorrents(ctx, client)
+		if err == nil {
+			return torrents, nil
+		}
+
+		if !errors.As(err, &IncompleteListingError{}) {
+			return nil, err
+		}
+	}
+
+	return nil, err
+}
+
+func listTorrents(ctx context.Context, client *real_debrid_client.Client) ([]*real_debrid_api.Torrent, error) {
+	fetchedTorrents := make([]*real_debrid_api.Torrent, 0)
+	seen := make(map[string]bool)
+	total := -1
+
+	for page := uint(1); ; page++ {
+		torrents, pageTotal, err := getTorrentsPage(ctx, client, page)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get torrents page %d: %w", page, err)
+		}
+
+		if torrents == nil {
+			// No content, the previous page was the last one
+			break
+		}
+
+		if total != -1 && pageTotal != total {
+			// Torrents were added or removed while paging, items may have shifted between pages
+			return nil, IncompleteListingError{Fetched: len(fetchedTorrents), Total: pageTotal}
+		}
+
+		total = pageTotal
+
+		for _, torrent := range torrents {
+			if seen[torrent.ID] {
+				continue
+			}
+
+			seen[torrent.ID] = true
+			fetchedTorrents = append(fetchedTorrents, torrent)
+		}
+
+		if len(fetchedTorrents) >= total || uint(len(torrents)) < pageLimit {
+			break
+		}
+	}
+
+	if total == -1 {
+		total = 0
+	}
+
+	if len(fetchedTorrents) < total {
+		return nil, IncompleteListingError{Fetched: len(fetchedTorrents), Total: total}
+	}
+
+	return fetchedTorrents, nil
+}
+
+// Retries a single page with exponential backoff on rate limits and server errors
+// Returns nil torrents when the page has no content
+func getTorrentsPage(ctx context.Context, client *real_debrid_client.Client, page uint) ([]*real_debrid_api.Torrent, int, error) {
+	delay := initialRetryDelay
+
+	for attempt := 1; ; attempt++ {
+		torrents, total, err := real_debrid_api.GetTorrents(client, pageLimit, page)
+		if err == nil {
+			return torrents, total, nil
+		}
+
+		if isNoContent(err) {
+			return nil, 0, nil
+		}
+
+		if attempt >= maxPageAttempts || !isRetryable(err) {
+			return nil, 0, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		case <-time.After(delay):
+		}
+
+		delay *= 2
+	}
+}
+
+func isNoContent(err error) bool {
+	return err.Error() == "No content"
+}
+
+// Rate limits, server errors and network errors are worth another try
+func isRetryable(err error) bool {
+	var urlError *url.Error
+	if errors.As(err, &urlError) {
+		return true
+	}
+
+	message := err.Error()
+
+	if strings.HasPrefix(message, "Service unavailable") || strings.HasPrefix(message, "Service timeout") {
+		return true
+	}
+
+	match := statusCodePattern.FindStringSubmatch(message)
+	if match == nil {
+		return false
+	}
+
+	statusCode, err := strconv.Atoi(match[1])
+	if err != nil {
+		return false
+	}
+
+	return statusCode == 429 || statusCode >= 500
+}